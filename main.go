@@ -9,11 +9,10 @@ import (
 	"github.com/Dataman-Cloud/janitor/src/janitor"
 
 	log "github.com/Sirupsen/logrus"
-
-	//"github.com/urfave/cli"
+	"github.com/urfave/cli"
 )
 
-var stopWait chan bool
+var stopWait = make(chan bool, 1)
 var cleanFuncs []func()
 
 func SetupLogger() {
@@ -27,38 +26,80 @@ func SetupLogger() {
 	log.SetLevel(log.DebugLevel)
 }
 
-func LoadConfig() config.Config {
-	return config.DefaultConfig()
+func LoadConfig(c *cli.Context) (*config.Loader, config.Config, error) {
+	loader := config.NewLoader(c)
+	config, err := loader.Load()
+	return loader, config, err
 }
 
 func TuneGolangProcess() {}
 
-func RegisterSignalHandler() {
+// RegisterSignalHandler reloads the config on SIGHUP, hands the listeners
+// over to a new janitor process on SIGUSR2 and runs the clean funcs on
+// SIGINT or SIGTERM
+func RegisterSignalHandler(loader *config.Loader, server *janitor.JanitorServer) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 
 	go func() {
-		<-sigs
-		for _, fn := range cleanFuncs {
-			fn()
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				log.Info("SIGHUP received, reloading config")
+				newConfig, err := loader.Load()
+				if err != nil {
+					log.Errorf("reload config got err, keep the running one: %s", err)
+					continue
+				}
+				server.Reload(newConfig)
+				continue
+			}
+
+			if sig == syscall.SIGUSR2 {
+				log.Info("SIGUSR2 received, upgrading janitor")
+				if err := server.Upgrade(); err != nil {
+					log.Errorf("upgrade got err, keep running: %s", err)
+					continue
+				}
+				server.Handover()
+				stopWait <- true
+				return
+			}
+
+			for _, fn := range cleanFuncs {
+				fn()
+			}
+
+			stopWait <- true
+			return
 		}
-
-		stopWait <- true
 	}()
 }
 
 func main() {
-	config := LoadConfig()
+	app := cli.NewApp()
+	app.Name = "janitor"
+	app.Usage = "a proxy with service discovery and load balance"
+	app.Flags = config.Flags()
+	app.Action = func(c *cli.Context) error {
+		loader, config, err := LoadConfig(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		TuneGolangProcess()
+		SetupLogger()
 
-	TuneGolangProcess()
-	SetupLogger()
+		server := janitor.NewJanitorServer(config)
+		server.Init()
+		cleanFuncs = append(cleanFuncs, func() {
+			server.Shutdown()
+		})
+		RegisterSignalHandler(loader, server)
 
-	server := janitor.NewJanitorServer(config)
-	server.Init().Run()
-	cleanFuncs = append(cleanFuncs, func() {
-		server.Shutdown()
-	})
+		go server.Run()
+		<-stopWait
+		return nil
+	}
 
-	//<-stopWait
-	//register signal handler
+	app.Run(os.Args)
 }
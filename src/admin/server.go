@@ -0,0 +1,491 @@
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
+	"github.com/Dataman-Cloud/janitor/src/service"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	API_PREFIX = "/api"
+
+	// proto of the admin listener key in the listener manager, so that
+	// the admin listener is handed over on upgrade like the others
+	ADMIN_PROTO = "admin"
+
+	// states of an upstream: served by a pod listening on its frontend,
+	// still served on another frontend by a pod failing to move, or not
+	// served yet
+	UPSTREAM_STATE_LISTENING = "listening"
+	UPSTREAM_STATE_MOVING    = "moving"
+	UPSTREAM_STATE_PENDING   = "pending"
+)
+
+// Janitor is what the admin api reads from a running janitor server
+type Janitor interface {
+	Upstreams() []*upstream.Upstream
+	Pods() []*service.ServicePod
+	PortsOccupied() []string
+	ClusterAddressList(prefix string) ([]string, error)
+	ServiceActvities(serviceName string) ([]string, error)
+	Overrides() *upstream.Overrides
+	LogServiceActivity(serviceName, activity string)
+	UpstreamsStale() (bool, time.Time)
+	Conflicts() []upstream.FrontendConflict
+}
+
+// Server serves the admin api, a set of JSON endpoints over the state of
+// a janitor server
+type Server struct {
+	Addr string
+
+	janitor    Janitor
+	httpServer *http.Server
+}
+
+func NewServer(addr string, janitor Janitor) *Server {
+	server := &Server{
+		Addr:    addr,
+		janitor: janitor,
+	}
+	server.httpServer = &http.Server{Handler: server.Handler()}
+	return server
+}
+
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(API_PREFIX+"/upstreams", server.listUpstreams)
+	mux.HandleFunc(API_PREFIX+"/upstreams/status", server.upstreamsStatus)
+	mux.HandleFunc(API_PREFIX+"/conflicts", server.listConflicts)
+	mux.HandleFunc(API_PREFIX+"/pods", server.listPods)
+	mux.HandleFunc(API_PREFIX+"/ports", server.listPorts)
+	mux.HandleFunc(API_PREFIX+"/cluster-addresses", server.listClusterAddresses)
+	mux.HandleFunc(API_PREFIX+"/overrides", server.listOverrides)
+	mux.HandleFunc(API_PREFIX+"/services/", server.serviceRoutes)
+	mux.Handle(API_PREFIX+"/metrics", expvar.Handler())
+	return mux
+}
+
+// Serve serves the admin api on ln in background
+func (server *Server) Serve(ln net.Listener) {
+	go func() {
+		log.Infof("admin api listening on %s", server.Addr)
+		err := server.httpServer.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin api serve error: %s", err)
+		}
+	}()
+}
+
+func (server *Server) Shutdown() {
+	server.httpServer.Close()
+}
+
+type targetView struct {
+	Node           string
+	Address        string
+	ServiceID      string
+	ServiceAddress string
+	ServicePort    string
+	Metadata       map[string]string `json:",omitempty"`
+	Priority       int               `json:",omitempty"`
+	Weight         int
+	Source         string `json:",omitempty"`
+
+	// connections and http requests in flight to the target
+	Connections int64
+	Requests    int64
+}
+
+type upstreamView struct {
+	ServiceName   string
+	FrontendProto string
+	FrontendIp    string
+	FrontendPort  string
+	Routes        []upstream.Route `json:",omitempty"`
+	Settings      upstream.ServiceSettings
+	Problems      []string `json:",omitempty"`
+	Targets       []targetView
+
+	State       string
+	ServedSince *time.Time `json:",omitempty"` // by the pod serving it
+	Uptime      string     `json:",omitempty"`
+}
+
+type podView struct {
+	ServiceName string
+	Listener    string
+	StartedAt   time.Time
+	Uptime      string
+	Inflight    int64
+}
+
+func (server *Server) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	pods := server.janitor.Pods()
+	views := make([]upstreamView, 0)
+	for _, u := range server.janitor.Upstreams() {
+		view := upstreamView{
+			ServiceName:   u.ServiceName,
+			FrontendProto: u.FrontendProto,
+			FrontendIp:    u.FrontendIp,
+			FrontendPort:  u.FrontendPort,
+			Routes:        u.Routes,
+			Settings:      u.Settings,
+			Problems:      u.Problems,
+			Targets:       make([]targetView, 0, len(u.Targets)),
+		}
+		for _, t := range u.Targets {
+			load := loadbalance.LoadOf(t)
+			view.Targets = append(view.Targets, targetView{
+				Node:           t.Node,
+				Address:        t.Address,
+				ServiceID:      t.ServiceID,
+				ServiceAddress: t.ServiceAddress,
+				ServicePort:    t.ServicePort,
+				Metadata:       t.Metadata,
+				Priority:       t.Priority,
+				Weight:         t.Weight,
+				Source:         t.Source,
+				Connections:    load.Connections,
+				Requests:       load.Requests,
+			})
+		}
+		view.State = UPSTREAM_STATE_PENDING
+		if pod := servingPod(u, pods); pod != nil {
+			view.State = UPSTREAM_STATE_MOVING
+			if pod.Key == u.Key() {
+				view.State = UPSTREAM_STATE_LISTENING
+			}
+			startedAt := pod.StartedAt
+			view.ServedSince, view.Uptime = &startedAt, time.Since(startedAt).String()
+		}
+		views = append(views, view)
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+// servingPod returns the pod listening on the frontend of u, or else the
+// one still serving its service on another frontend
+func servingPod(u *upstream.Upstream, pods []*service.ServicePod) *service.ServicePod {
+	var moving *service.ServicePod
+	for _, pod := range pods {
+		if pod.Key == u.Key() {
+			return pod
+		}
+		if pod.ServiceName == u.ServiceName {
+			moving = pod
+		}
+	}
+	return moving
+}
+
+// upstreamsStatusView tells whether the upstreams are served from the
+// snapshot saved at SnapshotSavedAt, their sources being unreachable
+type upstreamsStatusView struct {
+	Stale           bool
+	SnapshotSavedAt *time.Time `json:",omitempty"`
+}
+
+func (server *Server) upstreamsStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	view := upstreamsStatusView{}
+	if stale, savedAt := server.janitor.UpstreamsStale(); stale {
+		view.Stale = true
+		view.SnapshotSavedAt = &savedAt
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// conflictView is a frontend claimed by several services, Refused are
+// the ones not served
+type conflictView struct {
+	Frontend string
+	Policy   string
+	Served   string `json:",omitempty"`
+	Refused  []string
+	Reason   string `json:",omitempty"`
+}
+
+func (server *Server) listConflicts(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	views := make([]conflictView, 0)
+	for _, conflict := range server.janitor.Conflicts() {
+		views = append(views, conflictView{
+			Frontend: conflict.Key.ToString(),
+			Policy:   conflict.Policy,
+			Served:   conflict.Served,
+			Refused:  conflict.Refused,
+			Reason:   conflict.Reason,
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (server *Server) listPods(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	views := make([]podView, 0)
+	for _, pod := range server.janitor.Pods() {
+		view := podView{
+			ServiceName: pod.ServiceName,
+			Listener:    pod.Key.ToString(),
+			StartedAt:   pod.StartedAt,
+			Uptime:      time.Since(pod.StartedAt).String(),
+		}
+		if pod.Tracker != nil {
+			view.Inflight = pod.Tracker.Inflight()
+		}
+		views = append(views, view)
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (server *Server) listPorts(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.janitor.PortsOccupied())
+}
+
+func (server *Server) listClusterAddresses(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	addresses, err := server.janitor.ClusterAddressList(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, addresses)
+}
+
+// serviceRoutes dispatches the endpoints under /api/services/<name>/
+//
+// * GET /activities
+// * PUT, DELETE /maintenance
+// * PUT, DELETE /drained-targets/<host:port>
+// * POST /static-targets, DELETE /static-targets/<host:port>
+// * PUT, DELETE /target-weights/<host:port>
+func (server *Server) serviceRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, API_PREFIX+"/services/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	serviceName, resource, args := parts[0], parts[1], parts[2:]
+	switch {
+	case resource == "activities" && len(args) == 0:
+		server.listServiceActivities(w, r, serviceName)
+	case resource == "maintenance" && len(args) == 0:
+		server.toggleMaintenance(w, r, serviceName)
+	case resource == "drained-targets" && len(args) == 1:
+		server.toggleDrainedTarget(w, r, serviceName, args[0])
+	case resource == "static-targets" && len(args) == 0:
+		server.addStaticTarget(w, r, serviceName)
+	case resource == "static-targets" && len(args) == 1:
+		server.removeStaticTarget(w, r, serviceName, args[0])
+	case resource == "target-weights" && len(args) == 1:
+		server.toggleTargetWeight(w, r, serviceName, args[0])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (server *Server) listServiceActivities(w http.ResponseWriter, r *http.Request, serviceName string) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	activities, err := server.janitor.ServiceActvities(serviceName)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	nonEmpty := make([]string, 0, len(activities))
+	for _, activity := range activities {
+		if activity != "" {
+			nonEmpty = append(nonEmpty, activity)
+		}
+	}
+	writeJSON(w, http.StatusOK, nonEmpty)
+}
+
+func (server *Server) listOverrides(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.janitor.Overrides().List())
+}
+
+func (server *Server) toggleMaintenance(w http.ResponseWriter, r *http.Request, serviceName string) {
+	switch r.Method {
+	case "PUT":
+		server.janitor.Overrides().SetMaintenance(serviceName, true)
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] put application %s in maintenance", serviceName))
+	case "DELETE":
+		server.janitor.Overrides().SetMaintenance(serviceName, false)
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] put application %s out of maintenance", serviceName))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.janitor.Overrides().List())
+}
+
+func (server *Server) toggleDrainedTarget(w http.ResponseWriter, r *http.Request, serviceName, targetAddr string) {
+	if _, _, err := net.SplitHostPort(targetAddr); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("target %s should be like host:port", targetAddr))
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		server.janitor.Overrides().DrainTarget(serviceName, targetAddr)
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] drain target %s of application %s", targetAddr, serviceName))
+	case "DELETE":
+		if !server.janitor.Overrides().UndrainTarget(serviceName, targetAddr) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("target %s is not drained", targetAddr))
+			return
+		}
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] put target %s of application %s back in rotation", targetAddr, serviceName))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.janitor.Overrides().List())
+}
+
+func (server *Server) addStaticTarget(w http.ResponseWriter, r *http.Request, serviceName string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	target := upstream.Target{Weight: upstream.DEFAULT_WEIGHT}
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if target.ServiceAddress == "" || target.ServicePort == "" {
+		writeError(w, http.StatusBadRequest, "ServiceAddress and ServicePort are required")
+		return
+	}
+	if err := upstream.ValidateWeight(target.Weight); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if target.ServiceID == "" {
+		target.ServiceID = "static-" + target.Addr()
+	}
+
+	server.janitor.Overrides().AddStaticTarget(serviceName, &target)
+	server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] add static target %s to application %s", target.Addr(), serviceName))
+	writeJSON(w, http.StatusCreated, server.janitor.Overrides().List())
+}
+
+func (server *Server) removeStaticTarget(w http.ResponseWriter, r *http.Request, serviceName, targetAddr string) {
+	if r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !server.janitor.Overrides().RemoveStaticTarget(serviceName, targetAddr) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no static target %s", targetAddr))
+		return
+	}
+	server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] remove static target %s from application %s", targetAddr, serviceName))
+	writeJSON(w, http.StatusOK, server.janitor.Overrides().List())
+}
+
+// targetWeightView is the body of PUT /target-weights/<host:port>
+type targetWeightView struct {
+	Weight *int
+}
+
+func (server *Server) toggleTargetWeight(w http.ResponseWriter, r *http.Request, serviceName, targetAddr string) {
+	if _, _, err := net.SplitHostPort(targetAddr); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("target %s should be like host:port", targetAddr))
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var view targetWeightView
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if view.Weight == nil {
+			writeError(w, http.StatusBadRequest, "Weight is required")
+			return
+		}
+		if err := upstream.ValidateWeight(*view.Weight); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		server.janitor.Overrides().SetTargetWeight(serviceName, targetAddr, *view.Weight)
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] set weight of target %s of application %s to %d", targetAddr, serviceName, *view.Weight))
+	case "DELETE":
+		if !server.janitor.Overrides().ClearTargetWeight(serviceName, targetAddr) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("target %s has no weight set", targetAddr))
+			return
+		}
+		server.janitor.LogServiceActivity(serviceName, fmt.Sprintf("[INFO] put weight of target %s of application %s back to the one loaded", targetAddr, serviceName))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.janitor.Overrides().List())
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("encode admin api response error: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"Error": message})
+}
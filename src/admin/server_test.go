@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
+	"github.com/Dataman-Cloud/janitor/src/service"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeJanitor struct {
+	upstreams  []*upstream.Upstream
+	pods       []*service.ServicePod
+	activities map[string][]string
+	overrides  *upstream.Overrides
+	staleAt    time.Time
+	conflicts  []upstream.FrontendConflict
+}
+
+func (f *fakeJanitor) Upstreams() []*upstream.Upstream { return f.upstreams }
+func (f *fakeJanitor) Pods() []*service.ServicePod     { return f.pods }
+func (f *fakeJanitor) PortsOccupied() []string         { return []string{"3412"} }
+func (f *fakeJanitor) ClusterAddressList(prefix string) ([]string, error) {
+	return []string{"http://127.0.0.1:3412"}, nil
+}
+func (f *fakeJanitor) ServiceActvities(serviceName string) ([]string, error) {
+	return f.activities[serviceName], nil
+}
+func (f *fakeJanitor) Overrides() *upstream.Overrides { return f.overrides }
+func (f *fakeJanitor) LogServiceActivity(serviceName, activity string) {
+	f.activities[serviceName] = append(f.activities[serviceName], activity)
+}
+
+func (f *fakeJanitor) UpstreamsStale() (bool, time.Time)      { return !f.staleAt.IsZero(), f.staleAt }
+func (f *fakeJanitor) Conflicts() []upstream.FrontendConflict { return f.conflicts }
+
+func newFakeJanitor() *fakeJanitor {
+	u := &upstream.Upstream{ServiceName: "mesos", FrontendProto: "http", FrontendIp: "127.0.0.1", FrontendPort: "3412"}
+	u.Targets = []*upstream.Target{{ServiceAddress: "192.168.1.103", ServicePort: "5100", Upstream: u}}
+
+	return &fakeJanitor{
+		upstreams:  []*upstream.Upstream{u},
+		pods:       []*service.ServicePod{{Key: u.Key(), ServiceName: "mesos", StartedAt: time.Now()}},
+		activities: map[string][]string{"mesos": {"", "[INFO] preparing serving application mesos"}},
+		overrides:  upstream.NewOverrides(),
+	}
+}
+
+func get(t *testing.T, server *Server, path string, v interface{}) int {
+	return do(t, server, "GET", path, "", v)
+}
+
+func do(t *testing.T, server *Server, method, path, body string, v interface{}) int {
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil {
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), v))
+	}
+	return recorder.Code
+}
+
+func TestListUpstreams(t *testing.T) {
+	server := NewServer("", newFakeJanitor())
+	var views []upstreamView
+	assert.Equal(t, get(t, server, "/api/upstreams", &views), http.StatusOK)
+	assert.Equal(t, len(views), 1)
+	assert.Equal(t, views[0].FrontendPort, "3412")
+	assert.Equal(t, views[0].Targets[0].ServicePort, "5100")
+	assert.Equal(t, views[0].Targets[0].Connections, int64(0))
+	assert.Equal(t, views[0].State, UPSTREAM_STATE_LISTENING)
+	assert.NotNil(t, views[0].ServedSince)
+}
+
+func TestListUpstreamsState(t *testing.T) {
+	janitor := newFakeJanitor()
+	server := NewServer("", janitor)
+	var views []upstreamView
+
+	janitor.pods[0].Key.Port = "3413"
+	assert.Equal(t, get(t, server, "/api/upstreams", &views), http.StatusOK)
+	assert.Equal(t, views[0].State, UPSTREAM_STATE_MOVING)
+
+	janitor.pods, views = nil, nil
+	assert.Equal(t, get(t, server, "/api/upstreams", &views), http.StatusOK)
+	assert.Equal(t, views[0].State, UPSTREAM_STATE_PENDING)
+	assert.Nil(t, views[0].ServedSince)
+	assert.Equal(t, views[0].Uptime, "")
+}
+
+func TestListUpstreamsLoad(t *testing.T) {
+	janitor := newFakeJanitor()
+	server := NewServer("", janitor)
+	done := loadbalance.TrackConnection(janitor.upstreams[0].Targets[0])
+	defer done()
+
+	var views []upstreamView
+	assert.Equal(t, get(t, server, "/api/upstreams", &views), http.StatusOK)
+	assert.Equal(t, views[0].Targets[0].Connections, int64(1))
+	assert.Equal(t, views[0].Targets[0].Requests, int64(0))
+}
+
+func TestUpstreamsStatus(t *testing.T) {
+	janitor := newFakeJanitor()
+	server := NewServer("", janitor)
+	var view upstreamsStatusView
+	assert.Equal(t, get(t, server, "/api/upstreams/status", &view), http.StatusOK)
+	assert.False(t, view.Stale)
+	assert.Nil(t, view.SnapshotSavedAt)
+
+	janitor.staleAt = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, get(t, server, "/api/upstreams/status", &view), http.StatusOK)
+	assert.True(t, view.Stale)
+	assert.Equal(t, view.SnapshotSavedAt.Unix(), janitor.staleAt.Unix())
+}
+
+func TestListConflicts(t *testing.T) {
+	janitor := newFakeJanitor()
+	janitor.conflicts = []upstream.FrontendConflict{{
+		Key:     upstream.UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "3412"},
+		Policy:  upstream.CONFLICT_FIRST_REGISTERED,
+		Served:  "mesos",
+		Refused: []string{"marathon"},
+	}}
+	server := NewServer("", janitor)
+	var views []conflictView
+	assert.Equal(t, get(t, server, "/api/conflicts", &views), http.StatusOK)
+	assert.Equal(t, len(views), 1)
+	assert.Equal(t, views[0].Frontend, "http://127.0.0.1:3412")
+	assert.Equal(t, views[0].Served, "mesos")
+	assert.Equal(t, views[0].Refused, []string{"marathon"})
+
+	var metrics map[string]interface{}
+	assert.Equal(t, get(t, server, "/api/metrics", &metrics), http.StatusOK)
+	_, found := metrics["frontend_conflicts"]
+	assert.True(t, found)
+}
+
+func TestListPods(t *testing.T) {
+	server := NewServer("", newFakeJanitor())
+	var views []podView
+	assert.Equal(t, get(t, server, "/api/pods", &views), http.StatusOK)
+	assert.Equal(t, views[0].Listener, "http://127.0.0.1:3412")
+}
+
+func TestListPortsAndClusterAddresses(t *testing.T) {
+	server := NewServer("", newFakeJanitor())
+	var ports, addresses []string
+	assert.Equal(t, get(t, server, "/api/ports", &ports), http.StatusOK)
+	assert.Equal(t, ports, []string{"3412"})
+	assert.Equal(t, get(t, server, "/api/cluster-addresses?prefix=mesos", &addresses), http.StatusOK)
+	assert.Equal(t, len(addresses), 1)
+}
+
+func TestListServiceActivities(t *testing.T) {
+	server := NewServer("", newFakeJanitor())
+	var activities []string
+	assert.Equal(t, get(t, server, "/api/services/mesos/activities", &activities), http.StatusOK)
+	assert.Equal(t, activities, []string{"[INFO] preparing serving application mesos"})
+	assert.Equal(t, get(t, server, "/api/services/mesos", nil), http.StatusNotFound)
+}
+
+func TestOverrides(t *testing.T) {
+	janitor := newFakeJanitor()
+	server := NewServer("", janitor)
+
+	var overrides []upstream.Override
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/maintenance", "", &overrides), http.StatusOK)
+	assert.True(t, janitor.overrides.InMaintenance("mesos"))
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/drained-targets/192.168.1.103:5100", "", &overrides), http.StatusOK)
+	assert.Equal(t, do(t, server, "POST", "/api/services/mesos/static-targets", `{"ServiceAddress": "10.0.0.1", "ServicePort": "80", "Weight": 1000}`, nil), http.StatusBadRequest)
+	assert.Equal(t, do(t, server, "POST", "/api/services/mesos/static-targets", `{"ServiceAddress": "10.0.0.1", "ServicePort": "80"}`, &overrides), http.StatusCreated)
+	assert.Equal(t, len(overrides), 3)
+	assert.Equal(t, len(janitor.activities["mesos"]), 5)
+
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/maintenance", "", nil), http.StatusOK)
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/drained-targets/192.168.1.103:5100", "", nil), http.StatusOK)
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/drained-targets/192.168.1.103:5100", "", nil), http.StatusNotFound)
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/static-targets/10.0.0.1:80", "", nil), http.StatusOK)
+	assert.Equal(t, get(t, server, "/api/overrides", &overrides), http.StatusOK)
+	assert.Equal(t, len(overrides), 0)
+}
+
+func TestTargetWeights(t *testing.T) {
+	janitor := newFakeJanitor()
+	server := NewServer("", janitor)
+
+	var overrides []upstream.Override
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/target-weights/192.168.1.103:5100", `{"Weight": 0}`, &overrides), http.StatusOK)
+	assert.Equal(t, len(overrides), 1)
+	assert.Equal(t, overrides[0].Kind, upstream.OVERRIDE_WEIGHT)
+	assert.Equal(t, *overrides[0].Weight, 0)
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/target-weights/192.168.1.103:5100", `{}`, nil), http.StatusBadRequest)
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/target-weights/192.168.1.103:5100", `{"Weight": -1}`, nil), http.StatusBadRequest)
+	assert.Equal(t, do(t, server, "PUT", "/api/services/mesos/target-weights/192.168.1.103:5100", `{"Weight": 100000}`, nil), http.StatusBadRequest)
+
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/target-weights/192.168.1.103:5100", "", nil), http.StatusOK)
+	assert.Equal(t, do(t, server, "DELETE", "/api/services/mesos/target-weights/192.168.1.103:5100", "", nil), http.StatusNotFound)
+}
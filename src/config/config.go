@@ -3,6 +3,7 @@ package config
 import (
 	"net"
 	"net/http"
+	"reflect"
 	"time"
 )
 
@@ -10,14 +11,30 @@ func DefaultConfig() Config {
 	ip := net.ParseIP("127.0.0.1")
 
 	config := Config{
+		Proxy: Proxy{
+			Strategy:      DEFAULT_STRATEGY,
+			HashKey:       HASH_KEY_IP,
+			NoRouteStatus: http.StatusServiceUnavailable,
+			ShutdownWait:  time.Second * 10,
+			DialTimeout:   time.Second * 30,
+		},
 		Listener: Listener{
+			Mode:        "multi_port",
 			IP:          ip,
 			DefaultPort: "3456",
 		},
 		Upstream: Upstream{
-			SourceType:   "consul",
-			ConsulAddr:   "localhost:8500",
-			PollInterval: time.Second * 30,
+			SourceType:     "consul",
+			MergePolicy:    "precedence",
+			ConflictPolicy: "first_registered",
+			ConsulAddr:     "localhost:8500",
+			ConsulKVPrefix: "janitor/services/",
+			WatchMode:      "blocking",
+			PollInterval:   time.Second * 30,
+			FileInterval:   time.Second,
+			DockerAddr:     "unix:///var/run/docker.sock",
+			EtcdAddr:       "http://127.0.0.1:2379",
+			EtcdPrefix:     "/janitor/upstreams/",
 		},
 		HttpHandler: HttpHandler{
 			FlushInterval:  time.Second * 1,
@@ -27,6 +44,9 @@ func DefaultConfig() Config {
 			ReadTimeout:  time.Second * 1,
 			WriteTimeout: time.Second * 1,
 		},
+		Admin: Admin{
+			Addr: "127.0.0.1:3455",
+		},
 	}
 
 	return config
@@ -34,14 +54,17 @@ func DefaultConfig() Config {
 
 type Config struct {
 	Proxy           Proxy
+	CertSource      CertSource
 	Upstream        Upstream
 	Listener        Listener
 	HttpHandler     HttpHandler
 	HttpProxyServer HttpProxyServer
+	Admin           Admin
 }
 
 type Proxy struct {
 	Strategy              string
+	HashKey               string // of the chash strategy, ip, header:<name>, cookie:<name> or query:<name>
 	Matcher               string
 	NoRouteStatus         int
 	MaxConn               int
@@ -70,9 +93,32 @@ type CertSource struct {
 }
 
 type Upstream struct {
-	SourceType   string // one of consul, file or somthing else
-	ConsulAddr   string
-	PollInterval time.Duration
+	SourceType     string // one of consul, file or somthing else, or several separated by commas
+	MergePolicy    string // precedence or merge, for upstreams of several sources sharing a frontend
+	ConflictPolicy string // first_registered, priority or refuse, for services of a source claiming the same frontend
+	SnapshotPath   string // file keeping the last upstreams loaded, served on startup until the sources synced
+	ConsulAddr     string
+	WatchMode      string // blocking queries or poll every PollInterval
+	PollInterval   time.Duration
+	FilePath       string        // a file or a directory of upstream files
+	FileInterval   time.Duration // between two checks of the upstream files
+	MarathonAddr   string        // url of marathon, like http://marathon:8080
+
+	ConsulKVPrefix string // of the json documents describing the services, empty to read only their tags
+
+	KubernetesAddr      string // url of the kubernetes api server
+	KubernetesNamespace string // namespace to watch, all of them when empty
+	KubernetesTokenFile string // bearer token of the service account
+	KubernetesCAFile    string // CA certificate of the api server
+	KubernetesIngress   bool   // read ingresses as host and path routes
+
+	DockerAddr string // docker api, like unix:///var/run/docker.sock
+
+	EtcdAddr   string // url of etcd v3, like http://127.0.0.1:2379
+	EtcdPrefix string // prefix of the keys describing the upstreams
+
+	DNSServer string            // host:port, the resolv.conf one when empty
+	DNSNames  map[string]string // service name -> srv:// or host:// name
 }
 
 type Listener struct {
@@ -90,3 +136,34 @@ type HttpProxyServer struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 }
+
+type Admin struct {
+	Addr string // address of the admin api, empty to disable it
+}
+
+// Diff returns the names of the sections that differ between two configs
+func Diff(old, new Config) []string {
+	changed := make([]string, 0)
+	if !reflect.DeepEqual(old.Proxy, new.Proxy) {
+		changed = append(changed, "proxy")
+	}
+	if !reflect.DeepEqual(old.CertSource, new.CertSource) {
+		changed = append(changed, "cert_source")
+	}
+	if !reflect.DeepEqual(old.Upstream, new.Upstream) {
+		changed = append(changed, "upstream")
+	}
+	if !reflect.DeepEqual(old.Listener, new.Listener) {
+		changed = append(changed, "listener")
+	}
+	if !reflect.DeepEqual(old.HttpHandler, new.HttpHandler) {
+		changed = append(changed, "http_handler")
+	}
+	if !reflect.DeepEqual(old.HttpProxyServer, new.HttpProxyServer) {
+		changed = append(changed, "http_proxy_server")
+	}
+	if !reflect.DeepEqual(old.Admin, new.Admin) {
+		changed = append(changed, "admin")
+	}
+	return changed
+}
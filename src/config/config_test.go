@@ -1,11 +1,22 @@
 package config
 
 import (
-	"github.com/stretchr/testify/assert"
+	"net"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDefaultConfig(t *testing.T) {
 	c := DefaultConfig()
 	assert.Equal(t, c.Listener.DefaultPort, "3456")
 }
+
+func TestDiff(t *testing.T) {
+	c := DefaultConfig()
+	assert.Equal(t, len(Diff(c, DefaultConfig())), 0)
+
+	c.Upstream.PollInterval = c.Upstream.PollInterval * 2
+	c.Listener.IP = net.ParseIP("0.0.0.0")
+	assert.Equal(t, Diff(DefaultConfig(), c), []string{"upstream", "listener"})
+}
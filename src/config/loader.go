@@ -0,0 +1,355 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CONFIG_FLAG    = "config"
+	ENV_VAR_PREFIX = "JANITOR_"
+)
+
+// setting binds a dotted config key like `upstream.poll_interval` to a
+// field of Config. The same key is used in config files, and derives the
+// command-line flag `--upstream-poll-interval` and the environment
+// variable `JANITOR_UPSTREAM_POLL_INTERVAL`
+type setting struct {
+	key   string
+	usage string
+	isMap bool
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	stringSetting("proxy.strategy", "load balance strategy", func(c *Config) *string { return &c.Proxy.Strategy }),
+	stringSetting("proxy.hash_key", "request key of the chash strategy: ip, header:<name>, cookie:<name> or query:<name>", func(c *Config) *string { return &c.Proxy.HashKey }),
+	stringSetting("proxy.matcher", "route matcher", func(c *Config) *string { return &c.Proxy.Matcher }),
+	intSetting("proxy.no_route_status", "http status returned when no target is available", func(c *Config) *int { return &c.Proxy.NoRouteStatus }),
+	intSetting("proxy.max_conn", "max idle connections per target", func(c *Config) *int { return &c.Proxy.MaxConn }),
+	durationSetting("proxy.shutdown_wait", "time to drain connections on shutdown", func(c *Config) *time.Duration { return &c.Proxy.ShutdownWait }),
+	durationSetting("proxy.dial_timeout", "timeout connecting to a target", func(c *Config) *time.Duration { return &c.Proxy.DialTimeout }),
+	durationSetting("proxy.response_header_timeout", "timeout waiting for target response headers", func(c *Config) *time.Duration { return &c.Proxy.ResponseHeaderTimeout }),
+	durationSetting("proxy.keep_alive_timeout", "keep alive period of target connections", func(c *Config) *time.Duration { return &c.Proxy.KeepAliveTimeout }),
+	durationSetting("proxy.read_timeout", "read timeout of proxied connections", func(c *Config) *time.Duration { return &c.Proxy.ReadTimeout }),
+	durationSetting("proxy.write_timeout", "write timeout of proxied connections", func(c *Config) *time.Duration { return &c.Proxy.WriteTimeout }),
+	durationSetting("proxy.flush_interval", "flush interval of buffered responses", func(c *Config) *time.Duration { return &c.Proxy.FlushInterval }),
+	stringSetting("proxy.local_ip", "ip reported in the Forwarded header", func(c *Config) *string { return &c.Proxy.LocalIP }),
+	stringSetting("proxy.client_ip_header", "header to carry the client ip", func(c *Config) *string { return &c.Proxy.ClientIPHeader }),
+	stringSetting("proxy.tls_header", "header set on tls connections", func(c *Config) *string { return &c.Proxy.TLSHeader }),
+	stringSetting("proxy.tls_header_value", "value of proxy.tls_header", func(c *Config) *string { return &c.Proxy.TLSHeaderValue }),
+
+	stringSetting("cert_source.name", "name of the cert source", func(c *Config) *string { return &c.CertSource.Name }),
+	stringSetting("cert_source.type", "type of the cert source", func(c *Config) *string { return &c.CertSource.Type }),
+	stringSetting("cert_source.cert_path", "path of the certificates", func(c *Config) *string { return &c.CertSource.CertPath }),
+	stringSetting("cert_source.key_path", "path of the private keys", func(c *Config) *string { return &c.CertSource.KeyPath }),
+	stringSetting("cert_source.client_ca_path", "path of the client CA certificates", func(c *Config) *string { return &c.CertSource.ClientCAPath }),
+	stringSetting("cert_source.ca_upgrade_cn", "CN of the CA to upgrade to", func(c *Config) *string { return &c.CertSource.CAUpgradeCN }),
+	durationSetting("cert_source.refresh", "refresh interval of the certificates", func(c *Config) *time.Duration { return &c.CertSource.Refresh }),
+	headerSetting("cert_source.header", "headers sent to the cert source, as Name=Value,Name=Value", func(c *Config) *http.Header { return &c.CertSource.Header }),
+
+	stringSetting("upstream.source_type", "where upstreams are loaded from, several sources separated by commas are combined, the first ones taking precedence", func(c *Config) *string { return &c.Upstream.SourceType }),
+	stringSetting("upstream.snapshot_path", "file keeping the last upstreams loaded, served on startup while the sources are unreachable, empty to disable it", func(c *Config) *string { return &c.Upstream.SnapshotPath }),
+	stringSetting("upstream.merge_policy", "upstreams of several sources sharing a frontend are served from the first source (precedence) or with the targets of all of them (merge)", func(c *Config) *string { return &c.Upstream.MergePolicy }),
+	stringSetting("upstream.conflict_policy", "services claiming the same frontend: the first registered is served (first_registered), the one of the highest borg-frontend-priority (priority) or none of them (refuse)", func(c *Config) *string { return &c.Upstream.ConflictPolicy }),
+	stringSetting("upstream.consul_addr", "address of the consul agent", func(c *Config) *string { return &c.Upstream.ConsulAddr }),
+	stringSetting("upstream.consul_kv_prefix", "kv prefix of the json documents describing the services, empty to read only their tags", func(c *Config) *string { return &c.Upstream.ConsulKVPrefix }),
+	stringSetting("upstream.watch_mode", "blocking to follow consul with blocking queries, poll to poll it every upstream.poll_interval", func(c *Config) *string { return &c.Upstream.WatchMode }),
+	durationSetting("upstream.poll_interval", "interval between two upstream polls", func(c *Config) *time.Duration { return &c.Upstream.PollInterval }),
+	stringSetting("upstream.marathon_addr", "url of marathon, for the marathon source type", func(c *Config) *string { return &c.Upstream.MarathonAddr }),
+	stringSetting("upstream.kubernetes_addr", "url of the kubernetes api server, for the kubernetes source type", func(c *Config) *string { return &c.Upstream.KubernetesAddr }),
+	stringSetting("upstream.kubernetes_namespace", "kubernetes namespace to watch, all of them when empty", func(c *Config) *string { return &c.Upstream.KubernetesNamespace }),
+	stringSetting("upstream.kubernetes_token_file", "file of the bearer token sent to kubernetes", func(c *Config) *string { return &c.Upstream.KubernetesTokenFile }),
+	stringSetting("upstream.kubernetes_ca_file", "CA certificate of the kubernetes api server", func(c *Config) *string { return &c.Upstream.KubernetesCAFile }),
+	boolSetting("upstream.kubernetes_ingress", "read kubernetes ingresses as host and path routes", func(c *Config) *bool { return &c.Upstream.KubernetesIngress }),
+	stringSetting("upstream.docker_addr", "docker api address like unix:///var/run/docker.sock or tcp://host:2375, for the docker source type", func(c *Config) *string { return &c.Upstream.DockerAddr }),
+	stringSetting("upstream.etcd_addr", "url of etcd v3, for the etcd source type", func(c *Config) *string { return &c.Upstream.EtcdAddr }),
+	stringSetting("upstream.etcd_prefix", "prefix of the etcd keys describing the upstreams", func(c *Config) *string { return &c.Upstream.EtcdPrefix }),
+	stringSetting("upstream.dns_server", "dns server as host:port, the first nameserver of /etc/resolv.conf when empty", func(c *Config) *string { return &c.Upstream.DNSServer }),
+	mapSetting("upstream.dns_names", "dns names of the services, as service=srv://_http._tcp.web.example.com?frontend_port=8080,service=host://web.example.com:80?frontend_port=8080", func(c *Config) *map[string]string { return &c.Upstream.DNSNames }),
+	stringSetting("upstream.file_path", "upstream file or directory of files, for the file source type", func(c *Config) *string { return &c.Upstream.FilePath }),
+	durationSetting("upstream.file_interval", "interval between two checks of the upstream files", func(c *Config) *time.Duration { return &c.Upstream.FileInterval }),
+
+	stringSetting("listener.mode", "single_port or multi_port", func(c *Config) *string { return &c.Listener.Mode }),
+	ipSetting("listener.ip", "ip the listeners bind to", func(c *Config) *net.IP { return &c.Listener.IP }),
+	stringSetting("listener.default_port", "port of the default listener", func(c *Config) *string { return &c.Listener.DefaultPort }),
+
+	durationSetting("http_handler.flush_interval", "flush interval for server-sent events", func(c *Config) *time.Duration { return &c.HttpHandler.FlushInterval }),
+	stringSetting("http_handler.client_ip_header", "header to carry the client ip", func(c *Config) *string { return &c.HttpHandler.ClientIPHeader }),
+
+	durationSetting("http_proxy_server.read_timeout", "read timeout of the http server", func(c *Config) *time.Duration { return &c.HttpProxyServer.ReadTimeout }),
+	durationSetting("http_proxy_server.write_timeout", "write timeout of the http server", func(c *Config) *time.Duration { return &c.HttpProxyServer.WriteTimeout }),
+
+	stringSetting("admin.addr", "address of the admin api, empty to disable it", func(c *Config) *string { return &c.Admin.Addr }),
+}
+
+func stringSetting(key, usage string, field func(c *Config) *string) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intSetting(key, usage string, field func(c *Config) *int) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(key, usage string, field func(c *Config) *bool) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationSetting(key, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s", value)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func ipSetting(key, usage string, field func(c *Config) *net.IP) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, value string) error {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("%q is not an ip address", value)
+		}
+		*field(c) = ip
+		return nil
+	}}
+}
+
+func headerSetting(key, usage string, field func(c *Config) *http.Header) setting {
+	return setting{key: key, usage: usage, isMap: true, set: func(c *Config, value string) error {
+		header := http.Header{}
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not a Name=Value pair", pair)
+			}
+			header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		*field(c) = header
+		return nil
+	}}
+}
+
+func mapSetting(key, usage string, field func(c *Config) *map[string]string) setting {
+	return setting{key: key, usage: usage, isMap: true, set: func(c *Config, value string) error {
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not a name=value pair", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		*field(c) = m
+		return nil
+	}}
+}
+
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+func flagName(key string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+func envVarName(key string) string {
+	return ENV_VAR_PREFIX + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// Flags returns the command-line flags of janitor, one for each config
+// setting plus --config
+func Flags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:   CONFIG_FLAG + ", c",
+			Usage:  "path of a toml, yaml or json config file",
+			EnvVar: envVarName(CONFIG_FLAG),
+		},
+	}
+
+	for _, s := range settings {
+		flags = append(flags, cli.StringFlag{
+			Name:   flagName(s.key),
+			Usage:  s.usage,
+			EnvVar: envVarName(s.key),
+		})
+	}
+
+	return flags
+}
+
+// Loader builds a Config by layering, from lowest to highest precedence,
+// DefaultConfig, the config file at Path and the Overrides taken from
+// command-line flags and environment variables
+type Loader struct {
+	Path      string
+	Overrides map[string]string
+}
+
+func NewLoader(c *cli.Context) *Loader {
+	loader := &Loader{
+		Path:      c.String(CONFIG_FLAG),
+		Overrides: make(map[string]string),
+	}
+
+	for _, s := range settings {
+		if c.IsSet(flagName(s.key)) {
+			loader.Overrides[s.key] = c.String(flagName(s.key))
+		}
+	}
+
+	return loader
+}
+
+// Load reads the config file again and returns the resulting Config.
+// Every invalid value is reported in a single ValidationError
+func (loader *Loader) Load() (Config, error) {
+	config := DefaultConfig()
+	verr := &ValidationError{}
+
+	if loader.Path != "" {
+		values, err := readConfigFile(loader.Path)
+		if err != nil {
+			return config, err
+		}
+		apply(&config, values, loader.Path, verr)
+	}
+	apply(&config, loader.Overrides, "flags", verr)
+
+	if len(verr.Errors) > 0 {
+		return config, verr
+	}
+
+	return config, config.Validate()
+}
+
+func apply(config *Config, values map[string]string, source string, verr *ValidationError) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, found := lookupSetting(key)
+		if !found {
+			verr.add("unknown setting %s in %s", key, source)
+			continue
+		}
+		if err := s.set(config, values[key]); err != nil {
+			verr.add("%s in %s: %s", key, source, err)
+		}
+	}
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &raw)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %s", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", raw, values)
+	return values, nil
+}
+
+// flatten turns nested tables into dotted keys, so that
+// `[upstream] poll_interval = "5s"` becomes `upstream.poll_interval`
+func flatten(prefix string, value interface{}, values map[string]string) {
+	var nested map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		nested = v
+	case map[interface{}]interface{}:
+		nested = make(map[string]interface{}, len(v))
+		for k, val := range v {
+			nested[fmt.Sprint(k)] = val
+		}
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(items, ",")
+		return
+	default:
+		values[prefix] = fmt.Sprint(v)
+		return
+	}
+
+	if s, found := lookupSetting(prefix); found && s.isMap {
+		pairs := make([]string, 0, len(nested))
+		for k, v := range nested {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+		}
+		sort.Strings(pairs)
+		values[prefix] = strings.Join(pairs, ",")
+		return
+	}
+
+	for k, v := range nested {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		flatten(key, v, values)
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "janitor-config")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadTomlFile(t *testing.T) {
+	path := writeConfigFile(t, "janitor.toml", `
+[upstream]
+consul_addr = "consul:8500"
+poll_interval = "5s"
+kubernetes_ingress = true
+
+[proxy]
+no_route_status = 502
+
+[upstream.dns_names]
+web = "srv://_http._tcp.web.example.com?frontend_port=8080&frontend_proto=http"
+
+[cert_source.header]
+X-Token = "foo"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := (&Loader{Path: path}).Load()
+	assert.Nil(t, err)
+	assert.Equal(t, c.Upstream.ConsulAddr, "consul:8500")
+	assert.Equal(t, c.Upstream.PollInterval, time.Second*5)
+	assert.True(t, c.Upstream.KubernetesIngress)
+	assert.Equal(t, c.Upstream.DNSNames["web"], "srv://_http._tcp.web.example.com?frontend_port=8080&frontend_proto=http")
+	assert.Equal(t, c.Proxy.NoRouteStatus, 502)
+	assert.Equal(t, c.CertSource.Header.Get("X-Token"), "foo")
+	assert.Equal(t, c.Listener.DefaultPort, "3456")
+}
+
+func TestLoadYamlFileWithOverrides(t *testing.T) {
+	path := writeConfigFile(t, "janitor.yml", `
+listener:
+  ip: 0.0.0.0
+  default_port: 8080
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	loader := &Loader{Path: path, Overrides: map[string]string{"listener.default_port": "9090"}}
+	c, err := loader.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, c.Listener.IP.String(), "0.0.0.0")
+	assert.Equal(t, c.Listener.DefaultPort, "9090")
+}
+
+func TestLoadAggregatesErrors(t *testing.T) {
+	loader := &Loader{Overrides: map[string]string{
+		"upstream.poll_interval": "soon",
+		"listener.ip":            "localhost",
+		"proxy.unknown":          "1",
+	}}
+	_, err := loader.Load()
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, len(verr.Errors), 3)
+}
+
+func TestValidate(t *testing.T) {
+	c := DefaultConfig()
+	assert.Nil(t, c.Validate())
+
+	c.Upstream.SourceType = "zookeeper"
+	c.Upstream.WatchMode = "stream"
+	c.Listener.DefaultPort = "0"
+	verr, ok := c.Validate().(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, len(verr.Errors), 3)
+
+	c = DefaultConfig()
+	c.Proxy.Strategy = "fastest"
+	c.Proxy.HashKey = "cookie"
+	verr, ok = c.Validate().(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, len(verr.Errors), 2)
+	RegisterStrategy("fastest")
+	c.Proxy.HashKey = "cookie:session"
+	assert.Nil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "file"
+	assert.NotNil(t, c.Validate())
+	c.Upstream.FilePath = "/etc/janitor/upstreams"
+	assert.Nil(t, c.Validate())
+	c.Upstream.FileInterval = 0
+	assert.NotNil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "kubernetes"
+	c.Upstream.KubernetesAddr = "kubernetes.default.svc"
+	assert.NotNil(t, c.Validate())
+	c.Upstream.KubernetesAddr = "https://kubernetes.default.svc"
+	assert.Nil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "docker"
+	assert.Nil(t, c.Validate())
+	c.Upstream.DockerAddr = "docker:2375"
+	assert.NotNil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "etcd"
+	assert.Nil(t, c.Validate())
+	c.Upstream.EtcdPrefix = "/janitor"
+	assert.NotNil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "file, consul"
+	c.Upstream.FilePath = "/etc/janitor/upstreams"
+	assert.Nil(t, c.Validate())
+	c.Upstream.SourceType = "file,consul,file"
+	c.Upstream.MergePolicy = "union"
+	verr, ok = c.Validate().(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, len(verr.Errors), 2)
+
+	c = DefaultConfig()
+	c.Upstream.SourceType = "dns"
+	c.Upstream.DNSNames = map[string]string{"web": "host://web.example.com?frontend_port=8080"}
+	assert.NotNil(t, c.Validate())
+	c.Upstream.DNSNames["web"] = "srv://_http._tcp.web.example.com?frontend_port=8080"
+	assert.Nil(t, c.Validate())
+
+	c = DefaultConfig()
+	c.Upstream.ConflictPolicy = "priority"
+	assert.Nil(t, c.Validate())
+	c.Upstream.ConflictPolicy = "last_registered"
+	assert.NotNil(t, c.Validate())
+}
+
+func TestFlags(t *testing.T) {
+	assert.Equal(t, len(Flags()), len(settings)+1)
+	assert.Equal(t, flagName("upstream.poll_interval"), "upstream-poll-interval")
+	assert.Equal(t, envVarName("upstream.poll_interval"), "JANITOR_UPSTREAM_POLL_INTERVAL")
+}
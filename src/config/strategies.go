@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_STRATEGY = "rr"
+
+	// sources of the hash key of the chash strategy, written ip,
+	// header:<name>, cookie:<name> or query:<name>
+	HASH_KEY_IP     = "ip"
+	HASH_KEY_HEADER = "header"
+	HASH_KEY_COOKIE = "cookie"
+	HASH_KEY_QUERY  = "query"
+)
+
+// names of the load balance strategies, registered by the loadbalance
+// package along with their factories, so that the config and the service
+// settings are validated without depending on it
+var (
+	strategies     = map[string]bool{DEFAULT_STRATEGY: true}
+	strategiesLock sync.RWMutex
+)
+
+func RegisterStrategy(name string) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+	strategies[name] = true
+}
+
+// ValidateStrategy tells whether name is a registered strategy
+func ValidateStrategy(name string) error {
+	strategiesLock.RLock()
+	defer strategiesLock.RUnlock()
+	if strategies[name] {
+		return nil
+	}
+
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("load balance strategy %s is not registered, should be one of %v", name, names)
+}
+
+// ValidateHashKey tells whether raw is ip, header:<name>, cookie:<name>
+// or query:<name>
+func ValidateHashKey(raw string) error {
+	kv := strings.SplitN(raw, ":", 2)
+	switch {
+	case len(kv) == 1 && kv[0] == HASH_KEY_IP:
+		return nil
+	case len(kv) == 2 && kv[1] != "" && (kv[0] == HASH_KEY_HEADER || kv[0] == HASH_KEY_COOKIE || kv[0] == HASH_KEY_QUERY):
+		return nil
+	}
+	return fmt.Errorf("hash key %q should be ip, header:<name>, cookie:<name> or query:<name>", raw)
+}
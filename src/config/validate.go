@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError aggregates every problem found in a Config so that
+// all of them can be reported at once on startup
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Errors, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Errors = append(e.Errors, fmt.Sprintf(format, args...))
+}
+
+func (e *ValidationError) orNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (c Config) Validate() error {
+	verr := &ValidationError{}
+
+	sourceTypes := make(map[string]bool)
+	for _, sourceType := range strings.Split(strings.ToLower(c.Upstream.SourceType), ",") {
+		sourceType = strings.TrimSpace(sourceType)
+		if sourceTypes[sourceType] {
+			verr.add("upstream.source_type %q lists %s twice", c.Upstream.SourceType, sourceType)
+			continue
+		}
+		sourceTypes[sourceType] = true
+
+		switch sourceType {
+		case "consul":
+			if c.Upstream.ConsulAddr == "" {
+				verr.add("upstream.consul_addr is required when upstream.source_type is consul")
+			}
+			if c.Upstream.ConsulKVPrefix != "" && (strings.HasPrefix(c.Upstream.ConsulKVPrefix, "/") || !strings.HasSuffix(c.Upstream.ConsulKVPrefix, "/")) {
+				verr.add("upstream.consul_kv_prefix %q should be like janitor/services/", c.Upstream.ConsulKVPrefix)
+			}
+		case "marathon":
+			if u, err := url.Parse(c.Upstream.MarathonAddr); err != nil || u.Scheme == "" || u.Host == "" {
+				verr.add("upstream.marathon_addr %q should be an url like http://marathon:8080 when upstream.source_type is marathon", c.Upstream.MarathonAddr)
+			}
+		case "kubernetes":
+			if u, err := url.Parse(c.Upstream.KubernetesAddr); err != nil || u.Scheme == "" || u.Host == "" {
+				verr.add("upstream.kubernetes_addr %q should be an url like https://kubernetes.default.svc when upstream.source_type is kubernetes", c.Upstream.KubernetesAddr)
+			}
+		case "docker":
+			u, err := url.Parse(c.Upstream.DockerAddr)
+			switch {
+			case err != nil:
+				verr.add("upstream.docker_addr %q is not an url", c.Upstream.DockerAddr)
+			case u.Scheme == "unix" && u.Path == "":
+				verr.add("upstream.docker_addr %q has no socket path", c.Upstream.DockerAddr)
+			case u.Scheme != "unix" && (u.Host == "" || (u.Scheme != "tcp" && u.Scheme != "http" && u.Scheme != "https")):
+				verr.add("upstream.docker_addr %q should be like unix:///var/run/docker.sock or tcp://host:2375", c.Upstream.DockerAddr)
+			}
+		case "etcd":
+			if u, err := url.Parse(c.Upstream.EtcdAddr); err != nil || u.Scheme == "" || u.Host == "" {
+				verr.add("upstream.etcd_addr %q should be an url like http://127.0.0.1:2379 when upstream.source_type is etcd", c.Upstream.EtcdAddr)
+			}
+			if !strings.HasSuffix(c.Upstream.EtcdPrefix, "/") {
+				verr.add("upstream.etcd_prefix %q should end with /", c.Upstream.EtcdPrefix)
+			}
+		case "dns":
+			if len(c.Upstream.DNSNames) == 0 {
+				verr.add("upstream.dns_names is required when upstream.source_type is dns")
+			}
+			for serviceName, name := range c.Upstream.DNSNames {
+				u, err := url.Parse(name)
+				if err != nil || (u.Scheme != "srv" && u.Scheme != "host") || u.Hostname() == "" || !validPort(u.Query().Get("frontend_port")) {
+					verr.add("upstream.dns_names %s=%q should be like srv://_http._tcp.web.example.com?frontend_port=8080", serviceName, name)
+				} else if u.Scheme == "host" && !validPort(u.Port()) {
+					verr.add("upstream.dns_names %s=%q has no port, like host://web.example.com:80?frontend_port=8080", serviceName, name)
+				}
+			}
+		case "file":
+			if c.Upstream.FilePath == "" {
+				verr.add("upstream.file_path is required when upstream.source_type is file")
+			}
+		default:
+			verr.add("upstream.source_type %q is not supported", sourceType)
+		}
+	}
+	switch c.Upstream.MergePolicy {
+	case "", "precedence", "merge":
+	default:
+		verr.add("upstream.merge_policy %q should be one of precedence, merge", c.Upstream.MergePolicy)
+	}
+	switch c.Upstream.ConflictPolicy {
+	case "", "first_registered", "priority", "refuse":
+	default:
+		verr.add("upstream.conflict_policy %q should be one of first_registered, priority, refuse", c.Upstream.ConflictPolicy)
+	}
+	switch c.Upstream.WatchMode {
+	case "blocking", "poll":
+	default:
+		verr.add("upstream.watch_mode %q should be one of blocking, poll", c.Upstream.WatchMode)
+	}
+	if c.Upstream.PollInterval <= 0 {
+		verr.add("upstream.poll_interval must be positive, got %s", c.Upstream.PollInterval)
+	}
+	if c.Upstream.FileInterval <= 0 {
+		verr.add("upstream.file_interval must be positive, got %s", c.Upstream.FileInterval)
+	}
+
+	switch c.Listener.Mode {
+	case "single_port", "multi_port":
+	default:
+		verr.add("listener.mode %q should be one of single_port, multi_port", c.Listener.Mode)
+	}
+	if c.Listener.IP == nil {
+		verr.add("listener.ip is required")
+	}
+	if !validPort(c.Listener.DefaultPort) {
+		verr.add("listener.default_port %q is not a valid port", c.Listener.DefaultPort)
+	}
+
+	if err := ValidateStrategy(c.Proxy.Strategy); err != nil {
+		verr.add("proxy.strategy: %s", err)
+	}
+	if err := ValidateHashKey(c.Proxy.HashKey); err != nil {
+		verr.add("proxy.hash_key: %s", err)
+	}
+	if c.Proxy.NoRouteStatus != 0 && (c.Proxy.NoRouteStatus < 100 || c.Proxy.NoRouteStatus > 599) {
+		verr.add("proxy.no_route_status %d is not a valid http status", c.Proxy.NoRouteStatus)
+	}
+	if c.Proxy.MaxConn < 0 {
+		verr.add("proxy.max_conn must not be negative, got %d", c.Proxy.MaxConn)
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"proxy.shutdown_wait", c.Proxy.ShutdownWait},
+		{"proxy.dial_timeout", c.Proxy.DialTimeout},
+		{"proxy.response_header_timeout", c.Proxy.ResponseHeaderTimeout},
+		{"proxy.keep_alive_timeout", c.Proxy.KeepAliveTimeout},
+		{"proxy.read_timeout", c.Proxy.ReadTimeout},
+		{"proxy.write_timeout", c.Proxy.WriteTimeout},
+		{"proxy.flush_interval", c.Proxy.FlushInterval},
+		{"cert_source.refresh", c.CertSource.Refresh},
+		{"http_handler.flush_interval", c.HttpHandler.FlushInterval},
+		{"http_proxy_server.read_timeout", c.HttpProxyServer.ReadTimeout},
+		{"http_proxy_server.write_timeout", c.HttpProxyServer.WriteTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			verr.add("%s must not be negative, got %s", d.key, d.value)
+		}
+	}
+
+	if c.CertSource.Type != "" {
+		switch c.CertSource.Type {
+		case "file", "path", "consul", "http", "vault":
+		default:
+			verr.add("cert_source.type %q is not supported", c.CertSource.Type)
+		}
+		if c.CertSource.CertPath == "" {
+			verr.add("cert_source.cert_path is required when cert_source.type is set")
+		}
+	}
+
+	if c.Admin.Addr != "" {
+		if _, port, err := net.SplitHostPort(c.Admin.Addr); err != nil || !validPort(port) {
+			verr.add("admin.addr %q should be like 127.0.0.1:3455", c.Admin.Addr)
+		}
+	}
+
+	return verr.orNil()
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
@@ -1,9 +1,15 @@
 package handler
 
 import (
+	"crypto/tls"
+	"log"
+	"net"
 	"net/http"
+	"reflect"
+	"sync"
 
 	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
 	"github.com/Dataman-Cloud/janitor/src/upstream"
 )
 
@@ -12,12 +18,138 @@ const HANDLER_FACTORY_KEY = "handler_factory"
 type Factory struct {
 	HttpHandlerCfg config.HttpHandler
 	ListenerCfg    config.Listener
+	ProxyCfg       config.Proxy
+	Overrides      *upstream.Overrides
+
+	transport *http.Transport
+	rwMutex   sync.RWMutex
+}
+
+func NewFactory(cfg config.HttpHandler, listenerCfg config.Listener, proxyCfg config.Proxy) *Factory {
+	return &Factory{
+		HttpHandlerCfg: cfg,
+		ListenerCfg:    listenerCfg,
+		ProxyCfg:       proxyCfg,
+		transport:      newTransport(proxyCfg),
+	}
+}
+
+// HttpHandler proxies to the targets of upstream, picked from the live
+// set targets
+func (factory *Factory) HttpHandler(upstream *upstream.Upstream, targets *upstream.TargetSet) http.Handler {
+	return NewHTTPProxy(factory, upstream, targets)
+}
+
+// Reload applies new settings to every handler created by this factory,
+// the transport is rebuilt only when the proxy settings changed
+func (factory *Factory) Reload(Config config.Config) {
+	factory.rwMutex.Lock()
+	defer factory.rwMutex.Unlock()
+
+	if !reflect.DeepEqual(factory.ProxyCfg, Config.Proxy) {
+		staleTransport := factory.transport
+		factory.transport = newTransport(Config.Proxy)
+		staleTransport.CloseIdleConnections()
+	}
+
+	factory.HttpHandlerCfg = Config.HttpHandler
+	factory.ListenerCfg = Config.Listener
+	factory.ProxyCfg = Config.Proxy
+}
+
+func (factory *Factory) ProxyConfig() config.Proxy {
+	factory.rwMutex.RLock()
+	defer factory.rwMutex.RUnlock()
+	return factory.ProxyCfg
 }
 
-func NewFactory(cfg config.HttpHandler, listenerCfg config.Listener) *Factory {
-	return &Factory{HttpHandlerCfg: cfg, ListenerCfg: listenerCfg}
+func (factory *Factory) settings() (http.RoundTripper, config.HttpHandler, config.Listener) {
+	factory.rwMutex.RLock()
+	defer factory.rwMutex.RUnlock()
+	return factory.transport, factory.HttpHandlerCfg, factory.ListenerCfg
+}
+
+// loadBalancer returns a load balancer of the strategy of u, or of the
+// proxy one when u has none or an unknown one
+func (factory *Factory) loadBalancer(u *upstream.Upstream) loadbalance.LoadBalancer {
+	lb := factory.strategyLoadBalancer(u)
+	if keyed, ok := lb.(loadbalance.KeyedLoadBalancer); ok {
+		keyed.SetHashKey(factory.hashKey(u))
+	}
+	return lb
+}
+
+func (factory *Factory) strategyLoadBalancer(u *upstream.Upstream) loadbalance.LoadBalancer {
+	strategy := factory.ProxyConfig().Strategy
+	if u.Settings.Strategy != "" {
+		lb, err := loadbalance.New(u.Settings.Strategy)
+		if err == nil {
+			return lb
+		}
+		log.Printf("[WARN] %s of %s, using %s", err, u.ServiceName, strategy)
+	}
+
+	lb, err := loadbalance.New(strategy)
+	if err != nil {
+		log.Printf("[WARN] %s, using %s", err, loadbalance.STRATEGY_ROUND_ROBIN)
+		return loadbalance.NewRoundRobinLoadBalancer()
+	}
+	return lb
+}
+
+// hashKey returns the hash key of u, or the proxy one when u has none or
+// an invalid one
+func (factory *Factory) hashKey(u *upstream.Upstream) loadbalance.HashKey {
+	hashKey := factory.ProxyConfig().HashKey
+	if u.Settings.HashKey != "" {
+		key, err := loadbalance.ParseHashKey(u.Settings.HashKey)
+		if err == nil {
+			return key
+		}
+		log.Printf("[WARN] %s of %s, using %s", err, u.ServiceName, hashKey)
+	}
+
+	key, err := loadbalance.ParseHashKey(hashKey)
+	if err != nil {
+		log.Printf("[WARN] %s, using %s", err, loadbalance.HASH_KEY_IP)
+		return loadbalance.HashKey{Source: loadbalance.HASH_KEY_IP}
+	}
+	return key
+}
+
+// serviceTransport returns a transport for the timeouts and tls settings
+// of a service, nil when it has none. It follows the proxy settings of
+// the time the service pod started
+func (factory *Factory) serviceTransport(settings upstream.ServiceSettings) http.RoundTripper {
+	if settings.DialTimeout == 0 && settings.ResponseHeaderTimeout == 0 && !settings.TLSSkipVerify && settings.TLSServerName == "" {
+		return nil
+	}
+
+	cfg := factory.ProxyConfig()
+	if settings.DialTimeout > 0 {
+		cfg.DialTimeout = settings.DialTimeout
+	}
+	if settings.ResponseHeaderTimeout > 0 {
+		cfg.ResponseHeaderTimeout = settings.ResponseHeaderTimeout
+	}
+	transport := newTransport(cfg)
+	if settings.TLSSkipVerify || settings.TLSServerName != "" {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: settings.TLSSkipVerify,
+			ServerName:         settings.TLSServerName,
+		}
+	}
+	return transport
 }
 
-func (factory *Factory) HttpHandler(upstream *upstream.Upstream) http.Handler {
-	return NewHTTPProxy(&http.Transport{}, factory.HttpHandlerCfg, factory.ListenerCfg, upstream)
+func newTransport(cfg config.Proxy) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: cfg.KeepAliveTimeout,
+		}).Dial,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxConn,
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
 	"github.com/Dataman-Cloud/janitor/src/upstream"
 
 	"github.com/stretchr/testify/assert"
@@ -11,13 +12,69 @@ import (
 
 func TestNewFactory(t *testing.T) {
 	c := config.DefaultConfig()
-	f := NewFactory(c.HttpHandler, c.Listener)
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
 	assert.NotNil(t, f)
 }
 
 func TestHttpHandler(t *testing.T) {
 	c := config.DefaultConfig()
-	f := NewFactory(c.HttpHandler, c.Listener)
-	httpHandler := f.HttpHandler(&upstream.Upstream{})
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	httpHandler := f.HttpHandler(&upstream.Upstream{}, upstream.NewTargetSet(nil))
 	assert.NotNil(t, httpHandler)
 }
+
+func TestReload(t *testing.T) {
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	tr, _, _ := f.settings()
+
+	c.HttpHandler.ClientIPHeader = "X-Client-Ip"
+	f.Reload(c)
+	trAfter, cfg, _ := f.settings()
+	assert.Equal(t, cfg.ClientIPHeader, "X-Client-Ip")
+	assert.Equal(t, tr, trAfter)
+
+	c.Proxy.DialTimeout = c.Proxy.DialTimeout * 2
+	f.Reload(c)
+	trAfter, _, _ = f.settings()
+	assert.NotEqual(t, tr, trAfter)
+}
+
+// firstLoadBalancer always picks the first target
+type firstLoadBalancer struct {
+	targets *upstream.TargetSet
+}
+
+func (lb *firstLoadBalancer) Seed(targets *upstream.TargetSet) { lb.targets = targets }
+func (lb *firstLoadBalancer) Next(req *loadbalance.Request) *upstream.Target {
+	if targets := lb.targets.Targets(); len(targets) > 0 {
+		return targets[0]
+	}
+	return nil
+}
+
+func TestLoadBalancer(t *testing.T) {
+	loadbalance.Register("first", func() loadbalance.LoadBalancer { return &firstLoadBalancer{} })
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+
+	assert.IsType(t, &loadbalance.RoundRobinLoadBalancer{}, f.loadBalancer(&upstream.Upstream{}))
+	assert.IsType(t, &firstLoadBalancer{}, f.loadBalancer(&upstream.Upstream{Settings: upstream.ServiceSettings{Strategy: "first"}}))
+	// an unknown strategy of a service falls back to the proxy one
+	assert.IsType(t, &loadbalance.RoundRobinLoadBalancer{}, f.loadBalancer(&upstream.Upstream{Settings: upstream.ServiceSettings{Strategy: "fastest"}}))
+
+	c.Proxy.Strategy = "first"
+	f.Reload(c)
+	assert.IsType(t, &firstLoadBalancer{}, f.loadBalancer(&upstream.Upstream{}))
+}
+
+func TestHashKey(t *testing.T) {
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+
+	lb := f.loadBalancer(&upstream.Upstream{Settings: upstream.ServiceSettings{Strategy: loadbalance.STRATEGY_CONSISTENT_HASH, HashKey: "cookie:sid"}})
+	assert.Equal(t, lb.(*loadbalance.ConsistentHashLoadBalancer).Key, loadbalance.HashKey{Source: loadbalance.HASH_KEY_COOKIE, Name: "sid"})
+	// an invalid hash key of a service falls back to the proxy one
+	lb = f.loadBalancer(&upstream.Upstream{Settings: upstream.ServiceSettings{Strategy: loadbalance.STRATEGY_CONSISTENT_HASH, HashKey: "cookie"}})
+	assert.Equal(t, lb.(*loadbalance.ConsistentHashLoadBalancer).Key, loadbalance.HashKey{Source: loadbalance.HASH_KEY_IP})
+}
@@ -5,21 +5,39 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
 )
 
-func newHTTPProxy(t *url.URL, tr http.RoundTripper, flush time.Duration) http.Handler {
+// newHTTPProxy proxies to t, the entry of target, responseHeaders are set
+// on every response
+func newHTTPProxy(t *url.URL, target *upstream.Target, tr http.RoundTripper, flush time.Duration, responseHeaders map[string]string) http.Handler {
 	rp := httputil.NewSingleHostReverseProxy(t)
 	rp.Transport = tr
 	rp.FlushInterval = flush
-	rp.Transport = &meteredRoundTripper{tr}
+	rp.Transport = &meteredRoundTripper{tr, target}
+	if len(responseHeaders) > 0 {
+		rp.ModifyResponse = func(resp *http.Response) error {
+			for name, value := range responseHeaders {
+				resp.Header.Set(name, value)
+			}
+			return nil
+		}
+	}
 	return rp
 }
 
+// meteredRoundTripper feeds the latency of target to the load balancers,
+// up to the response headers, errors and 5xx counting as failures
 type meteredRoundTripper struct {
-	tr http.RoundTripper
+	tr     http.RoundTripper
+	target *upstream.Target
 }
 
 func (m *meteredRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	done := loadbalance.ObserveRoundTrip(m.target)
 	resp, err := m.tr.RoundTrip(r)
+	done(err != nil || resp.StatusCode >= http.StatusInternalServerError)
 	return resp, err
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"time"
@@ -12,37 +13,76 @@ import (
 )
 
 // httpProxy is a dynamic reverse proxy for HTTP and HTTPS protocols.
+// settings are read from the factory on every request, so a config
+// reload takes effect without rebuilding the handler.
 type httpProxy struct {
-	tr             http.RoundTripper
-	cfg            config.HttpHandler
-	listenerConfig config.Listener
-	loadbalancer   loadbalance.LoadBalancer
+	factory      *Factory
+	serviceName  string
+	routes       []upstream.Route
+	settings     upstream.ServiceSettings
+	loadbalancer loadbalance.LoadBalancer
+
+	// transport of a service with its own timeouts or tls settings, the
+	// one of the factory otherwise
+	transport http.RoundTripper
 }
 
-func NewHTTPProxy(tr http.RoundTripper, cfg config.HttpHandler, configListener config.Listener, upstream *upstream.Upstream) http.Handler {
-	loadbalancer := loadbalance.NewRoundRobinLoadBalancer()
-	loadbalancer.Seed(upstream)
+func NewHTTPProxy(factory *Factory, upstream *upstream.Upstream, targets *upstream.TargetSet) http.Handler {
+	loadbalancer := factory.loadBalancer(upstream)
+	loadbalancer.Seed(targets)
 
 	return &httpProxy{
-		tr:             tr,
-		listenerConfig: configListener,
-		cfg:            cfg,
-		loadbalancer:   loadbalancer,
+		factory:      factory,
+		serviceName:  upstream.ServiceName,
+		routes:       upstream.Routes,
+		settings:     upstream.Settings,
+		loadbalancer: loadbalancer,
+		transport:    factory.serviceTransport(upstream.Settings),
 	}
 }
 
 func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	targetEntry := p.loadbalancer.Next().Entry()
-	if targetEntry == nil {
-		w.WriteHeader(http.StatusBadGateway)
+	if !p.routed(r) {
+		http.Error(w, fmt.Sprintf("no route of %s for %s%s", p.serviceName, r.Host, r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	if p.factory.Overrides.InMaintenance(p.serviceName) {
+		http.Error(w, fmt.Sprintf("%s is under maintenance", p.serviceName), http.StatusServiceUnavailable)
 		return
 	}
 
-	if err := p.AddHeaders(r); err != nil {
+	tr, cfg, listenerCfg := p.factory.settings()
+	if err := p.AddHeaders(r, cfg, listenerCfg); err != nil {
 		http.Error(w, "cannot parse "+r.RemoteAddr, http.StatusInternalServerError)
 		return
 	}
 
+	target := p.loadbalancer.Next(loadbalance.NewRequest(r, r.Header.Get("X-Real-Ip")))
+	if target == nil {
+		http.Error(w, fmt.Sprintf("no target available for %s", p.serviceName), p.factory.ProxyConfig().NoRouteStatus)
+		return
+	}
+
+	targetEntry := target.Entry()
+	if targetEntry == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	// a websocket is a connection to the target, a request waits for a
+	// response too
+	defer loadbalance.TrackConnection(target)()
+	if r.Header.Get("Upgrade") != "websocket" {
+		defer loadbalance.TrackRequest(target)()
+	}
+	if p.transport != nil {
+		tr = p.transport
+	}
+	for name, value := range p.settings.RequestHeaders {
+		r.Header.Set(name, value)
+	}
+
 	var h http.Handler
 	switch {
 	case r.Header.Get("Upgrade") == "websocket":
@@ -54,17 +94,30 @@ func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case r.Header.Get("Accept") == "text/event-stream":
 		// use the flush interval for SSE (server-sent events)
 		// must be > 0s to be effective
-		h = newHTTPProxy(targetEntry, p.tr, p.cfg.FlushInterval)
+		h = newHTTPProxy(targetEntry, target, tr, cfg.FlushInterval, p.settings.ResponseHeaders)
 
 	default:
-		h = newHTTPProxy(targetEntry, p.tr, time.Duration(0))
+		h = newHTTPProxy(targetEntry, target, tr, time.Duration(0), p.settings.ResponseHeaders)
 	}
 
 	//start := time.Now()
 	h.ServeHTTP(w, r)
 }
 
-func (proxy *httpProxy) AddHeaders(r *http.Request) error {
+// routed tells whether r follows one of the routes, if any
+func (p *httpProxy) routed(r *http.Request) bool {
+	if len(p.routes) == 0 {
+		return true
+	}
+	for _, route := range p.routes {
+		if route.Match(r.Host, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *httpProxy) AddHeaders(r *http.Request, cfg config.HttpHandler, listenerCfg config.Listener) error {
 	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return errors.New("cannot parse " + r.RemoteAddr)
@@ -73,10 +126,10 @@ func (proxy *httpProxy) AddHeaders(r *http.Request) error {
 	// set configurable ClientIPHeader
 	// X-Real-Ip is set later and X-Forwarded-For is set
 	// by the Go HTTP reverse proxy.
-	if proxy.cfg.ClientIPHeader != "" &&
-		proxy.cfg.ClientIPHeader != "X-Forwarded-For" &&
-		proxy.cfg.ClientIPHeader != "X-Real-Ip" {
-		r.Header.Set(proxy.cfg.ClientIPHeader, remoteIP)
+	if cfg.ClientIPHeader != "" &&
+		cfg.ClientIPHeader != "X-Forwarded-For" &&
+		cfg.ClientIPHeader != "X-Real-Ip" {
+		r.Header.Set(cfg.ClientIPHeader, remoteIP)
 	}
 
 	if r.Header.Get("X-Real-Ip") == "" {
@@ -122,8 +175,8 @@ func (proxy *httpProxy) AddHeaders(r *http.Request) error {
 			fwd += "; proto=http"
 		}
 	}
-	if proxy.listenerConfig.IP.String() != "" {
-		fwd += "; by=" + proxy.listenerConfig.IP.String()
+	if listenerCfg.IP.String() != "" {
+		fwd += "; by=" + listenerCfg.IP.String()
 	}
 	r.Header.Set("Forwarded", fwd)
 
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func backendTarget(t *testing.T, u *upstream.Upstream, body string) *upstream.Target {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(backend.Close)
+
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	return &upstream.Target{ServiceAddress: host, ServicePort: port, Weight: upstream.DEFAULT_WEIGHT, Upstream: u}
+}
+
+func TestHttpProxyTargetsSwapped(t *testing.T) {
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "mesos", FrontendProto: "http"}
+	targets := upstream.NewTargetSet([]*upstream.Target{backendTarget(t, u, "old")})
+	h := f.HttpHandler(u, targets)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, recorder.Body.String(), "old")
+
+	targets.Swap([]*upstream.Target{backendTarget(t, u, "new")})
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, recorder.Body.String(), "new")
+}
+
+func TestHttpProxyNoTarget(t *testing.T) {
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	h := f.HttpHandler(&upstream.Upstream{ServiceName: "mesos"}, upstream.NewTargetSet(nil))
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, recorder.Code, http.StatusServiceUnavailable)
+}
+
+func TestHttpProxyRoutes(t *testing.T) {
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "web", FrontendProto: "http", Routes: []upstream.Route{
+		{Host: "web.example.com", Path: "/api"},
+		{Host: "web.example.com", Path: "/health", Exact: true},
+	}}
+	h := f.HttpHandler(u, upstream.NewTargetSet([]*upstream.Target{backendTarget(t, u, "web")}))
+
+	for path, code := range map[string]int{
+		"http://web.example.com:8080/api/users": http.StatusOK,
+		"http://web.example.com/api":            http.StatusOK,
+		"http://web.example.com/apis":           http.StatusNotFound,
+		"http://web.example.com/health":         http.StatusOK,
+		"http://web.example.com/health/deep":    http.StatusNotFound,
+		"http://other.example.com/api":          http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, recorder.Code, code, path)
+	}
+}
+
+func TestHttpProxySettings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "backend")
+		w.Write([]byte(r.Header.Get("X-Env")))
+	}))
+	t.Cleanup(backend.Close)
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "web", FrontendProto: "http", Settings: upstream.ServiceSettings{
+		DialTimeout:     time.Second,
+		RequestHeaders:  map[string]string{"X-Env": "prod"},
+		ResponseHeaders: map[string]string{"X-Served-By": "janitor"},
+	}}
+	h := f.HttpHandler(u, upstream.NewTargetSet([]*upstream.Target{{ServiceAddress: host, ServicePort: port, Weight: upstream.DEFAULT_WEIGHT, Upstream: u}}))
+	assert.NotNil(t, h.(*httpProxy).transport)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, recorder.Body.String(), "prod")
+	assert.Equal(t, recorder.Header().Get("X-Served-By"), "janitor")
+}
+
+func TestHttpProxyTracksLoad(t *testing.T) {
+	served, release := make(chan bool), make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served <- true
+		<-release
+	}))
+	t.Cleanup(backend.Close)
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "poll", FrontendProto: "http"}
+	target := &upstream.Target{ServiceName: "poll", ServiceAddress: host, ServicePort: port, Weight: 1, Upstream: u}
+	h := f.HttpHandler(u, upstream.NewTargetSet([]*upstream.Target{target}))
+
+	done := make(chan bool)
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		done <- true
+	}()
+	<-served
+	assert.Equal(t, loadbalance.LoadOf(target), loadbalance.TargetLoad{Connections: 1, Requests: 1})
+	assert.Equal(t, loadbalance.LatencyOf(target).InFlight, int64(1))
+
+	close(release)
+	<-done
+	assert.Equal(t, loadbalance.LoadOf(target), loadbalance.TargetLoad{})
+	assert.Equal(t, loadbalance.LatencyOf(target).InFlight, int64(0))
+	assert.True(t, loadbalance.LatencyOf(target).Average > 0)
+}
+
+func TestHttpProxyPenalizesFailures(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(backend.Close)
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "failing", FrontendProto: "http"}
+	target := &upstream.Target{ServiceName: "failing", ServiceAddress: host, ServicePort: port, Weight: 1, Upstream: u}
+	h := f.HttpHandler(u, upstream.NewTargetSet([]*upstream.Target{target}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.True(t, loadbalance.LatencyOf(target).Average > loadbalance.LATENCY_FAILURE_PENALTY*9/10)
+}
+
+func TestHttpProxyTracksWebsocket(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer backend.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			conn.Read(make([]byte, 1024))
+			accepted <- conn
+		}
+	}()
+	host, port, _ := net.SplitHostPort(backend.Addr().String())
+
+	c := config.DefaultConfig()
+	f := NewFactory(c.HttpHandler, c.Listener, c.Proxy)
+	u := &upstream.Upstream{ServiceName: "ws", FrontendProto: "http"}
+	target := &upstream.Target{ServiceName: "ws", ServiceAddress: host, ServicePort: port, Weight: 1, Upstream: u}
+	frontend := httptest.NewServer(f.HttpHandler(u, upstream.NewTargetSet([]*upstream.Target{target})))
+	defer frontend.Close()
+
+	client, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	assert.Nil(t, err)
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: ws\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	conn := <-accepted
+	defer conn.Close()
+
+	// a websocket is a connection, not a request waiting for its response
+	assert.Equal(t, loadbalance.LoadOf(target), loadbalance.TargetLoad{Connections: 1})
+	client.Close()
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if loadbalance.LoadOf(target).Connections == 0 {
+			break
+		}
+	}
+	assert.Equal(t, loadbalance.LoadOf(target), loadbalance.TargetLoad{})
+}
@@ -28,6 +28,11 @@ func newRawProxy(t *url.URL) http.Handler {
 		}
 		defer in.Close()
 
+		if tracker := connTrackerFromRequest(r); tracker != nil {
+			tracker.hijack(in)
+			defer tracker.release(in)
+		}
+
 		out, err := net.Dial("tcp", t.Host)
 		if err != nil {
 			log.Printf("[ERROR] WS error for %s. %s", r.URL, err)
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const TRACKER_POLL_INTERVAL = time.Millisecond * 100
+
+type connTrackerKey struct{}
+
+// ConnTracker follows the requests served by a handler, including the
+// ones whose connection was hijacked by the raw proxy, so that a service
+// pod can wait for them to finish before going away.
+type ConnTracker struct {
+	inflight int64
+	hijacked map[net.Conn]struct{}
+	mutex    sync.Mutex
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{hijacked: make(map[net.Conn]struct{})}
+}
+
+// Handler wraps h so that every request it serves is tracked
+func (tracker *ConnTracker) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&tracker.inflight, 1)
+		defer atomic.AddInt64(&tracker.inflight, -1)
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), connTrackerKey{}, tracker)))
+	})
+}
+
+func (tracker *ConnTracker) Inflight() int64 {
+	return atomic.LoadInt64(&tracker.inflight)
+}
+
+// Wait blocks until no request is in flight or ctx is done
+func (tracker *ConnTracker) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(TRACKER_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for tracker.Inflight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// CloseHijacked closes the hijacked connections still open
+func (tracker *ConnTracker) CloseHijacked() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for conn := range tracker.hijacked {
+		conn.Close()
+	}
+}
+
+func (tracker *ConnTracker) hijack(conn net.Conn) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.hijacked[conn] = struct{}{}
+}
+
+func (tracker *ConnTracker) release(conn net.Conn) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.hijacked, conn)
+}
+
+func connTrackerFromRequest(r *http.Request) *ConnTracker {
+	tracker, _ := r.Context().Value(connTrackerKey{}).(*ConnTracker)
+	return tracker
+}
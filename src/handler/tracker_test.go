@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestConnTrackerWait(t *testing.T) {
+	tracker := NewConnTracker()
+	release := make(chan bool)
+	h := tracker.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, connTrackerFromRequest(r), tracker)
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	for tracker.Inflight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, tracker.Wait(ctx), context.DeadlineExceeded)
+
+	close(release)
+	assert.Nil(t, tracker.Wait(context.Background()))
+}
+
+func TestConnTrackerCloseHijacked(t *testing.T) {
+	tracker := NewConnTracker()
+	in, out := net.Pipe()
+	defer out.Close()
+
+	tracker.hijack(in)
+	tracker.CloseHijacked()
+	_, err := in.Write([]byte("foo"))
+	assert.NotNil(t, err)
+
+	tracker.release(in)
+	assert.Equal(t, len(tracker.hijacked), 0)
+}
@@ -1,9 +1,16 @@
 package janitor
 
 import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/admin"
 	"github.com/Dataman-Cloud/janitor/src/config"
 	"github.com/Dataman-Cloud/janitor/src/handler"
 	"github.com/Dataman-Cloud/janitor/src/listener"
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
 	"github.com/Dataman-Cloud/janitor/src/service"
 	"github.com/Dataman-Cloud/janitor/src/upstream"
 
@@ -16,17 +23,23 @@ type JanitorServer struct {
 	listenerManager *listener.Manager
 	handerFactory   *handler.Factory
 	serviceManager  *service.ServiceManager
+	adminServer     *admin.Server
+	overrides       *upstream.Overrides
 
 	ctx     context.Context
 	config  config.Config
 	running bool
+
+	upgradeReadyOnce sync.Once
 }
 
 func NewJanitorServer(Config config.Config) *JanitorServer {
 	server := &JanitorServer{
-		config: Config,
-		ctx:    context.Background(),
+		config:    Config,
+		ctx:       context.Background(),
+		overrides: upstream.NewOverrides(),
 	}
+	server.ctx = context.WithValue(server.ctx, upstream.OVERRIDES_KEY, server.overrides)
 	return server
 }
 
@@ -42,9 +55,18 @@ func (server *JanitorServer) Init() *JanitorServer {
 		log.Fatalf("Setup Listener Manager Got err: %s", err)
 	}
 
-	server.setupHandlerFactory()
+	err = server.setupHandlerFactory()
+	if err != nil {
+		log.Fatalf("Setup Handler Factory Got err: %s", err)
+	}
 	server.setupServiceManager()
 
+	// the admin api is not worth to stop serving traffic
+	err = server.setupAdminServer()
+	if err != nil {
+		log.Errorf("Setup Admin Server Got err: %s", err)
+	}
+
 	return server
 }
 
@@ -61,7 +83,7 @@ func (server *JanitorServer) setupUpstreamLoader() error {
 
 func (server *JanitorServer) setupListenerManager() error {
 	log.Info("Listener Manager started")
-	listenerManager, err := listener.InitManager(listener.MULTIPORT_LISTENER_MODE, server.config.Listener)
+	listenerManager, err := listener.InitManager(server.config.Listener.Mode, server.config.Listener)
 	if err != nil {
 		return err
 	}
@@ -72,7 +94,14 @@ func (server *JanitorServer) setupListenerManager() error {
 
 func (server *JanitorServer) setupHandlerFactory() error {
 	log.Info("Setup handler factory")
-	handerFactory := handler.NewFactory(server.config.HttpHandler, server.config.Listener)
+	if _, err := loadbalance.New(server.config.Proxy.Strategy); err != nil {
+		return err
+	}
+	if _, err := loadbalance.ParseHashKey(server.config.Proxy.HashKey); err != nil {
+		return err
+	}
+	handerFactory := handler.NewFactory(server.config.HttpHandler, server.config.Listener, server.config.Proxy)
+	handerFactory.Overrides = server.overrides
 	server.ctx = context.WithValue(server.ctx, handler.HANDLER_FACTORY_KEY, handerFactory)
 	server.handerFactory = handerFactory
 	return nil
@@ -84,44 +113,112 @@ func (server *JanitorServer) setupServiceManager() error {
 	return nil
 }
 
+func (server *JanitorServer) setupAdminServer() error {
+	if server.config.Admin.Addr == "" {
+		log.Info("Admin api disabled")
+		return nil
+	}
+
+	log.Info("Setup admin server")
+	host, port, err := net.SplitHostPort(server.config.Admin.Addr)
+	if err != nil {
+		return err
+	}
+	ln, err := server.listenerManager.FetchListener(upstream.UpstreamKey{Proto: admin.ADMIN_PROTO, Ip: host, Port: port})
+	if err != nil {
+		return err
+	}
+
+	server.adminServer = admin.NewServer(server.config.Admin.Addr, server)
+	server.adminServer.Serve(ln)
+	return nil
+}
+
 func (server *JanitorServer) Run() {
-	for {
-		<-server.upstreamLoader.ChangeNotify()
-		for _, u := range server.upstreamLoader.List() {
-			switch u.State.State() {
-			case upstream.STATE_NEW:
-				log.Infof("create new service pod: %s", u.Key())
-				pod, err := server.serviceManager.ForkOrFetchNewServicePod(u)
-				if err != nil {
-					log.Infof("fail to create a service pod: %s", err.Error())
-					continue
-				}
-				pod.Run()
-
-			case upstream.STATE_CHANGED:
-				log.Infof("update existing service pod: %s", u.Key())
-				log.Infof("current upstream has %d targets", len(u.Targets))
-				pod, err := server.serviceManager.ForkOrFetchNewServicePod(u)
-				if err != nil {
-					log.Errorf("failed to found pod %s", u.Key().ToString())
-				} else {
-					pod.Invalid()
-				}
-			}
-
-			u.SetState(upstream.STATE_LISTENING)
+	for event := range server.upstreamLoader.Events() {
+		if event.Type == upstream.EVENT_SYNCED {
+			server.upgradeReadyOnce.Do(server.notifyUpgradeReady)
+			continue
 		}
+		server.serviceManager.HandleEvent(event)
+	}
+}
 
-		for _, u := range server.upstreamLoader.List() {
-			if u.StaleMark {
-				log.Infof("remove unused service pod: %s", u.Key())
-				server.serviceManager.KillServicePod(u)
-			}
-		}
+// Reload pushes a new config into the running components, listeners
+// and service pods already serving are kept as they are
+func (server *JanitorServer) Reload(newConfig config.Config) {
+	changed := config.Diff(server.config, newConfig)
+	if len(changed) == 0 {
+		log.Info("config not changed, nothing to reload")
+		return
+	}
+	log.Infof("reloading config, changed sections: %s", strings.Join(changed, ", "))
+
+	if !strings.EqualFold(newConfig.Upstream.SourceType, server.config.Upstream.SourceType) {
+		log.Warnf("upstream source type change from %s to %s requires a restart", server.config.Upstream.SourceType, newConfig.Upstream.SourceType)
+	}
+
+	if newConfig.Admin.Addr != server.config.Admin.Addr {
+		log.Warnf("admin address change from %s to %s requires a restart", server.config.Admin.Addr, newConfig.Admin.Addr)
+	}
+
+	server.handerFactory.Reload(newConfig)
+	if newConfig.Proxy.Strategy != server.config.Proxy.Strategy || newConfig.Proxy.HashKey != server.config.Proxy.HashKey {
+		log.Infof("load balance strategy changed to %s, rebuilding the service pod handlers", newConfig.Proxy.Strategy)
+		server.serviceManager.ReloadHandlers()
+	}
+	server.listenerManager.Reload(newConfig.Listener)
+	server.upstreamLoader.Reload(newConfig.Upstream)
+	server.config = newConfig
+}
+
+// Shutdown drains every service pod, releasing their consul sessions and
+// entries, then closes the listeners left
+func (server *JanitorServer) Shutdown() {
+	log.Info("Janitor Server shutting down")
+	if server.serviceManager != nil {
+		server.serviceManager.Shutdown()
+	}
+	if server.listenerManager != nil {
+		server.listenerManager.Shutdown()
+	}
+	if server.adminServer != nil {
+		server.adminServer.Shutdown()
 	}
+	log.Info("Janitor Server stopped")
 }
 
-func (server *JanitorServer) Shutdown() {}
+func (server *JanitorServer) Upstreams() []*upstream.Upstream {
+	return server.upstreamLoader.List()
+}
+
+// UpstreamsStale tells whether the upstreams come from the snapshot saved
+// at the time returned, their sources being unreachable since startup
+func (server *JanitorServer) UpstreamsStale() (bool, time.Time) {
+	if snapshotUpstreamLoader, ok := server.upstreamLoader.(*upstream.SnapshotUpstreamLoader); ok {
+		return snapshotUpstreamLoader.Stale()
+	}
+	return false, time.Time{}
+}
+
+func (server *JanitorServer) Pods() []*service.ServicePod {
+	return server.serviceManager.Pods()
+}
+
+func (server *JanitorServer) Overrides() *upstream.Overrides {
+	return server.overrides
+}
+
+// LogServiceActivity records an activity of serviceName, on its pod when
+// it is served
+func (server *JanitorServer) LogServiceActivity(serviceName, activity string) {
+	server.serviceManager.LogActivity(serviceName, activity)
+}
+
+// Conflicts returns the frontends claimed by several services
+func (server *JanitorServer) Conflicts() []upstream.FrontendConflict {
+	return server.upstreamLoader.Conflicts()
+}
 
 func (server *JanitorServer) PortsOccupied() []string {
 	return server.serviceManager.PortsOccupied()
@@ -52,5 +52,16 @@ func TestSetupHandlerFactory(t *testing.T) {
 func TestSetupServiceManager(t *testing.T) {
 	janitorServer := NewJanitorServer(config.DefaultConfig())
 	janitorServer.setupListenerManager()
-	assert.Not(t, janitorServer.serviceManager)
+	assert.Nil(t, janitorServer.serviceManager)
+}
+
+func TestReload(t *testing.T) {
+	janitorServer := NewJanitorServer(config.DefaultConfig())
+	janitorServer.Init()
+
+	newConfig := config.DefaultConfig()
+	newConfig.HttpHandler.ClientIPHeader = "X-Client-Ip"
+	janitorServer.Reload(newConfig)
+	assert.Equal(t, janitorServer.config.HttpHandler.ClientIPHeader, "X-Client-Ip")
+	assert.Equal(t, janitorServer.handerFactory.HttpHandlerCfg.ClientIPHeader, "X-Client-Ip")
 }
@@ -0,0 +1,144 @@
+package janitor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/listener"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	UPGRADE_READY_FD_ENV = "JANITOR_UPGRADE_READY_FD"
+	UPGRADE_TIMEOUT      = time.Minute * 2
+
+	// ExtraFiles of a child start at fd 3, the ready pipe goes first and
+	// the listeners follow
+	upgradeReadyFd         = 3
+	upgradeFirstListenerFd = 4
+)
+
+// Upgrade starts the binary of janitor again with every listener handed
+// over, and blocks until the new process reports it is serving them.
+// The caller is expected to hand over its pods and exit once it returns
+// without error
+func (server *JanitorServer) Upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	keys, files, err := server.listenerManager.Files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	fds := make([]uintptr, 0, len(files))
+	for i := range files {
+		fds = append(fds, uintptr(upgradeFirstListenerFd+i))
+	}
+	listenersEnv, err := listener.InheritedListenersEnv(keys, fds)
+	if err != nil {
+		return err
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, listener.INHERITED_LISTENERS_ENV+"=") || strings.HasPrefix(e, UPGRADE_READY_FD_ENV+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	env = append(env, listenersEnv, fmt.Sprintf("%s=%d", UPGRADE_READY_FD_ENV, upgradeReadyFd))
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{readyWriter}, files...)
+
+	log.Infof("starting new janitor process %s with %d listeners", executable, len(files))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		// the child writes a single byte once ready, reading nothing
+		// means it exited before
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("new janitor process exited before ready: %s", err)
+		}
+	case <-time.After(UPGRADE_TIMEOUT):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new janitor process not ready in %s", UPGRADE_TIMEOUT)
+	}
+
+	log.Infof("new janitor process %d is ready", cmd.Process.Pid)
+	return nil
+}
+
+// Handover drains every pod of a process replaced by Upgrade
+func (server *JanitorServer) Handover() {
+	log.Info("Janitor Server handing over to the new process")
+	server.serviceManager.Handover()
+	server.listenerManager.Shutdown()
+	if server.adminServer != nil {
+		server.adminServer.Shutdown()
+	}
+	log.Info("Janitor Server stopped")
+}
+
+// notifyUpgradeReady tells the parent process, if this one was started by
+// Upgrade, that the inherited listeners are served now
+func (server *JanitorServer) notifyUpgradeReady() {
+	value := os.Getenv(UPGRADE_READY_FD_ENV)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(UPGRADE_READY_FD_ENV)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		log.Errorf("invalid %s %s", UPGRADE_READY_FD_ENV, value)
+		return
+	}
+
+	server.listenerManager.CloseInherited()
+
+	ready := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.Errorf("notify parent process ready error: %s", err)
+		return
+	}
+	log.Info("notified parent process that listeners are taken over")
+}
@@ -0,0 +1,138 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/go-proxyproto"
+)
+
+const (
+	INHERITED_LISTENERS_ENV = "JANITOR_INHERITED_LISTENERS"
+)
+
+// inheritedListener describes a listener socket handed over by the
+// janitor process being upgraded
+type inheritedListener struct {
+	Key upstream.UpstreamKey
+	Fd  uintptr
+}
+
+// InheritedListenersEnv encodes the listeners handed to a new process, the
+// listener of keys[i] is expected at file descriptor fds[i] in the child
+func InheritedListenersEnv(keys []upstream.UpstreamKey, fds []uintptr) (string, error) {
+	if len(keys) != len(fds) {
+		return "", fmt.Errorf("%d listener keys for %d file descriptors", len(keys), len(fds))
+	}
+
+	inherited := make([]inheritedListener, 0, len(keys))
+	for i, key := range keys {
+		inherited = append(inherited, inheritedListener{Key: key, Fd: fds[i]})
+	}
+
+	data, err := json.Marshal(inherited)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s=%s", INHERITED_LISTENERS_ENV, data), nil
+}
+
+// inheritListeners rebuilds the listeners handed over by the parent
+// process, the env is cleared so that they are not inherited twice
+func inheritListeners() map[upstream.UpstreamKey]*net.TCPListener {
+	listeners := make(map[upstream.UpstreamKey]*net.TCPListener)
+
+	value := os.Getenv(INHERITED_LISTENERS_ENV)
+	if value == "" {
+		return listeners
+	}
+	os.Unsetenv(INHERITED_LISTENERS_ENV)
+
+	var inherited []inheritedListener
+	if err := json.Unmarshal([]byte(value), &inherited); err != nil {
+		log.Errorf("decode inherited listeners error: %s", err)
+		return listeners
+	}
+
+	for _, i := range inherited {
+		file := os.NewFile(i.Fd, i.Key.ToString())
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Errorf("inherit listener %s error: %s", i.Key.ToString(), err)
+			continue
+		}
+
+		tcpListener, ok := ln.(*net.TCPListener)
+		if !ok {
+			log.Errorf("inherited listener %s is not a tcp listener", i.Key.ToString())
+			ln.Close()
+			continue
+		}
+
+		log.Infof("inherited listener %s from parent process", i.Key.ToString())
+		listeners[i.Key] = tcpListener
+	}
+
+	return listeners
+}
+
+// Files returns a duplicate of the file of every listener, to be handed
+// over to a new process
+func (manager *Manager) Files() ([]upstream.UpstreamKey, []*os.File, error) {
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+
+	keys := make([]upstream.UpstreamKey, 0, len(manager.Listeners))
+	files := make([]*os.File, 0, len(manager.Listeners))
+	for key, l := range manager.Listeners {
+		file, err := tcpListenerOf(l).File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+
+		keys = append(keys, key)
+		files = append(files, file)
+	}
+
+	return keys, files, nil
+}
+
+// CloseInherited closes the inherited listeners no upstream claimed
+func (manager *Manager) CloseInherited() {
+	manager.rwMutex.Lock()
+	defer manager.rwMutex.Unlock()
+
+	for key, ln := range manager.inherited {
+		log.Infof("close inherited listener %s no longer in use", key.ToString())
+		ln.Close()
+	}
+	manager.inherited = make(map[upstream.UpstreamKey]*net.TCPListener)
+}
+
+// listen adopts the inherited listener of key if any, or binds a new one
+func (manager *Manager) listen(key upstream.UpstreamKey) (*proxyproto.Listener, error) {
+	if ln, found := manager.inherited[key]; found {
+		delete(manager.inherited, key)
+		return &proxyproto.Listener{Listener: TcpKeepAliveListener{ln}}, nil
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(key.Ip, key.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyproto.Listener{Listener: TcpKeepAliveListener{ln.(*net.TCPListener)}}, nil
+}
+
+func tcpListenerOf(l *proxyproto.Listener) *net.TCPListener {
+	return l.Listener.(TcpKeepAliveListener).TCPListener
+}
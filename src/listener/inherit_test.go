@@ -0,0 +1,45 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInheritListeners(t *testing.T) {
+	parent, _ := InitManager(MULTIPORT_LISTENER_MODE, config.DefaultConfig().Listener)
+	key := upstream.UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "0"}
+	ln, err := parent.FetchListener(key)
+	assert.Nil(t, err)
+	defer parent.Shutdown()
+
+	keys, files, err := parent.Files()
+	assert.Nil(t, err)
+	assert.Equal(t, keys, []upstream.UpstreamKey{key})
+
+	env, err := InheritedListenersEnv(keys, []uintptr{files[0].Fd()})
+	assert.Nil(t, err)
+	os.Setenv(INHERITED_LISTENERS_ENV, env[len(INHERITED_LISTENERS_ENV)+1:])
+
+	child, _ := InitManager(MULTIPORT_LISTENER_MODE, config.DefaultConfig().Listener)
+	defer child.Shutdown()
+	assert.Equal(t, os.Getenv(INHERITED_LISTENERS_ENV), "")
+
+	adopted, err := child.FetchListener(key)
+	assert.Nil(t, err)
+	assert.Equal(t, adopted.Addr().String(), ln.Addr().String())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	conn.Close()
+}
+
+func TestInheritedListenersEnvMismatch(t *testing.T) {
+	_, err := InheritedListenersEnv([]upstream.UpstreamKey{{}}, []uintptr{})
+	assert.NotNil(t, err)
+}
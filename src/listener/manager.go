@@ -2,6 +2,7 @@ package listener
 
 import (
 	"net"
+	"sync"
 
 	"github.com/Dataman-Cloud/janitor/src/config"
 	"github.com/Dataman-Cloud/janitor/src/upstream"
@@ -24,6 +25,9 @@ type Manager struct {
 	Mode      string
 	Listeners map[upstream.UpstreamKey]*proxyproto.Listener
 	Config    config.Listener
+
+	inherited map[upstream.UpstreamKey]*net.TCPListener
+	rwMutex   sync.RWMutex
 }
 
 func InitManager(mode string, Config config.Listener) (*Manager, error) {
@@ -31,6 +35,7 @@ func InitManager(mode string, Config config.Listener) (*Manager, error) {
 	manager.Mode = mode
 	manager.Listeners = make(map[upstream.UpstreamKey]*proxyproto.Listener)
 	manager.Config = Config
+	manager.inherited = inheritListeners()
 
 	switch mode {
 	case SINGLE_LISTENER_MODE:
@@ -48,46 +53,82 @@ func ManagerFromContext(ctx context.Context) *Manager {
 }
 
 func (manager *Manager) Shutdown() {
+	manager.rwMutex.Lock()
+	defer manager.rwMutex.Unlock()
+
 	for _, listener := range manager.Listeners {
 		listener.Close()
 	}
+	for _, ln := range manager.inherited {
+		ln.Close()
+	}
+}
+
+// Reload takes the new listener settings, listeners already bound are
+// kept open so the ports being served are not interrupted
+func (manager *Manager) Reload(Config config.Listener) {
+	manager.rwMutex.Lock()
+	defer manager.rwMutex.Unlock()
+
+	if Config.Mode != manager.Mode {
+		log.Warnf("listener mode change from %s to %s requires a restart", manager.Mode, Config.Mode)
+	}
+	if !Config.IP.Equal(manager.Config.IP) {
+		log.Infof("listener ip changed from %s to %s, only new listeners bind to it", manager.Config.IP, Config.IP)
+	}
+
+	manager.Config = Config
 }
 
 func (manager *Manager) DefaultUpstreamKey() upstream.UpstreamKey {
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+	return manager.defaultUpstreamKey()
+}
+
+func (manager *Manager) defaultUpstreamKey() upstream.UpstreamKey {
 	return upstream.UpstreamKey{Ip: manager.Config.IP.String(), Port: manager.Config.DefaultPort}
 }
 
 func (manager *Manager) DefaultListener() *proxyproto.Listener {
-	return manager.Listeners[manager.DefaultUpstreamKey()]
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+	return manager.Listeners[manager.defaultUpstreamKey()]
 }
 
 func setupSingleListener(manager *Manager) error {
-	ln, err := net.Listen("tcp", net.JoinHostPort(manager.Config.IP.String(), manager.Config.DefaultPort))
+	ln, err := manager.listen(manager.defaultUpstreamKey())
 	if err != nil {
 		log.Errorf("%s", err)
 		return err
 	}
 
-	manager.Listeners[manager.DefaultUpstreamKey()] = &proxyproto.Listener{Listener: TcpKeepAliveListener{ln.(*net.TCPListener)}}
+	manager.Listeners[manager.defaultUpstreamKey()] = ln
 	return nil
 }
 
 func (manager *Manager) FetchListener(key upstream.UpstreamKey) (*proxyproto.Listener, error) {
+	manager.rwMutex.Lock()
+	defer manager.rwMutex.Unlock()
+
 	listener := manager.Listeners[key]
 	if listener == nil {
-		ln, err := net.Listen("tcp", net.JoinHostPort(key.Ip, key.Port))
+		ln, err := manager.listen(key)
 		if err != nil {
 			log.Errorf("%s", err)
 			return nil, err
 		}
 
-		manager.Listeners[key] = &proxyproto.Listener{Listener: TcpKeepAliveListener{ln.(*net.TCPListener)}}
+		manager.Listeners[key] = ln
 	}
 
 	return manager.Listeners[key], nil
 }
 
 func (manager *Manager) Remove(key upstream.UpstreamKey) {
+	manager.rwMutex.Lock()
+	defer manager.rwMutex.Unlock()
+
 	l, ok := manager.Listeners[key]
 	if ok {
 		err := l.Close()
@@ -100,6 +141,9 @@ func (manager *Manager) Remove(key upstream.UpstreamKey) {
 }
 
 func (manager *Manager) ListeningPorts() []string {
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+
 	var ports []string
 	for key, _ := range manager.Listeners {
 		ports = append(ports, key.Port)
@@ -0,0 +1,205 @@
+package loadbalance
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+const (
+	STRATEGY_CONSISTENT_HASH = "chash"
+
+	HASH_KEY_IP     = config.HASH_KEY_IP
+	HASH_KEY_HEADER = config.HASH_KEY_HEADER
+	HASH_KEY_COOKIE = config.HASH_KEY_COOKIE
+	HASH_KEY_QUERY  = config.HASH_KEY_QUERY
+
+	// points of a target on the ring for each unit of its weight
+	HASH_RING_REPLICAS = 160
+	// bound of the points on a ring, the points of every target being
+	// scaled down when their weights sum to more
+	HASH_RING_MAX_POINTS = 1 << 16
+)
+
+func init() {
+	Register(STRATEGY_CONSISTENT_HASH, func() LoadBalancer { return NewConsistentHashLoadBalancer() })
+}
+
+// HashKey tells which part of a request is hashed to pick a target
+type HashKey struct {
+	Source string
+	Name   string // of the header, cookie or query parameter
+}
+
+// ParseHashKey reads ip, header:<name>, cookie:<name> or query:<name>
+func ParseHashKey(raw string) (HashKey, error) {
+	if err := config.ValidateHashKey(raw); err != nil {
+		return HashKey{}, err
+	}
+	kv := strings.SplitN(raw, ":", 2)
+	key := HashKey{Source: kv[0]}
+	if len(kv) == 2 {
+		key.Name = kv[1]
+	}
+	return key, nil
+}
+
+func (key HashKey) ToString() string {
+	if key.Name == "" {
+		return key.Source
+	}
+	return key.Source + ":" + key.Name
+}
+
+// Of returns the value hashed for req, its client ip when the key is
+// missing, like on a connection without a request
+func (key HashKey) Of(req *Request) string {
+	if req == nil {
+		return ""
+	}
+
+	value := ""
+	switch key.Source {
+	case HASH_KEY_HEADER:
+		value = req.Header.Get(key.Name)
+	case HASH_KEY_COOKIE:
+		value = req.Cookie(key.Name)
+	case HASH_KEY_QUERY:
+		value = req.Query.Get(key.Name)
+	}
+	if value == "" {
+		return req.ClientIP
+	}
+	return value
+}
+
+// KeyedLoadBalancer picks targets by a key of the request, set by the
+// handler factory from the settings of the service
+type KeyedLoadBalancer interface {
+	LoadBalancer
+	SetHashKey(key HashKey)
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *upstream.Target
+}
+
+// ConsistentHashLoadBalancer sends the requests of the same key to the
+// same target. Targets are placed on a ring with HASH_RING_REPLICAS
+// points per unit of weight, and a key goes to the first point after its
+// hash. The points depend on the address of the target alone, so a
+// target joining or leaving only moves the keys of its own points, as
+// long as the ring holds at most HASH_RING_MAX_POINTS
+type ConsistentHashLoadBalancer struct {
+	Targets *upstream.TargetSet
+	Key     HashKey
+
+	ring       []ringPoint
+	ringSource []*upstream.Target // the targets the ring was built from
+	lock       sync.Mutex
+}
+
+func NewConsistentHashLoadBalancer() *ConsistentHashLoadBalancer {
+	return &ConsistentHashLoadBalancer{Key: HashKey{Source: HASH_KEY_IP}}
+}
+
+func (ch *ConsistentHashLoadBalancer) SetHashKey(key HashKey) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.Key = key
+}
+
+func (ch *ConsistentHashLoadBalancer) Seed(targets *upstream.TargetSet) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.Targets = targets
+	ch.ring, ch.ringSource = nil, nil
+}
+
+func (ch *ConsistentHashLoadBalancer) Next(req *Request) *upstream.Target {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	targets := ch.Targets.Targets()
+	if !sameTargets(targets, ch.ringSource) {
+		ch.ring, ch.ringSource = buildRing(targets), targets
+	}
+	if len(ch.ring) == 0 {
+		return nil
+	}
+
+	hash := hashOf(ch.Key.Of(req))
+	i := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i].hash >= hash })
+	if i == len(ch.ring) {
+		i = 0
+	}
+	return ch.ring[i].target
+}
+
+// sameTargets tells whether both slices are the same snapshot of a
+// target set, every change of the set storing a new one
+func sameTargets(targets, source []*upstream.Target) bool {
+	if len(targets) != len(source) {
+		return false
+	}
+	return len(targets) == 0 || &targets[0] == &source[0]
+}
+
+func buildRing(targets []*upstream.Target) []ringPoint {
+	total := 0
+	for _, target := range targets {
+		if target.Weight > 0 {
+			total += target.Weight * HASH_RING_REPLICAS
+		}
+	}
+
+	ring := make([]ringPoint, 0)
+	for _, target := range targets {
+		addr := target.Addr()
+		for i := 0; i < ringPoints(target.Weight, total); i++ {
+			ring = append(ring, ringPoint{hash: hashOf(addr + "#" + strconv.Itoa(i)), target: target})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].target.Addr() < ring[j].target.Addr()
+		}
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// ringPoints returns the points of a target of weight on a ring of total
+// points, scaled down when the total is over HASH_RING_MAX_POINTS. A
+// target keeps its first points and one at least, so scaling moves few
+// keys
+func ringPoints(weight, total int) int {
+	if weight <= 0 {
+		return 0
+	}
+	n := weight * HASH_RING_REPLICAS
+	if total > HASH_RING_MAX_POINTS {
+		n = int(int64(n) * HASH_RING_MAX_POINTS / int64(total))
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func hashOf(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv spreads keys differing by their last bytes poorly, mix it
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,134 @@
+package loadbalance
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHashKey(t *testing.T) {
+	key, err := ParseHashKey("header:X-User")
+	assert.Nil(t, err)
+	assert.Equal(t, key, HashKey{Source: HASH_KEY_HEADER, Name: "X-User"})
+	assert.Equal(t, key.ToString(), "header:X-User")
+
+	key, err = ParseHashKey("ip")
+	assert.Nil(t, err)
+	assert.Equal(t, key.Source, HASH_KEY_IP)
+
+	for _, raw := range []string{"", "cookie", "query:", "ip:X", "body:user"} {
+		_, err = ParseHashKey(raw)
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestHashKeyOf(t *testing.T) {
+	req := &Request{
+		ClientIP: "192.168.1.10",
+		Header:   http.Header{"X-User": {"alice"}, "Cookie": {"sid=s1"}},
+		Query:    url.Values{"user": {"bob"}},
+	}
+	assert.Equal(t, HashKey{Source: HASH_KEY_IP}.Of(req), "192.168.1.10")
+	assert.Equal(t, HashKey{Source: HASH_KEY_HEADER, Name: "X-User"}.Of(req), "alice")
+	assert.Equal(t, HashKey{Source: HASH_KEY_COOKIE, Name: "sid"}.Of(req), "s1")
+	assert.Equal(t, HashKey{Source: HASH_KEY_QUERY, Name: "user"}.Of(req), "bob")
+	// falls back to the client ip
+	assert.Equal(t, HashKey{Source: HASH_KEY_QUERY, Name: "tenant"}.Of(req), "192.168.1.10")
+}
+
+func testHashTargets(n int) []*upstream.Target {
+	targets := make([]*upstream.Target, 0, n)
+	for i := 0; i < n; i++ {
+		targets = append(targets, testTarget("", strconv.Itoa(8000+i), 1))
+	}
+	return targets
+}
+
+func testHashPicks(ch *ConsistentHashLoadBalancer, users int) map[string]string {
+	picks := make(map[string]string, users)
+	for i := 0; i < users; i++ {
+		user := "user-" + strconv.Itoa(i)
+		picks[user] = ch.Next(&Request{Header: http.Header{"X-User": {user}}}).Addr()
+	}
+	return picks
+}
+
+func TestConsistentHashSticky(t *testing.T) {
+	ch := NewConsistentHashLoadBalancer()
+	ch.SetHashKey(HashKey{Source: HASH_KEY_HEADER, Name: "X-User"})
+	ch.Seed(upstream.NewTargetSet(testHashTargets(5)))
+
+	picks := testHashPicks(ch, 1000)
+	counts := make(map[string]int)
+	for _, addr := range picks {
+		counts[addr]++
+	}
+	assert.Equal(t, len(counts), 5)
+	for addr, count := range counts {
+		assert.True(t, count > 100 && count < 300, "%s got %d", addr, count)
+	}
+
+	// another janitor with the targets listed in another order agrees
+	targets := testHashTargets(5)
+	targets[0], targets[4] = targets[4], targets[0]
+	other := NewConsistentHashLoadBalancer()
+	other.SetHashKey(HashKey{Source: HASH_KEY_HEADER, Name: "X-User"})
+	other.Seed(upstream.NewTargetSet(targets))
+	assert.Equal(t, testHashPicks(other, 1000), picks)
+}
+
+func TestConsistentHashRemap(t *testing.T) {
+	targets := upstream.NewTargetSet(testHashTargets(5))
+	ch := NewConsistentHashLoadBalancer()
+	ch.SetHashKey(HashKey{Source: HASH_KEY_HEADER, Name: "X-User"})
+	ch.Seed(targets)
+	before := testHashPicks(ch, 1000)
+
+	// a sixth target takes keys from the others only
+	targets.Swap(testHashTargets(6))
+	after := testHashPicks(ch, 1000)
+	moved := 0
+	for user, addr := range after {
+		if addr != before[user] {
+			assert.Equal(t, addr, "10.0.0.1:8005")
+			moved++
+		}
+	}
+	assert.True(t, moved > 100 && moved < 300, "%d moved", moved)
+
+	// removing it again moves back only its keys
+	targets.Swap(testHashTargets(5))
+	assert.Equal(t, testHashPicks(ch, 1000), before)
+}
+
+func TestConsistentHashWeight(t *testing.T) {
+	ch := NewConsistentHashLoadBalancer()
+	ch.Seed(upstream.NewTargetSet([]*upstream.Target{testTarget("", "1", 0)}))
+	assert.Nil(t, ch.Next(&Request{ClientIP: "192.168.1.10"}))
+
+	heavy, light := testTarget("", "1", 3), testTarget("", "2", 1)
+	ch.Seed(upstream.NewTargetSet([]*upstream.Target{heavy, light}))
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[ch.Next(&Request{ClientIP: "192.168.1." + strconv.Itoa(i)}).ServicePort]++
+	}
+	assert.True(t, counts["1"] > 2*counts["2"], "%v", counts)
+}
+
+func TestConsistentHashRingBounded(t *testing.T) {
+	targets := []*upstream.Target{testTarget("", "1", upstream.MAX_WEIGHT), testTarget("", "2", upstream.MAX_WEIGHT), testTarget("", "3", 1)}
+	ring := buildRing(targets)
+	assert.True(t, len(ring) <= HASH_RING_MAX_POINTS, "%d points", len(ring))
+
+	points := make(map[string]int)
+	for _, point := range ring {
+		points[point.target.ServicePort]++
+	}
+	assert.Equal(t, points["1"], points["2"])
+	assert.True(t, points["3"] >= 1 && points["3"] < points["1"]/100, "%v", points)
+}
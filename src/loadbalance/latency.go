@@ -0,0 +1,119 @@
+package loadbalance
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+const (
+	// time for a latency sample to weigh 1/e of the average, it is also
+	// how a target left alone fades back to an unknown one
+	LATENCY_DECAY = time.Second * 10
+	// a target with no sample for so long is forgotten
+	LATENCY_FORGET = LATENCY_DECAY * 30
+	// least latency counted for a round trip which failed or answered 5xx,
+	// so that a target failing fast is not taken for a fast one
+	LATENCY_FAILURE_PENALTY = time.Second
+)
+
+// TargetLatency is the round trips to a target seen by its http proxies:
+// the exponentially weighted moving average of the time to the response
+// headers, and the round trips in flight
+type TargetLatency struct {
+	Average  time.Duration
+	InFlight int64
+
+	observedAt time.Time
+}
+
+var (
+	latencies     = make(map[string]*TargetLatency) // service name/target addr -> latency
+	latenciesLock sync.Mutex
+	latenciesSeen time.Time // last time latencies were checked for stale targets
+
+	now = time.Now
+)
+
+// ObserveRoundTrip counts a round trip to t in flight until done is
+// called, once its response headers are read or it failed. A failed round
+// trip counts for LATENCY_FAILURE_PENALTY at least
+func ObserveRoundTrip(t *upstream.Target) (done func(failed bool)) {
+	key := loadKey(t)
+	latenciesLock.Lock()
+	latency, found := latencies[key]
+	if !found {
+		latency = &TargetLatency{}
+		latencies[key] = latency
+	}
+	latency.InFlight++
+	latenciesLock.Unlock()
+
+	start := now()
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			latenciesLock.Lock()
+			defer latenciesLock.Unlock()
+			latency.InFlight--
+			sample := now().Sub(start)
+			if failed && sample < LATENCY_FAILURE_PENALTY {
+				sample = LATENCY_FAILURE_PENALTY
+			}
+			latency.observe(sample, now())
+			forgetLatencies(now())
+			// observed again in case it was forgotten in flight
+			latencies[key] = latency
+		})
+	}
+}
+
+// observe folds a sample into the average, weighing it by the time since
+// the last one so that the average follows time rather than traffic
+func (latency *TargetLatency) observe(sample time.Duration, at time.Time) {
+	if latency.observedAt.IsZero() {
+		latency.Average, latency.observedAt = sample, at
+		return
+	}
+	w := math.Exp(-float64(at.Sub(latency.observedAt)) / float64(LATENCY_DECAY))
+	latency.Average = time.Duration(float64(latency.Average)*w + float64(sample)*(1-w))
+	latency.observedAt = at
+}
+
+// decayed returns the average fading to zero once the target is left
+// without samples, so that a slow target is tried again after a while
+func (latency TargetLatency) decayed(at time.Time) time.Duration {
+	if latency.observedAt.IsZero() || !at.After(latency.observedAt) {
+		return latency.Average
+	}
+	w := math.Exp(-float64(at.Sub(latency.observedAt)) / float64(LATENCY_DECAY))
+	return time.Duration(float64(latency.Average) * w)
+}
+
+func forgetLatencies(at time.Time) {
+	if at.Sub(latenciesSeen) < LATENCY_FORGET {
+		return
+	}
+	latenciesSeen = at
+	for key, latency := range latencies {
+		if latency.InFlight == 0 && at.Sub(latency.observedAt) > LATENCY_FORGET {
+			delete(latencies, key)
+		}
+	}
+}
+
+// LatencyOf returns the latency of t, across the pods serving its
+// service, its average decayed to now
+func LatencyOf(t *upstream.Target) TargetLatency {
+	latenciesLock.Lock()
+	defer latenciesLock.Unlock()
+	latency, found := latencies[loadKey(t)]
+	if !found {
+		return TargetLatency{}
+	}
+	decayed := *latency
+	decayed.Average = latency.decayed(now())
+	return decayed
+}
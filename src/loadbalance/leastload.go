@@ -0,0 +1,70 @@
+package loadbalance
+
+import (
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+const (
+	STRATEGY_LEAST_CONNECTIONS = "leastconn"
+	STRATEGY_LEAST_REQUESTS    = "leastreq"
+)
+
+func init() {
+	Register(STRATEGY_LEAST_CONNECTIONS, func() LoadBalancer {
+		return NewLeastLoadBalancer(func(load TargetLoad) int64 { return load.Connections })
+	})
+	Register(STRATEGY_LEAST_REQUESTS, func() LoadBalancer {
+		return NewLeastLoadBalancer(func(load TargetLoad) int64 { return load.Requests })
+	})
+}
+
+// LeastLoadBalancer picks the target of the lowest load for its weight,
+// the load being its open connections or its outstanding requests. Ties
+// go round robin, a target of weight 0 gets none
+type LeastLoadBalancer struct {
+	Targets *upstream.TargetSet
+
+	loadOf func(load TargetLoad) int64
+	next   int
+	lock   sync.Mutex
+}
+
+func NewLeastLoadBalancer(loadOf func(load TargetLoad) int64) *LeastLoadBalancer {
+	return &LeastLoadBalancer{loadOf: loadOf}
+}
+
+func (ll *LeastLoadBalancer) Seed(targets *upstream.TargetSet) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.Targets = targets
+	ll.next = 0
+}
+
+func (ll *LeastLoadBalancer) Next(req *Request) *upstream.Target {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	targets := ll.Targets.Targets()
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var best *upstream.Target
+	var bestLoad int64
+	start := ll.next % len(targets)
+	for i := range targets {
+		target := targets[(start+i)%len(targets)]
+		if target.Weight <= 0 {
+			continue
+		}
+		load := ll.loadOf(LoadOf(target))
+		// load / weight < bestLoad / best.Weight
+		if best == nil || load*int64(best.Weight) < bestLoad*int64(target.Weight) {
+			best, bestLoad = target, load
+		}
+	}
+	ll.next = (start + 1) % len(targets)
+	return best
+}
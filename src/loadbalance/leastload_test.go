@@ -0,0 +1,58 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrack(t *testing.T) {
+	target := testTarget("track", "1", 1)
+	doneConn := TrackConnection(target)
+	doneReq := TrackRequest(target)
+	assert.Equal(t, LoadOf(target), TargetLoad{Connections: 1, Requests: 1})
+
+	doneReq()
+	doneReq()
+	assert.Equal(t, LoadOf(target), TargetLoad{Connections: 1})
+	doneConn()
+	assert.Equal(t, LoadOf(target), TargetLoad{})
+	assert.Equal(t, len(loads), 0)
+}
+
+func TestLeastConnections(t *testing.T) {
+	a, b, c := testTarget("leastconn", "1", 1), testTarget("leastconn", "2", 1), testTarget("leastconn", "3", 0)
+	lb, _ := New(STRATEGY_LEAST_CONNECTIONS)
+	lb.Seed(upstream.NewTargetSet([]*upstream.Target{a, b, c}))
+
+	// a long poll holds a, the next ones go to b as long as it is less busy
+	done := TrackConnection(lb.Next(nil))
+	defer done()
+	busy := lb.Next(nil)
+	assert.NotEqual(t, busy, c)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, lb.Next(nil), busy)
+	}
+	// requests alone do not count as connections
+	doneReq := TrackRequest(busy)
+	defer doneReq()
+	assert.Equal(t, lb.Next(nil), busy)
+}
+
+func TestLeastRequestsWeighted(t *testing.T) {
+	a, b := testTarget("leastreq", "1", 3), testTarget("leastreq", "2", 1)
+	lb, _ := New(STRATEGY_LEAST_REQUESTS)
+	lb.Seed(upstream.NewTargetSet([]*upstream.Target{a, b}))
+
+	counts := make(map[*upstream.Target]int)
+	for i := 0; i < 8; i++ {
+		target := lb.Next(nil)
+		counts[target]++
+		done := TrackRequest(target)
+		defer done()
+	}
+	assert.Equal(t, counts[a], 6)
+	assert.Equal(t, counts[b], 2)
+}
@@ -0,0 +1,68 @@
+package loadbalance
+
+import (
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+// TargetLoad is what a target is busy with: the connections proxied to
+// it by the http proxies, requests and websockets alike, and the http
+// requests waiting for their response
+type TargetLoad struct {
+	Connections int64
+	Requests    int64
+}
+
+var (
+	loads     = make(map[string]*TargetLoad) // service name/target addr -> load
+	loadsLock sync.Mutex
+)
+
+func loadKey(t *upstream.Target) string {
+	return t.ServiceName + "/" + t.Addr()
+}
+
+// TrackConnection counts a connection to t until done is called
+func TrackConnection(t *upstream.Target) (done func()) {
+	return track(t, func(load *TargetLoad, delta int64) { load.Connections += delta })
+}
+
+// TrackRequest counts an http request to t until done is called
+func TrackRequest(t *upstream.Target) (done func()) {
+	return track(t, func(load *TargetLoad, delta int64) { load.Requests += delta })
+}
+
+func track(t *upstream.Target, count func(load *TargetLoad, delta int64)) func() {
+	key := loadKey(t)
+	loadsLock.Lock()
+	load, found := loads[key]
+	if !found {
+		load = &TargetLoad{}
+		loads[key] = load
+	}
+	count(load, 1)
+	loadsLock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			loadsLock.Lock()
+			defer loadsLock.Unlock()
+			count(load, -1)
+			if load.Connections == 0 && load.Requests == 0 {
+				delete(loads, key)
+			}
+		})
+	}
+}
+
+// LoadOf returns the load of t, across the pods serving its service
+func LoadOf(t *upstream.Target) TargetLoad {
+	loadsLock.Lock()
+	defer loadsLock.Unlock()
+	if load, found := loads[loadKey(t)]; found {
+		return *load
+	}
+	return TargetLoad{}
+}
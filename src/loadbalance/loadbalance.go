@@ -0,0 +1,83 @@
+package loadbalance
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+type LoadBalancer interface {
+	// Next returns nil when there is no target, req is nil for a
+	// connection without a request
+	Next(req *Request) *upstream.Target
+	Seed(targets *upstream.TargetSet)
+}
+
+// Request is what a strategy may read of the request it balances
+type Request struct {
+	ClientIP string
+	Header   http.Header
+	Query    url.Values
+}
+
+func NewRequest(r *http.Request, clientIP string) *Request {
+	return &Request{ClientIP: clientIP, Header: r.Header, Query: r.URL.Query()}
+}
+
+// Cookie returns the value of the cookie name, empty when it is not set
+func (req *Request) Cookie(name string) string {
+	if req == nil {
+		return ""
+	}
+	cookie, err := (&http.Request{Header: req.Header}).Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// Factory builds a load balancer of a strategy
+type Factory func() LoadBalancer
+
+var (
+	registry     = make(map[string]Factory)
+	registryLock sync.RWMutex
+)
+
+// Register makes a strategy available under name, as proxy.strategy or
+// the lb-strategy of a service
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = factory
+	config.RegisterStrategy(name)
+}
+
+// New returns a load balancer of the strategy name
+func New(name string) (LoadBalancer, error) {
+	registryLock.RLock()
+	factory, found := registry[name]
+	registryLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("load balance strategy %s is not registered, should be one of %v", name, Strategies())
+	}
+	return factory(), nil
+}
+
+// Strategies returns the names of the strategies registered
+func Strategies() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,40 @@
+package loadbalance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTarget returns a target of 10.0.0.1, its load and latency being
+// kept apart from those of other tests by serviceName
+func testTarget(serviceName, port string, weight int) *upstream.Target {
+	return &upstream.Target{ServiceName: serviceName, ServiceAddress: "10.0.0.1", ServicePort: port, Weight: weight}
+}
+
+func TestNew(t *testing.T) {
+	lb, err := New(STRATEGY_ROUND_ROBIN)
+	assert.Nil(t, err)
+	assert.IsType(t, &RoundRobinLoadBalancer{}, lb)
+
+	_, err = New("fastest")
+	assert.NotNil(t, err)
+	assert.Contains(t, Strategies(), STRATEGY_ROUND_ROBIN)
+}
+
+func TestRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api?user=42", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	req := NewRequest(r, "10.0.0.1")
+	assert.Equal(t, req.ClientIP, "10.0.0.1")
+	assert.Equal(t, req.Query.Get("user"), "42")
+	assert.Equal(t, req.Cookie("session"), "abc")
+	assert.Equal(t, req.Cookie("missing"), "")
+
+	var none *Request
+	assert.Equal(t, none.Cookie("session"), "")
+}
@@ -0,0 +1,74 @@
+package loadbalance
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+const STRATEGY_P2C = "p2c"
+
+func init() {
+	Register(STRATEGY_P2C, func() LoadBalancer { return NewP2CLoadBalancer() })
+}
+
+// P2CLoadBalancer picks two targets at random and keeps the one of the
+// lower cost, its average latency times its round trips in flight plus
+// one, for its weight. A slow target loses most draws but still wins
+// some, and its average fades when it is left alone, so traffic comes
+// back once it is fast again. A target of weight 0 gets none
+type P2CLoadBalancer struct {
+	Targets *upstream.TargetSet
+
+	rand *rand.Rand
+	lock sync.Mutex
+}
+
+func NewP2CLoadBalancer() *P2CLoadBalancer {
+	return &P2CLoadBalancer{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p2c *P2CLoadBalancer) Seed(targets *upstream.TargetSet) {
+	p2c.lock.Lock()
+	defer p2c.lock.Unlock()
+	p2c.Targets = targets
+}
+
+func (p2c *P2CLoadBalancer) Next(req *Request) *upstream.Target {
+	p2c.lock.Lock()
+	defer p2c.lock.Unlock()
+
+	weighted := make([]*upstream.Target, 0)
+	for _, target := range p2c.Targets.Targets() {
+		if target.Weight > 0 {
+			weighted = append(weighted, target)
+		}
+	}
+
+	switch len(weighted) {
+	case 0:
+		return nil
+	case 1:
+		return weighted[0]
+	}
+
+	i := p2c.rand.Intn(len(weighted))
+	j := p2c.rand.Intn(len(weighted) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := weighted[i], weighted[j]
+	if cost(b) < cost(a) {
+		return b
+	}
+	return a
+}
+
+// cost of a new request to t, an unknown latency counting as 1ns so that
+// the round trips in flight still tell targets apart
+func cost(t *upstream.Target) float64 {
+	latency := LatencyOf(t)
+	return float64(latency.Average+1) * float64(latency.InFlight+1) / float64(t.Weight)
+}
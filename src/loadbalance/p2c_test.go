@@ -0,0 +1,118 @@
+package loadbalance
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withClock replaces now with a clock moved by the test
+func withClock(t *testing.T) *time.Time {
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+	return &clock
+}
+
+func observe(clock *time.Time, target *upstream.Target, latency time.Duration, failed bool) {
+	done := ObserveRoundTrip(target)
+	*clock = clock.Add(latency)
+	done(failed)
+}
+
+func TestObserveRoundTrip(t *testing.T) {
+	clock := withClock(t)
+	target := testTarget("latency", "1", 1)
+
+	done := ObserveRoundTrip(target)
+	assert.Equal(t, LatencyOf(target).InFlight, int64(1))
+	*clock = clock.Add(time.Millisecond * 100)
+	done(false)
+	done(false)
+	assert.Equal(t, LatencyOf(target), TargetLatency{Average: time.Millisecond * 100, observedAt: *clock})
+
+	// a sample LATENCY_DECAY later weighs 1 - 1/e
+	*clock = clock.Add(LATENCY_DECAY)
+	observe(clock, target, 0, false)
+	assert.InDelta(t, float64(LatencyOf(target).Average), float64(time.Millisecond*100)*0.3679, float64(time.Millisecond))
+
+	// left alone, the average fades
+	*clock = clock.Add(LATENCY_DECAY * 5)
+	assert.True(t, LatencyOf(target).Average < time.Millisecond)
+}
+
+func TestP2CAvoidsSlowTarget(t *testing.T) {
+	clock := withClock(t)
+	slow, fast1, fast2 := testTarget("p2c", "1", 1), testTarget("p2c", "2", 1), testTarget("p2c", "3", 1)
+	p2c := NewP2CLoadBalancer()
+	p2c.rand = rand.New(rand.NewSource(1))
+	p2c.Seed(upstream.NewTargetSet([]*upstream.Target{slow, fast1, fast2}))
+
+	latencies := map[*upstream.Target]time.Duration{slow: time.Millisecond * 200, fast1: time.Millisecond * 5, fast2: time.Millisecond * 5}
+	counts := make(map[*upstream.Target]int)
+	serve := func(n int) {
+		for i := 0; i < n; i++ {
+			target := p2c.Next(nil)
+			counts[target]++
+			observe(clock, target, latencies[target], false)
+		}
+	}
+
+	serve(300)
+	assert.True(t, counts[slow] < 10, "%d to the slow target", counts[slow])
+
+	// the slow target is still tried now and then, and wins traffic back
+	// once it is faster than the others
+	latencies[slow] = time.Millisecond * 2
+	for target := range counts {
+		counts[target] = 0
+	}
+	for i := 0; i < 60; i++ {
+		*clock = clock.Add(time.Second)
+		serve(10)
+	}
+	assert.True(t, counts[slow] > 100, "%d to the slow target", counts[slow])
+}
+
+func TestP2CInFlight(t *testing.T) {
+	withClock(t)
+	busy, idle := testTarget("inflight", "1", 1), testTarget("inflight", "2", 1)
+	p2c := NewP2CLoadBalancer()
+	p2c.Seed(upstream.NewTargetSet([]*upstream.Target{busy, idle, testTarget("inflight", "3", 1)}))
+
+	defer ObserveRoundTrip(busy)(false)
+	for i := 0; i < 20; i++ {
+		assert.NotEqual(t, p2c.Next(nil), busy)
+	}
+
+	p2c.Seed(upstream.NewTargetSet([]*upstream.Target{idle, {ServiceName: "inflight", ServiceAddress: "10.0.0.1", ServicePort: "4"}}))
+	assert.Equal(t, p2c.Next(nil), idle)
+	p2c.Seed(upstream.NewTargetSet(nil))
+	assert.Nil(t, p2c.Next(nil))
+}
+
+func TestP2CAvoidsFailingTarget(t *testing.T) {
+	clock := withClock(t)
+	failing, ok1, ok2 := testTarget("failing", "1", 1), testTarget("failing", "2", 1), testTarget("failing", "3", 1)
+	p2c := NewP2CLoadBalancer()
+	p2c.rand = rand.New(rand.NewSource(1))
+	p2c.Seed(upstream.NewTargetSet([]*upstream.Target{failing, ok1, ok2}))
+
+	// refused in 1ms, it is no faster than the targets answering in 20ms
+	counts := make(map[*upstream.Target]int)
+	for i := 0; i < 300; i++ {
+		target := p2c.Next(nil)
+		counts[target]++
+		if target == failing {
+			observe(clock, target, time.Millisecond, true)
+		} else {
+			observe(clock, target, time.Millisecond*20, false)
+		}
+	}
+	assert.True(t, counts[failing] < 10, "%d to the failing target", counts[failing])
+	assert.True(t, LatencyOf(failing).Average >= LATENCY_FAILURE_PENALTY/2)
+}
@@ -5,30 +5,47 @@ import (
 	"sync"
 )
 
-type LoadBalancer interface {
-	Next() *upstream.Target
-	Seed(upstream *upstream.Upstream)
+const STRATEGY_ROUND_ROBIN = "rr"
+
+func init() {
+	Register(STRATEGY_ROUND_ROBIN, func() LoadBalancer { return NewRoundRobinLoadBalancer() })
 }
 
 type RoundRobinLoadBalancer struct {
-	Upstream  *upstream.Upstream
+	Targets   *upstream.TargetSet
 	NextIndex int
-	SeedLock  sync.Mutex
+	lock      sync.Mutex
 }
 
 func NewRoundRobinLoadBalancer() *RoundRobinLoadBalancer {
 	return &RoundRobinLoadBalancer{}
 }
 
-func (rr *RoundRobinLoadBalancer) Seed(upstream *upstream.Upstream) {
-	rr.SeedLock.Lock()
-	defer rr.SeedLock.Unlock()
-	rr.Upstream = upstream
+func (rr *RoundRobinLoadBalancer) Seed(targets *upstream.TargetSet) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.Targets = targets
 	rr.NextIndex = 0
 }
 
-func (rr *RoundRobinLoadBalancer) Next() *upstream.Target {
-	current := rr.Upstream.Targets[rr.NextIndex]
-	rr.NextIndex = (rr.NextIndex + 1) % len(rr.Upstream.Targets)
-	return current
+func (rr *RoundRobinLoadBalancer) Next(req *Request) *upstream.Target {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	// the set may have shrunk since the last call
+	targets := rr.Targets.Targets()
+	if len(targets) == 0 {
+		return nil
+	}
+
+	// a target of weight 0 stays registered but gets no new request
+	start := rr.NextIndex % len(targets)
+	for i := range targets {
+		current := targets[(start+i)%len(targets)]
+		if current.Weight > 0 {
+			rr.NextIndex = (start + i + 1) % len(targets)
+			return current
+		}
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package loadbalance
 import (
 	"github.com/Dataman-Cloud/janitor/src/upstream"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
@@ -13,18 +14,72 @@ func TestNewRoundRobinLoadBalancer(t *testing.T) {
 
 func TestSeed(t *testing.T) {
 	rr := NewRoundRobinLoadBalancer()
-	u := &upstream.Upstream{}
-	rr.Seed(u)
+	targets := upstream.NewTargetSet(nil)
+	rr.Seed(targets)
 
-	assert.Equal(t, rr.Upstream, u)
+	assert.Equal(t, rr.Targets, targets)
 	assert.Equal(t, rr.NextIndex, 0)
 }
 
 func TestNext(t *testing.T) {
 	rr := NewRoundRobinLoadBalancer()
 	u := &upstream.Upstream{Targets: make([]*upstream.Target, 0)}
-	u.Targets = append(u.Targets, &upstream.Target{})
-	rr.Seed(u)
+	u.Targets = append(u.Targets, &upstream.Target{Weight: 1})
+	rr.Seed(upstream.NewTargetSet(u.Targets))
 
-	assert.Equal(t, rr.Next(), u.Targets[0])
+	assert.Equal(t, rr.Next(nil), u.Targets[0])
+}
+
+func TestNextAfterSwap(t *testing.T) {
+	rr := NewRoundRobinLoadBalancer()
+	first, second, third := &upstream.Target{ServicePort: "1", Weight: 1}, &upstream.Target{ServicePort: "2", Weight: 1}, &upstream.Target{ServicePort: "3", Weight: 1}
+	targets := upstream.NewTargetSet([]*upstream.Target{first, second, third})
+	rr.Seed(targets)
+	rr.Next(nil)
+	rr.Next(nil)
+
+	targets.Swap([]*upstream.Target{first})
+	assert.Equal(t, rr.Next(nil), first)
+
+	targets.Swap(nil)
+	assert.Nil(t, rr.Next(nil))
+}
+
+func TestNextConcurrently(t *testing.T) {
+	rr := NewRoundRobinLoadBalancer()
+	first, second := &upstream.Target{ServicePort: "1", Weight: 1}, &upstream.Target{ServicePort: "2", Weight: 1}
+	rr.Seed(upstream.NewTargetSet([]*upstream.Target{first, second}))
+
+	var wg sync.WaitGroup
+	picks := make(chan *upstream.Target, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			picks <- rr.Next(nil)
+		}()
+	}
+	wg.Wait()
+	close(picks)
+
+	counts := make(map[*upstream.Target]int)
+	for target := range picks {
+		counts[target]++
+	}
+	assert.Equal(t, counts[first], 50)
+	assert.Equal(t, counts[second], 50)
+}
+
+func TestNextSkipsZeroWeight(t *testing.T) {
+	rr := NewRoundRobinLoadBalancer()
+	first, second, third := &upstream.Target{ServicePort: "1", Weight: 1}, &upstream.Target{ServicePort: "2"}, &upstream.Target{ServicePort: "3", Weight: 1}
+	targets := upstream.NewTargetSet([]*upstream.Target{first, second, third})
+	rr.Seed(targets)
+
+	assert.Equal(t, rr.Next(nil), first)
+	assert.Equal(t, rr.Next(nil), third)
+	assert.Equal(t, rr.Next(nil), first)
+
+	targets.Swap([]*upstream.Target{second})
+	assert.Nil(t, rr.Next(nil))
 }
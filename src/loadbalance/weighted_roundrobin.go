@@ -0,0 +1,80 @@
+package loadbalance
+
+import (
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+)
+
+const STRATEGY_WEIGHTED_ROUND_ROBIN = "wrr"
+
+func init() {
+	Register(STRATEGY_WEIGHTED_ROUND_ROBIN, func() LoadBalancer { return NewWeightedRoundRobinLoadBalancer() })
+}
+
+// WeightedRoundRobinLoadBalancer is the smooth weighted round robin of
+// nginx: every pick raises the current weight of each target by its
+// weight, picks the highest and lowers it by the total. Picks of a target
+// are spread over the round instead of coming in a burst, and a target
+// of weight 0 gets none
+type WeightedRoundRobinLoadBalancer struct {
+	Targets *upstream.TargetSet
+
+	current map[string]int // target addr -> current weight
+	lock    sync.Mutex
+}
+
+func NewWeightedRoundRobinLoadBalancer() *WeightedRoundRobinLoadBalancer {
+	return &WeightedRoundRobinLoadBalancer{current: make(map[string]int)}
+}
+
+func (wrr *WeightedRoundRobinLoadBalancer) Seed(targets *upstream.TargetSet) {
+	wrr.lock.Lock()
+	defer wrr.lock.Unlock()
+	wrr.Targets = targets
+	wrr.current = make(map[string]int)
+}
+
+func (wrr *WeightedRoundRobinLoadBalancer) Next(req *Request) *upstream.Target {
+	wrr.lock.Lock()
+	defer wrr.lock.Unlock()
+
+	targets := wrr.Targets.Targets()
+	var best *upstream.Target
+	total := 0
+	for _, target := range targets {
+		addr := target.Addr()
+		if target.Weight <= 0 {
+			// starts over once weighted again
+			delete(wrr.current, addr)
+			continue
+		}
+		wrr.current[addr] += target.Weight
+		total += target.Weight
+		if best == nil || wrr.current[addr] > wrr.current[best.Addr()] {
+			best = target
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	wrr.current[best.Addr()] -= total
+
+	if len(wrr.current) > len(targets) {
+		wrr.forget(targets)
+	}
+	return best
+}
+
+// forget drops the current weight of the targets which left the set
+func (wrr *WeightedRoundRobinLoadBalancer) forget(targets []*upstream.Target) {
+	addrs := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		addrs[target.Addr()] = true
+	}
+	for addr := range wrr.current {
+		if !addrs[addr] {
+			delete(wrr.current, addr)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+	a, b, c := testTarget("", "1", 5), testTarget("", "2", 1), testTarget("", "3", 1)
+	wrr := NewWeightedRoundRobinLoadBalancer()
+	wrr.Seed(upstream.NewTargetSet([]*upstream.Target{a, b, c}))
+
+	picks := make([]string, 0, 7)
+	for i := 0; i < 7; i++ {
+		picks = append(picks, wrr.Next(nil).ServicePort)
+	}
+	// as nginx, a a b a c a a rather than a a a a a b c
+	assert.Equal(t, picks, []string{"1", "1", "2", "1", "3", "1", "1"})
+}
+
+func TestWeightedRoundRobinZeroWeight(t *testing.T) {
+	a, b := testTarget("", "1", 1), testTarget("", "2", 0)
+	targets := upstream.NewTargetSet([]*upstream.Target{a, b})
+	wrr := NewWeightedRoundRobinLoadBalancer()
+	wrr.Seed(targets)
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, wrr.Next(nil), a)
+	}
+
+	targets.Swap([]*upstream.Target{testTarget("", "1", 0), b})
+	assert.Nil(t, wrr.Next(nil))
+
+	// a target added later takes its share right away
+	d := testTarget("", "4", 1)
+	targets.Swap([]*upstream.Target{a, d})
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[wrr.Next(nil).ServicePort]++
+	}
+	assert.Equal(t, counts["1"], 5)
+	assert.Equal(t, counts["4"], 5)
+}
@@ -3,8 +3,10 @@ package service
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Dataman-Cloud/janitor/src/handler"
 	"github.com/Dataman-Cloud/janitor/src/listener"
@@ -18,10 +20,17 @@ import (
 const (
 	SERVICE_ACTIVITIES_PREFIX = "SA"
 	SERVICE_ENTRIES_PREFIX    = "SE"
+
+	// interval between two binds of the new frontend of a pod which failed
+	// to move there
+	MOVE_RETRY_INTERVAL = time.Second * 10
 )
 
 type ServiceManager struct {
 	servicePods map[upstream.UpstreamKey]*ServicePod
+	// new frontend -> move of a pod still serving its former one
+	pendingMoves      map[upstream.UpstreamKey]*pendingMove
+	moveRetryInterval time.Duration
 
 	handlerFactory  *handler.Factory
 	listenerManager *listener.Manager
@@ -29,9 +38,19 @@ type ServiceManager struct {
 	consulClient    *consulApi.Client
 	ctx             context.Context
 	forkMutex       sync.Mutex
+	moveMutex       sync.Mutex
 	rwMutex         sync.RWMutex
 }
 
+// pendingMove is a pod which failed to bind the new frontend of its
+// service, it keeps serving previous, with the targets of latest, until
+// the bind is retried successfully
+type pendingMove struct {
+	previous *upstream.Upstream
+	latest   *upstream.Upstream
+	retry    *time.Timer
+}
+
 func NewServiceManager(ctx context.Context) *ServiceManager {
 	serviceManager := &ServiceManager{}
 
@@ -41,10 +60,15 @@ func NewServiceManager(ctx context.Context) *ServiceManager {
 	listenerManager_ := ctx.Value(listener.LISTENER_MANAGER_KEY)
 	serviceManager.listenerManager = listenerManager_.(*listener.Manager)
 
-	serviceManager.upstreamLoader = ctx.Value(upstream.CONSUL_UPSTREAM_LOADER_KEY).(*upstream.ConsulUpstreamLoader)
-	serviceManager.consulClient = serviceManager.upstreamLoader.(*upstream.ConsulUpstreamLoader).ConsulClient
+	serviceManager.upstreamLoader, _ = ctx.Value(upstream.CONSUL_UPSTREAM_LOADER_KEY).(upstream.UpstreamLoader)
+	// without consul, pods keep no session, entries nor activities there
+	if consulUpstreamLoader := upstream.FindConsulUpstreamLoader(serviceManager.upstreamLoader); consulUpstreamLoader != nil {
+		serviceManager.consulClient = consulUpstreamLoader.ConsulClient
+	}
 
 	serviceManager.servicePods = make(map[upstream.UpstreamKey]*ServicePod)
+	serviceManager.pendingMoves = make(map[upstream.UpstreamKey]*pendingMove)
+	serviceManager.moveRetryInterval = MOVE_RETRY_INTERVAL
 	serviceManager.ctx = ctx
 
 	return serviceManager
@@ -54,7 +78,9 @@ func (manager *ServiceManager) ForkOrFetchNewServicePod(upstream *upstream.Upstr
 	manager.forkMutex.Lock()
 	defer manager.forkMutex.Unlock()
 
+	manager.rwMutex.RLock()
 	pod, found := manager.servicePods[upstream.Key()]
+	manager.rwMutex.RUnlock()
 	if found {
 		return pod, nil
 	}
@@ -64,38 +90,296 @@ func (manager *ServiceManager) ForkOrFetchNewServicePod(upstream *upstream.Upstr
 		return nil, err
 	}
 
-	// fetch a listener then assign it to pod
-	pod.Listener, err = manager.listenerManager.FetchListener(upstream.Key())
-	if err != nil {
+	if err := manager.attach(pod, upstream); err != nil {
 		pod.LogActivity(fmt.Sprintf("[ERRO] fetch a listener error: %s", err.Error()))
 		return nil, err
 	}
 
-	// fetch a http handler then assign it to pod
-	pod.HttpServer = &http.Server{Handler: manager.handlerFactory.HttpHandler(upstream)}
-
+	manager.rwMutex.Lock()
 	manager.servicePods[upstream.Key()] = pod
+	manager.rwMutex.Unlock()
 	return pod, nil
 }
 
+// attach fetches the listener of the frontend of u and the http handler
+// serving it for pod
+func (manager *ServiceManager) attach(pod *ServicePod, u *upstream.Upstream) error {
+	var err error
+	pod.Listener, err = manager.listenerManager.FetchListener(u.Key())
+	if err != nil {
+		return err
+	}
+
+	pod.handler, pod.handlerUpstream = manager.handlerFactory.HttpHandler(u, pod.Targets), u
+	pod.HttpServer = &http.Server{Handler: pod.Tracker.Handler(pod)}
+	return nil
+}
+
+// HandleEvent applies a change of an upstream to its service pod
+func (manager *ServiceManager) HandleEvent(event upstream.UpstreamEvent) {
+	switch event.Type {
+	case upstream.EVENT_UPSTREAM_ADDED:
+		log.Infof("create new service pod: %s", event.Upstream.Key())
+		manager.startServicePod(event.Upstream)
+
+	case upstream.EVENT_TARGETS_CHANGED:
+		log.Infof("update existing service pod: %s", event.Upstream.Key())
+		pod, found := manager.podOf(event.Upstream)
+		if !found {
+			log.Errorf("failed to found pod %s", event.Upstream.Key().ToString())
+			return
+		}
+		pod.Invalid(event.Upstream, event.AddedTargets, event.RemovedTargets)
+
+	case upstream.EVENT_FRONTEND_CHANGED:
+		log.Infof("move service pod %s to %s", event.Previous.Key(), event.Upstream.Key())
+		manager.MoveServicePod(event.Previous, event.Upstream)
+
+	case upstream.EVENT_UPSTREAM_REMOVED:
+		log.Infof("remove unused service pod: %s", event.Upstream.Key())
+		manager.KillServicePod(event.Upstream)
+
+	case upstream.EVENT_FRONTEND_CONFLICT:
+		conflict := event.Conflict
+		for _, serviceName := range conflict.Refused {
+			if conflict.Reason != "" {
+				manager.LogActivity(serviceName, fmt.Sprintf("[WARN] application %s is not served at %s, %s (%s)", serviceName, conflict.Key.ToString(), conflict.Reason, conflict.Policy))
+			} else if conflict.Served == "" {
+				manager.LogActivity(serviceName, fmt.Sprintf("[WARN] application %s is not served, %s is also claimed by %s (%s)", serviceName, conflict.Key.ToString(), strings.Join(others(conflict.Refused, serviceName), ", "), conflict.Policy))
+			} else {
+				manager.LogActivity(serviceName, fmt.Sprintf("[WARN] application %s is not served, %s is given to %s (%s)", serviceName, conflict.Key.ToString(), conflict.Served, conflict.Policy))
+			}
+		}
+	}
+}
+
+func others(serviceNames []string, serviceName string) []string {
+	names := make([]string, 0, len(serviceNames))
+	for _, name := range serviceNames {
+		if name != serviceName {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (manager *ServiceManager) startServicePod(u *upstream.Upstream) {
+	pod, err := manager.ForkOrFetchNewServicePod(u)
+	if err != nil {
+		log.Infof("fail to create a service pod: %s", err.Error())
+		return
+	}
+	pod.Run()
+}
+
+// podOf returns the pod serving u, the one still at the former frontend
+// of the service when it failed to move to the frontend of u
+func (manager *ServiceManager) podOf(u *upstream.Upstream) (*ServicePod, bool) {
+	manager.moveMutex.Lock()
+	key := u.Key()
+	if move, found := manager.pendingMoves[key]; found {
+		move.latest = u
+		key = move.previous.Key()
+	}
+	manager.moveMutex.Unlock()
+
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+	pod, found := manager.servicePods[key]
+	return pod, found
+}
+
+// MoveServicePod serves latest in place of previous, the same service at
+// another frontend or with other routes or settings. A new frontend is
+// bound before the pod of the former one is drained, the former pod keeps
+// serving when it can not be bound, and the bind is retried every
+// MOVE_RETRY_INTERVAL
+func (manager *ServiceManager) MoveServicePod(previous, latest *upstream.Upstream) {
+	manager.moveMutex.Lock()
+	defer manager.moveMutex.Unlock()
+
+	// previous may be a frontend the pod failed to move to
+	if move, found := manager.pendingMoves[previous.Key()]; found {
+		move.retry.Stop()
+		delete(manager.pendingMoves, previous.Key())
+		previous = move.previous
+	}
+	manager.move(previous, latest)
+}
+
+// retryMove binds again the frontend a pod failed to move to
+func (manager *ServiceManager) retryMove(key upstream.UpstreamKey) {
+	manager.moveMutex.Lock()
+	defer manager.moveMutex.Unlock()
+
+	if move, found := manager.pendingMoves[key]; found {
+		manager.move(move.previous, move.latest)
+	}
+}
+
+func (manager *ServiceManager) move(previous, latest *upstream.Upstream) {
+	manager.rwMutex.RLock()
+	pod, found := manager.servicePods[previous.Key()]
+	manager.rwMutex.RUnlock()
+	if !found {
+		delete(manager.pendingMoves, latest.Key())
+		manager.startServicePod(latest)
+		return
+	}
+
+	if previous.Key() == latest.Key() {
+		pod.Reconfigure(latest, manager.handlerFactory.HttpHandler(latest, pod.Targets))
+		return
+	}
+
+	next, err := manager.forkMovedServicePod(latest)
+	if err != nil {
+		move, retrying := manager.pendingMoves[latest.Key()]
+		if !retrying {
+			log.Errorf("fail to move service pod %s to %s: %s", previous.Key(), latest.Key(), err)
+			pod.LogActivity(fmt.Sprintf("[ERRO] move application %s from %s to %s failed, still serving at %s: %s", latest.ServiceName, previous.Key().ToString(), latest.Key().ToString(), previous.Key().ToString(), err))
+			pod.logProblems(latest)
+			move = &pendingMove{previous: previous, latest: latest}
+			manager.pendingMoves[latest.Key()] = move
+		} else {
+			log.Debugf("fail to move service pod %s to %s again: %s", previous.Key(), latest.Key(), err)
+			if move.latest != latest {
+				pod.logProblems(latest)
+			}
+			move.retry.Stop()
+			move.latest = latest
+		}
+		pod.SwapTargets(latest)
+		key := latest.Key()
+		move.retry = time.AfterFunc(manager.moveRetryInterval, func() { manager.retryMove(key) })
+		return
+	}
+	delete(manager.pendingMoves, latest.Key())
+	next.Run()
+
+	manager.rwMutex.Lock()
+	delete(manager.servicePods, previous.Key())
+	manager.listenerManager.Remove(previous.Key())
+	manager.rwMutex.Unlock()
+
+	go pod.MoveTo(next, manager.handlerFactory.ProxyConfig().ShutdownWait)
+}
+
+// forkMovedServicePod is ForkOrFetchNewServicePod for a pod moving to the
+// frontend of u, which must be free, its activities are left to MoveTo
+func (manager *ServiceManager) forkMovedServicePod(u *upstream.Upstream) (*ServicePod, error) {
+	manager.forkMutex.Lock()
+	defer manager.forkMutex.Unlock()
+
+	manager.rwMutex.RLock()
+	_, found := manager.servicePods[u.Key()]
+	manager.rwMutex.RUnlock()
+	if found {
+		return nil, fmt.Errorf("%s is served by another pod", u.Key().ToString())
+	}
+
+	pod, err := newServicePod(u, manager)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.attach(pod, u); err != nil {
+		pod.releaseSession()
+		return nil, err
+	}
+
+	manager.rwMutex.Lock()
+	manager.servicePods[u.Key()] = pod
+	manager.rwMutex.Unlock()
+	return pod, nil
+}
+
+// KillServicePod stops accepting on the pod listener right away, then
+// drains the pod in background up to the proxy shutdown wait
 func (manager *ServiceManager) KillServicePod(u *upstream.Upstream) error {
+	key := u.Key()
+	manager.moveMutex.Lock()
+	if move, found := manager.pendingMoves[key]; found {
+		move.retry.Stop()
+		delete(manager.pendingMoves, key)
+		key = move.previous.Key()
+	}
+	manager.moveMutex.Unlock()
+
 	manager.rwMutex.Lock()
-	defer manager.rwMutex.Unlock()
+	pod, found := manager.servicePods[key]
+	if found {
+		delete(manager.servicePods, key)
+		manager.listenerManager.Remove(key)
+	}
+	manager.rwMutex.Unlock()
 
-	pod, found := manager.servicePods[u.Key()]
 	if found {
-		pod.Dispose()
-		delete(manager.servicePods, u.Key())
-		manager.upstreamLoader.Remove(u)
-		manager.listenerManager.Remove(u.Key())
+		go pod.Dispose(manager.handlerFactory.ProxyConfig().ShutdownWait)
 	}
 	return nil
 }
 
+// ReloadHandlers builds the handler of every pod again, with the load
+// balancing strategy of the proxy settings reloaded. Requests in flight
+// finish on the former handlers
+func (manager *ServiceManager) ReloadHandlers() {
+	for _, pod := range manager.Pods() {
+		pod.ReloadHandler(manager.handlerFactory)
+	}
+}
+
+// Shutdown stops accepting on every pod listener, then drains all the
+// pods at once and waits for them
+func (manager *ServiceManager) Shutdown() {
+	manager.disposeAll(func(pod *ServicePod, shutdownWait time.Duration) {
+		pod.Dispose(shutdownWait)
+	})
+}
+
+// Handover is Shutdown for a process whose listeners were handed to a
+// new one, the pod entries are left in place for it
+func (manager *ServiceManager) Handover() {
+	manager.disposeAll(func(pod *ServicePod, shutdownWait time.Duration) {
+		pod.Handover(shutdownWait)
+	})
+}
+
+func (manager *ServiceManager) disposeAll(dispose func(pod *ServicePod, shutdownWait time.Duration)) {
+	manager.moveMutex.Lock()
+	for _, move := range manager.pendingMoves {
+		move.retry.Stop()
+	}
+	manager.pendingMoves = make(map[upstream.UpstreamKey]*pendingMove)
+	manager.moveMutex.Unlock()
+
+	manager.rwMutex.Lock()
+	pods := make([]*ServicePod, 0, len(manager.servicePods))
+	for key, pod := range manager.servicePods {
+		pods = append(pods, pod)
+		manager.listenerManager.Remove(key)
+	}
+	manager.servicePods = make(map[upstream.UpstreamKey]*ServicePod)
+	manager.rwMutex.Unlock()
+
+	shutdownWait := manager.handlerFactory.ProxyConfig().ShutdownWait
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod *ServicePod) {
+			defer wg.Done()
+			dispose(pod, shutdownWait)
+		}(pod)
+	}
+	wg.Wait()
+}
+
 // error condition not considered
 func (manager *ServiceManager) ClusterAddressList(prefix string) ([]string, error) {
 	// use consulClient For short, UGLY
 	serviceEntriesWithPrefix := make([]string, 0)
+	if manager.consulClient == nil {
+		return serviceEntriesWithPrefix, nil
+	}
 	kv := manager.consulClient.KV()
 	trimedPrefix := strings.TrimLeft(prefix, "/")
 	kvPairs, _, err := kv.List(fmt.Sprintf("%s/%s", SERVICE_ENTRIES_PREFIX, trimedPrefix), nil)
@@ -111,7 +395,29 @@ func (manager *ServiceManager) ClusterAddressList(prefix string) ([]string, erro
 	return serviceEntriesWithPrefix, nil
 }
 
+// Pods lists the running service pods ordered by their key
+func (manager *ServiceManager) Pods() []*ServicePod {
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+
+	pods := make([]*ServicePod, 0, len(manager.servicePods))
+	for _, pod := range manager.servicePods {
+		pods = append(pods, pod)
+	}
+	sort.Sort(podsByKey(pods))
+	return pods
+}
+
+type podsByKey []*ServicePod
+
+func (p podsByKey) Len() int           { return len(p) }
+func (p podsByKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p podsByKey) Less(i, j int) bool { return p[i].Key.ToString() < p[j].Key.ToString() }
+
 func (manager *ServiceManager) PortsOccupied() []string {
+	manager.rwMutex.RLock()
+	defer manager.rwMutex.RUnlock()
+
 	ports := make([]string, 0)
 	for key, _ := range manager.servicePods {
 		ports = append(ports, key.Port)
@@ -119,8 +425,67 @@ func (manager *ServiceManager) PortsOccupied() []string {
 	return ports
 }
 
+// LogActivity appends an activity to the history of an application, held
+// by the session of its pod when it is served
+func (manager *ServiceManager) LogActivity(serviceName, activity string) {
+	for _, pod := range manager.Pods() {
+		if pod.ServiceName == serviceName {
+			pod.LogActivity(activity)
+			return
+		}
+	}
+	go manager.appendActivity(serviceName, activity, "", false)
+}
+
+// appendActivity appends an activity to the history of an application,
+// acquiring or releasing its key for session, or putting it without one
+func (manager *ServiceManager) appendActivity(serviceName, activity, session string, release bool) {
+	if manager.consulClient == nil {
+		log.Info(activity)
+		return
+	}
+
+	kv := manager.consulClient.KV()
+	kvPair, _, err := kv.Get(fmt.Sprintf("%s/%s", SERVICE_ACTIVITIES_PREFIX, serviceName), nil)
+	if err != nil {
+		log.Errorf("kv get error %s", err)
+	}
+
+	var existingValue string
+	if kvPair == nil {
+		existingValue = ""
+	} else {
+		existingValue = string(kvPair.Value)
+		if len(existingValue) > 100000 {
+			existingValues := strings.Split(string(existingValue), "--")
+			existingValuesLen := len(existingValues)
+			existingValue = strings.Join(existingValues[existingValuesLen-20:existingValuesLen], "--")
+		}
+	}
+
+	log.Debug(existingValue)
+	p := &consulApi.KVPair{Key: fmt.Sprintf("%s/%s", SERVICE_ACTIVITIES_PREFIX, serviceName),
+		Value:   []byte(fmt.Sprintf("%s--%s", existingValue, activity)),
+		Session: session,
+	}
+	switch {
+	case session == "":
+		_, err = kv.Put(p, nil)
+	case release:
+		_, _, err = kv.Release(p, nil)
+	default:
+		_, _, err = kv.Acquire(p, nil)
+	}
+	if err != nil {
+		log.Errorf("persist service entries error %s", err)
+	}
+}
+
 // list activities for a pod
 func (manager *ServiceManager) ServiceActvities(serviceName string) ([]string, error) {
+	if manager.consulClient == nil {
+		return []string{}, nil
+	}
 	kv := manager.consulClient.KV()
 
 	kvPair, _, err := kv.Get(fmt.Sprintf("%s/%s", SERVICE_ACTIVITIES_PREFIX, serviceName), nil)
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+	"github.com/Dataman-Cloud/janitor/src/handler"
+	"github.com/Dataman-Cloud/janitor/src/listener"
+	"github.com/Dataman-Cloud/janitor/src/loadbalance"
+	"github.com/Dataman-Cloud/janitor/src/upstream"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newTestServiceManager(t *testing.T) *ServiceManager {
+	cfg := config.DefaultConfig()
+	cfg.Proxy.ShutdownWait = time.Millisecond * 100
+	listenerManager, err := listener.InitManager(listener.MULTIPORT_LISTENER_MODE, cfg.Listener)
+	assert.Nil(t, err)
+
+	ctx := context.WithValue(context.Background(), listener.LISTENER_MANAGER_KEY, listenerManager)
+	ctx = context.WithValue(ctx, handler.HANDLER_FACTORY_KEY, handler.NewFactory(cfg.HttpHandler, cfg.Listener, cfg.Proxy))
+	manager := NewServiceManager(ctx)
+	t.Cleanup(manager.Shutdown)
+	return manager
+}
+
+func testFreePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func testServiceUpstream(t *testing.T, port string, backend *httptest.Server) *upstream.Upstream {
+	u := &upstream.Upstream{ServiceName: "web", FrontendProto: "http", FrontendIp: "127.0.0.1", FrontendPort: port}
+	addr, _ := url.Parse(backend.URL)
+	host, servicePort, _ := net.SplitHostPort(addr.Host)
+	u.Targets = []*upstream.Target{{ServiceName: "web", ServiceAddress: host, ServicePort: servicePort, Weight: upstream.DEFAULT_WEIGHT, Upstream: u}}
+	return u
+}
+
+func testGet(port string) (string, error) {
+	resp, err := http.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestMoveServicePod(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer backend.Close()
+
+	manager := newTestServiceManager(t)
+	previous := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: previous})
+	body, err := testGet(previous.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "web")
+
+	latest := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_FRONTEND_CHANGED, Upstream: latest, Previous: previous})
+	body, err = testGet(latest.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "web")
+	_, err = testGet(previous.FrontendPort)
+	assert.NotNil(t, err)
+	assert.Equal(t, len(manager.Pods()), 1)
+	assert.Equal(t, manager.Pods()[0].Key, latest.Key())
+}
+
+func TestMoveServicePodToBoundPort(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer backend.Close()
+	moved := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("moved"))
+	}))
+	defer moved.Close()
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer bound.Close()
+
+	manager := newTestServiceManager(t)
+	previous := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: previous})
+
+	// the new port can not be bound, the pod keeps serving the former one
+	// with the new targets
+	latest := testServiceUpstream(t, strconv.Itoa(bound.Addr().(*net.TCPAddr).Port), moved)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_FRONTEND_CHANGED, Upstream: latest, Previous: previous})
+	body, err := testGet(previous.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "moved")
+	assert.Equal(t, manager.Pods()[0].Key, previous.Key())
+}
+
+func TestReconfigureServicePod(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Env")))
+	}))
+	defer backend.Close()
+
+	manager := newTestServiceManager(t)
+	previous := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: previous})
+
+	// same frontend, the handler is swapped on the listener in place
+	latest := testServiceUpstream(t, previous.FrontendPort, backend)
+	latest.Settings.RequestHeaders = map[string]string{"X-Env": "prod"}
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_FRONTEND_CHANGED, Upstream: latest, Previous: previous})
+	body, err := testGet(latest.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "prod")
+}
+
+func TestMoveServicePodFailedThenChanged(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer backend.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer bound.Close()
+
+	manager := newTestServiceManager(t)
+	previous := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: previous})
+	latest := testServiceUpstream(t, strconv.Itoa(bound.Addr().(*net.TCPAddr).Port), api)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_FRONTEND_CHANGED, Upstream: latest, Previous: previous})
+
+	// the targets of the new frontend are served at the former one
+	body, err := testGet(previous.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "api")
+
+	// and follow its targets changing
+	changed := testServiceUpstream(t, latest.FrontendPort, backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_TARGETS_CHANGED, Upstream: changed})
+	body, err = testGet(previous.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "web")
+
+	// and removing the service removes the pod left there
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_REMOVED, Upstream: changed})
+	assert.Equal(t, len(manager.Pods()), 0)
+	_, err = testGet(previous.FrontendPort)
+	assert.NotNil(t, err)
+}
+
+func TestMoveServicePodRetried(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer backend.Close()
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	manager := newTestServiceManager(t)
+	manager.moveRetryInterval = time.Millisecond * 50
+	previous := testServiceUpstream(t, testFreePort(t), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: previous})
+	latest := testServiceUpstream(t, strconv.Itoa(bound.Addr().(*net.TCPAddr).Port), backend)
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_FRONTEND_CHANGED, Upstream: latest, Previous: previous})
+	assert.Equal(t, manager.Pods()[0].Key, previous.Key())
+
+	// the pod moves once the new frontend is free
+	bound.Close()
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 20) {
+		if manager.Pods()[0].Key == latest.Key() {
+			break
+		}
+	}
+	assert.Equal(t, manager.Pods()[0].Key, latest.Key())
+	body, err := testGet(latest.FrontendPort)
+	assert.Nil(t, err)
+	assert.Equal(t, body, "web")
+}
+
+func TestReloadHandlers(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) }))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b")) }))
+	defer b.Close()
+
+	manager := newTestServiceManager(t)
+	u := testServiceUpstream(t, testFreePort(t), a)
+	u.Targets = append(u.Targets, testServiceUpstream(t, u.FrontendPort, b).Targets[0])
+	u.Targets[1].Upstream = u
+	manager.HandleEvent(upstream.UpstreamEvent{Type: upstream.EVENT_UPSTREAM_ADDED, Upstream: u})
+
+	bodies := func() map[string]bool {
+		seen := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			body, err := testGet(u.FrontendPort)
+			assert.Nil(t, err)
+			seen[body] = true
+		}
+		return seen
+	}
+	assert.Equal(t, len(bodies()), 2)
+
+	// every request of the client goes to the same target once reloaded
+	cfg := config.DefaultConfig()
+	cfg.Proxy.Strategy = loadbalance.STRATEGY_CONSISTENT_HASH
+	manager.handlerFactory.Reload(cfg)
+	manager.ReloadHandlers()
+	assert.Equal(t, len(bodies()), 1)
+}
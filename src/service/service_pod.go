@@ -7,11 +7,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Dataman-Cloud/janitor/src/handler"
 	"github.com/Dataman-Cloud/janitor/src/upstream"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-proxyproto"
 	consulApi "github.com/hashicorp/consul/api"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -19,26 +21,49 @@ const (
 )
 
 type ServicePod struct {
-	Key upstream.UpstreamKey
+	Key         upstream.UpstreamKey
+	ServiceName string
+	StartedAt   time.Time
 
 	Manager    *ServiceManager
 	HttpServer *http.Server
 	Listener   *proxyproto.Listener
+	Tracker    *handler.ConnTracker
+	Targets    *upstream.TargetSet
 
 	upstream           *upstream.Upstream
+	handler            http.Handler       // proxying to Targets, swapped by Reconfigure
+	handlerUpstream    *upstream.Upstream // routes and settings handler was built for
+	handlerLock        sync.RWMutex
 	sessionIDWithTTY   string
 	sessionRenewTicker *time.Ticker
 	stopCh             chan bool
 	lock               sync.Mutex
 }
 
-func NewServicePod(upstream *upstream.Upstream, manager *ServiceManager) (*ServicePod, error) {
+func NewServicePod(u *upstream.Upstream, manager *ServiceManager) (*ServicePod, error) {
+	pod, err := newServicePod(u, manager)
+	if err != nil {
+		return nil, err
+	}
+
+	pod.LogActivity(fmt.Sprintf("[INFO] preparing serving application %s at %s", u.ServiceName, u.Key().ToString()))
+	pod.logProblems(u)
+	return pod, nil
+}
+
+// newServicePod is NewServicePod leaving the activities to the caller
+func newServicePod(u *upstream.Upstream, manager *ServiceManager) (*ServicePod, error) {
 	pod := &ServicePod{
-		Key: upstream.Key(),
+		Key:         u.Key(),
+		ServiceName: u.ServiceName,
+		StartedAt:   time.Now(),
 
 		stopCh:   make(chan bool, 1),
-		upstream: upstream,
+		upstream: u,
 		Manager:  manager,
+		Tracker:  handler.NewConnTracker(),
+		Targets:  upstream.NewTargetSet(u.Targets),
 	}
 
 	pod.sessionRenewTicker = time.NewTicker(SESSION_RENEW_INTERVAL)
@@ -48,12 +73,14 @@ func NewServicePod(upstream *upstream.Upstream, manager *ServiceManager) (*Servi
 	}
 
 	pod.keepSessionAlive()
-	pod.LogActivity(fmt.Sprintf("[INFO] preparing serving application %s at %s", upstream.ServiceName, upstream.Key().ToString()))
-
 	return pod, nil
 }
 
 func (pod *ServicePod) setupTTLSession() error {
+	if pod.Manager.consulClient == nil {
+		return nil
+	}
+
 	var err error
 	pod.sessionIDWithTTY, _, err = pod.Manager.consulClient.Session().Create(
 		&consulApi.SessionEntry{
@@ -72,7 +99,7 @@ func (pod *ServicePod) keepSessionAlive() {
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Error("KeepSessionAlive got error: %s", err)
+				log.Errorf("KeepSessionAlive got error: %s", err)
 				pod.keepSessionAlive()
 			}
 		}()
@@ -80,10 +107,16 @@ func (pod *ServicePod) keepSessionAlive() {
 		for {
 			select {
 			case <-pod.sessionRenewTicker.C:
+				if pod.Manager.consulClient == nil {
+					continue
+				}
 				_, _, err := pod.Manager.consulClient.Session().Renew(pod.sessionIDWithTTY, nil)
 				if err != nil {
 					log.Errorf("renew a session error: %s", err)
 				}
+				// acquire the entry again in case it was held by the
+				// process this one took over from
+				pod.RenewPodEntries()
 			case <-pod.stopCh:
 				log.Info("exiting KeepSessionAlive goroutine")
 				return
@@ -92,48 +125,81 @@ func (pod *ServicePod) keepSessionAlive() {
 	}()
 }
 
-func (pod *ServicePod) Invalid() {
+// Invalid swaps the targets of the pod with the ones of u, requests in
+// flight to removed targets are left to finish
+func (pod *ServicePod) Invalid(u *upstream.Upstream, added, removed []*upstream.Target) {
+	pod.lock.Lock()
+	defer pod.lock.Unlock()
+
+	pod.Targets.Swap(u.Targets)
+	pod.LogActivity(fmt.Sprintf("[INFO] changing application %s targets, added [%s] removed [%s]", u.ServiceName, targetList(added), targetList(removed)))
+	pod.logProblems(u)
+}
+
+// SwapTargets serves the targets of u, a frontend the pod failed to move
+// to, while the pod stays at its own frontend
+func (pod *ServicePod) SwapTargets(u *upstream.Upstream) {
+	pod.lock.Lock()
+	defer pod.lock.Unlock()
+	pod.Targets.Swap(u.Targets)
+}
+
+// ServeHTTP passes the requests to the handler of the pod, the one of the
+// current routes and settings of the service
+func (pod *ServicePod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pod.handlerLock.RLock()
+	handler := pod.handler
+	pod.handlerLock.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// Reconfigure serves u, of the same frontend as the pod, with handler in
+// place of the current one. Requests in flight finish on the former one
+func (pod *ServicePod) Reconfigure(u *upstream.Upstream, handler http.Handler) {
 	pod.lock.Lock()
 	defer pod.lock.Unlock()
 
-	targets := make([]string, 0)
-	for _, t := range pod.upstream.Targets {
-		targets = append(targets, t.ToString())
+	pod.Targets.Swap(u.Targets)
+	pod.handlerLock.Lock()
+	pod.handler, pod.handlerUpstream = handler, u
+	pod.handlerLock.Unlock()
+	pod.LogActivity(fmt.Sprintf("[INFO] changing application %s routes and settings at %s", u.ServiceName, u.Key().ToString()))
+	pod.logProblems(u)
+}
+
+// ReloadHandler builds the handler of the pod again, for the routes and
+// settings it serves, like when the load balancing strategy changed
+func (pod *ServicePod) ReloadHandler(factory *handler.Factory) {
+	pod.handlerLock.Lock()
+	defer pod.handlerLock.Unlock()
+	pod.handler = factory.HttpHandler(pod.handlerUpstream, pod.Targets)
+}
+
+// logProblems records the values of the description of u which were left
+// out as invalid
+func (pod *ServicePod) logProblems(u *upstream.Upstream) {
+	if len(u.Problems) > 0 {
+		pod.LogActivity(fmt.Sprintf("[WARN] application %s has invalid settings left out: %s", u.ServiceName, strings.Join(u.Problems, "; ")))
 	}
+}
 
-	pod.LogActivity(fmt.Sprintf("[INFO] changing application %s to targets [%s]", pod.upstream.ServiceName, strings.Join(targets, "  ")))
+func targetList(targets []*upstream.Target) string {
+	addrs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		addrs = append(addrs, t.Addr())
+	}
+	return strings.Join(addrs, "  ")
 }
 
 func (pod *ServicePod) LogActivity(activity string) {
-	go func() { // make this run in other thread
-		kv := pod.Manager.consulClient.KV()
-		kvPair, _, err := kv.Get(fmt.Sprintf("%s/%s", SERVICE_ACTIVITIES_PREFIX, pod.upstream.ServiceName), nil)
-		if err != nil {
-			log.Errorf("kv get error %s", err)
-		}
-
-		var existingValue string
-		if kvPair == nil {
-			existingValue = ""
-		} else {
-			existingValue = string(kvPair.Value)
-			if len(existingValue) > 100000 {
-				existingValues := strings.Split(string(existingValue), "--")
-				existingValuesLen := len(existingValues)
-				existingValue = strings.Join(existingValues[existingValuesLen-20:existingValuesLen], "--")
-			}
-		}
+	go pod.logActivity(activity, false) // make this run in other thread
+}
 
-		log.Debugf(existingValue)
-		p := &consulApi.KVPair{Key: fmt.Sprintf("%s/%s", SERVICE_ACTIVITIES_PREFIX, pod.upstream.ServiceName),
-			Value:   []byte(fmt.Sprintf("%s--%s", existingValue, activity)),
-			Session: pod.sessionIDWithTTY,
-		}
-		_, _, err = kv.Acquire(p, nil)
-		if err != nil {
-			log.Errorf("persist service entries error %s", err)
-		}
-	}()
+// logActivity appends an activity to the history of the application, the
+// key is held by the pod session, unless release is set which leaves the
+// history in place once the session is destroyed
+func (pod *ServicePod) logActivity(activity string, release bool) {
+	pod.Manager.appendActivity(pod.upstream.ServiceName, activity, pod.sessionIDWithTTY, release)
 }
 
 func (pod *ServicePod) Run() {
@@ -141,43 +207,118 @@ func (pod *ServicePod) Run() {
 	go func() {
 		log.Infof("start runing pod now %s", pod.Key)
 		err := pod.HttpServer.Serve(pod.Listener)
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Errorf("pod run goroutine error  <%s>,  the error is [%s]", pod.Key, err)
 		}
 		log.Infof("end runing pod now %s", pod.Key)
 	}()
 }
 
-func (pod *ServicePod) Dispose() {
-	log.Infof("disposing a service pod")
+// Dispose unregisters the pod entry, drains its connections and then
+// destroys the pod session
+func (pod *ServicePod) Dispose(shutdownWait time.Duration) {
+	log.Infof("disposing service pod %s", pod.Key)
+	pod.RemovePodEntry()
+	pod.Drain(shutdownWait)
+	pod.logActivity(fmt.Sprintf("[INFO] stop application %s at %s", pod.upstream.ServiceName, pod.upstream.Key().ToString()), true)
+	pod.releaseSession()
+}
+
+// MoveTo is Dispose for a pod replaced by next at another frontend, the
+// move is recorded before draining so that next may record its activities
+func (pod *ServicePod) MoveTo(next *ServicePod, shutdownWait time.Duration) {
+	log.Infof("moving service pod %s to %s", pod.Key, next.Key)
 	pod.RemovePodEntry()
-	pod.LogActivity(fmt.Sprintf("[INFO] stop application %s at %s", pod.upstream.ServiceName, pod.upstream.Key().ToString()))
+	pod.logActivity(fmt.Sprintf("[INFO] move application %s from %s to %s", pod.upstream.ServiceName, pod.Key.ToString(), next.Key.ToString()), true)
+	pod.Drain(shutdownWait)
+	pod.releaseSession()
+}
+
+// Handover drains the pod like Dispose, but releases its entry instead
+// of deleting it, as the process taking over the listener serves it now
+func (pod *ServicePod) Handover(shutdownWait time.Duration) {
+	log.Infof("handing over service pod %s", pod.Key)
+	pod.ReleasePodEntry()
+	pod.Drain(shutdownWait)
+	pod.logActivity(fmt.Sprintf("[INFO] hand over application %s at %s to a new process", pod.upstream.ServiceName, pod.upstream.Key().ToString()), true)
+	pod.releaseSession()
+}
+
+// Drain stops accepting new connections and waits up to shutdownWait for
+// the requests in flight, hijacked ones included, connections still open
+// after that are closed
+func (pod *ServicePod) Drain(shutdownWait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+	defer cancel()
+
+	pod.HttpServer.SetKeepAlivesEnabled(false)
+	// the listener might be closed by the listener manager already, so
+	// the error of shutdown is not interesting, running out of time is
+	pod.HttpServer.Shutdown(ctx)
+	pod.Tracker.Wait(ctx)
+
+	if ctx.Err() != nil {
+		log.Warnf("pod %s not drained in %s, closing %d connections left", pod.Key, shutdownWait, pod.Tracker.Inflight())
+		pod.HttpServer.Close()
+		pod.Tracker.CloseHijacked()
+	}
+}
+
+func (pod *ServicePod) releaseSession() {
 	pod.stopCh <- true
+	pod.sessionRenewTicker.Stop()
+	if pod.Manager.consulClient == nil {
+		return
+	}
+
+	_, err := pod.Manager.consulClient.Session().Destroy(pod.sessionIDWithTTY, nil)
+	if err != nil {
+		log.Errorf("destroy a session error: %s", err)
+	}
+}
+
+func (pod *ServicePod) podEntry() *consulApi.KVPair {
+	return &consulApi.KVPair{Key: fmt.Sprintf("%s/%s/%s/%s", SERVICE_ENTRIES_PREFIX, pod.upstream.ServiceName, pod.Key.Ip, pod.Key.Port),
+		Value:   []byte(fmt.Sprintf("%s://%s:%s", pod.Key.Proto, pod.Key.Ip, pod.Key.Port)),
+		Session: pod.sessionIDWithTTY,
+	}
 }
 
 func (pod *ServicePod) RenewPodEntries() {
 	// use consulClient For short, UGLY
+	if pod.Manager.consulClient == nil {
+		return
+	}
 	go func() {
 		kv := pod.Manager.consulClient.KV()
 
-		p := &consulApi.KVPair{Key: fmt.Sprintf("%s/%s/%s/%s", SERVICE_ENTRIES_PREFIX, pod.upstream.ServiceName, pod.Key.Ip, pod.Key.Port),
-			Value:   []byte(fmt.Sprintf("%s://%s:%s", pod.Key.Proto, pod.Key.Ip, pod.Key.Port)),
-			Session: pod.sessionIDWithTTY,
-		}
-		_, _, err := kv.Acquire(p, nil)
+		_, _, err := kv.Acquire(pod.podEntry(), nil)
 		if err != nil {
 			log.Errorf("persist service entries error %s", err)
 		}
 	}()
 }
 
+func (pod *ServicePod) ReleasePodEntry() {
+	if pod.Manager.consulClient == nil {
+		return
+	}
+	kv := pod.Manager.consulClient.KV()
+
+	_, _, err := kv.Release(pod.podEntry(), nil)
+	if err != nil {
+		log.Errorf("release service entries error %s", err)
+	}
+}
+
 func (pod *ServicePod) RemovePodEntry() {
-	go func() {
-		kv := pod.Manager.consulClient.KV()
+	if pod.Manager.consulClient == nil {
+		return
+	}
+	kv := pod.Manager.consulClient.KV()
 
-		_, err := kv.Delete(fmt.Sprintf("%s/%s/%s/%s", SERVICE_ENTRIES_PREFIX, pod.upstream.ServiceName, pod.Key.Ip, pod.Key.Port), nil)
-		if err != nil {
-			log.Errorf("delete service entries error %s", err)
-		}
-	}()
+	_, err := kv.Delete(fmt.Sprintf("%s/%s/%s/%s", SERVICE_ENTRIES_PREFIX, pod.upstream.ServiceName, pod.Key.Ip, pod.Key.Port), nil)
+	if err != nil {
+		log.Errorf("delete service entries error %s", err)
+	}
 }
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// how upstreams of several sources sharing a frontend are served, the
+	// one of the first source listed in upstream.source_type, or the
+	// targets of every source together
+	COMPOSITE_PRECEDENCE = "precedence"
+	COMPOSITE_MERGE      = "merge"
+)
+
+// CompositeUpstreamLoader serves the upstreams of several loaders, like
+// consul together with a file of static upstreams. Upstreams are merged by
+// frontend following MergePolicy, a source listed first taking precedence
+// over the next ones, and every target tells the source it came from.
+// Overrides are applied once to the merged upstreams, the loaders
+// themselves have none
+type CompositeUpstreamLoader struct {
+	UpstreamLoader
+
+	Config      config.Upstream
+	Overrides   *Overrides
+	Loaders     []UpstreamLoader
+	Sources     []string // source type of each loader
+	MergePolicy string
+
+	served  *upstreamSet
+	changed chan bool
+	sync.Mutex
+
+	synced map[int]bool // loaders which sent EVENT_SYNCED
+}
+
+func InitCompositeUpstreamLoader(Config config.Upstream, sources []string, loaders []UpstreamLoader, overrides *Overrides) (*CompositeUpstreamLoader, error) {
+	if len(sources) != len(loaders) {
+		return nil, fmt.Errorf("%d sources for %d upstream loaders", len(sources), len(loaders))
+	}
+
+	mergePolicy := Config.MergePolicy
+	if mergePolicy == "" {
+		mergePolicy = COMPOSITE_PRECEDENCE
+	}
+	if mergePolicy != COMPOSITE_PRECEDENCE && mergePolicy != COMPOSITE_MERGE {
+		return nil, fmt.Errorf("merge policy %s should be %s or %s", mergePolicy, COMPOSITE_PRECEDENCE, COMPOSITE_MERGE)
+	}
+
+	compositeUpstreamLoader := &CompositeUpstreamLoader{
+		Config:      Config,
+		Overrides:   overrides,
+		Loaders:     loaders,
+		Sources:     sources,
+		MergePolicy: mergePolicy,
+		served:      newUpstreamSet(overrides, Config.ConflictPolicy),
+		changed:     make(chan bool, 1),
+		synced:      make(map[int]bool),
+	}
+
+	go compositeUpstreamLoader.Poll()
+	for i := range loaders {
+		go compositeUpstreamLoader.follow(i)
+	}
+
+	return compositeUpstreamLoader, nil
+}
+
+// Poll merges the upstreams again whenever a loader or the overrides
+// change, once every loader has synced
+func (compositeUpstreamLoader *CompositeUpstreamLoader) Poll() {
+	for {
+		select {
+		case <-compositeUpstreamLoader.changed:
+		case <-compositeUpstreamLoader.Overrides.ChangeNotify():
+		}
+
+		compositeUpstreamLoader.Lock()
+		if len(compositeUpstreamLoader.synced) == len(compositeUpstreamLoader.Loaders) {
+			compositeUpstreamLoader.reconcile()
+			compositeUpstreamLoader.served.synced()
+		}
+		compositeUpstreamLoader.Unlock()
+	}
+}
+
+func (compositeUpstreamLoader *CompositeUpstreamLoader) notifyChanged() {
+	select {
+	case compositeUpstreamLoader.changed <- true:
+	default:
+	}
+}
+
+// follow drains the events of a loader, the merge reads the loaders again
+// rather than replaying their events, their conflicts are passed on
+func (compositeUpstreamLoader *CompositeUpstreamLoader) follow(i int) {
+	for event := range compositeUpstreamLoader.Loaders[i].Events() {
+		if event.Type == EVENT_FRONTEND_CONFLICT {
+			compositeUpstreamLoader.served.events <- event
+			continue
+		}
+		if event.Type == EVENT_SYNCED {
+			compositeUpstreamLoader.Lock()
+			compositeUpstreamLoader.synced[i] = true
+			compositeUpstreamLoader.Unlock()
+		}
+		compositeUpstreamLoader.notifyChanged()
+	}
+}
+
+// reconcile merges the upstreams of the loaders and sends what changed
+// since the last time, callers must hold the lock. An upstream left out
+// for the one of another source is reported as a conflict
+func (compositeUpstreamLoader *CompositeUpstreamLoader) reconcile() {
+	upstreams := make([]*Upstream, 0)
+	byKey := make(map[UpstreamKey]*Upstream)
+	byService := make(map[string]string) // service name -> source serving it
+	addrs := make(map[UpstreamKey]map[string]bool)
+	conflicts := make(map[UpstreamKey]*FrontendConflict)
+	conflictKeys := make([]UpstreamKey, 0)
+	refuse := func(loaded *Upstream, served, reason string) {
+		conflict, found := conflicts[loaded.Key()]
+		if !found {
+			conflict = &FrontendConflict{Key: loaded.Key(), Policy: compositeUpstreamLoader.MergePolicy, Served: served, Reason: reason}
+			conflicts[loaded.Key()] = conflict
+			conflictKeys = append(conflictKeys, loaded.Key())
+		}
+		conflict.Refused = append(conflict.Refused, loaded.ServiceName)
+	}
+
+	for i, loader := range compositeUpstreamLoader.Loaders {
+		source := compositeUpstreamLoader.Sources[i]
+		for _, loaded := range loader.List() {
+			merged, found := byKey[loaded.Key()]
+			if !found {
+				if owner, found := byService[loaded.ServiceName]; found {
+					log.Debugf("%s of %s is already served from %s", loaded.ServiceName, source, owner)
+					refuse(loaded, "", fmt.Sprintf("%s of %s is served from %s", loaded.ServiceName, source, owner))
+					continue
+				}
+
+				copied := *loaded
+				merged = &copied
+				merged.Targets = make([]*Target, 0, len(loaded.Targets))
+				byKey[merged.Key()] = merged
+				byService[merged.ServiceName] = source
+				addrs[merged.Key()] = make(map[string]bool)
+				upstreams = append(upstreams, merged)
+			} else if compositeUpstreamLoader.MergePolicy != COMPOSITE_MERGE {
+				log.Debugf("%s of %s is already served for %s", loaded.Key().ToString(), source, merged.ServiceName)
+				// the same service of several sources is not a conflict
+				if loaded.ServiceName != merged.ServiceName {
+					refuse(loaded, merged.ServiceName, "")
+				}
+				continue
+			}
+
+			// a target announced by several sources is kept once, from the
+			// first of them
+			for _, target := range loaded.Targets {
+				if addrs[merged.Key()][target.Addr()] {
+					continue
+				}
+				addrs[merged.Key()][target.Addr()] = true
+
+				copied := *target
+				copied.ServiceName = merged.ServiceName
+				copied.Source = source
+				copied.Upstream = merged
+				merged.Targets = append(merged.Targets, &copied)
+			}
+		}
+	}
+
+	resolved := make([]FrontendConflict, 0, len(conflictKeys))
+	for _, key := range conflictKeys {
+		resolved = append(resolved, *conflicts[key])
+	}
+	compositeUpstreamLoader.served.updateWithConflicts(upstreams, resolved)
+}
+
+func (compositeUpstreamLoader *CompositeUpstreamLoader) List() []*Upstream {
+	compositeUpstreamLoader.Lock()
+	defer compositeUpstreamLoader.Unlock()
+	return compositeUpstreamLoader.served.list()
+}
+
+func (compositeUpstreamLoader *CompositeUpstreamLoader) Get(serviceName string) *Upstream {
+	compositeUpstreamLoader.Lock()
+	defer compositeUpstreamLoader.Unlock()
+	return compositeUpstreamLoader.served.get(serviceName)
+}
+
+func (compositeUpstreamLoader *CompositeUpstreamLoader) Events() <-chan UpstreamEvent {
+	return compositeUpstreamLoader.served.events
+}
+
+// Conflicts are the ones found within each loader, then the upstreams of
+// a source left out for the ones of a source listed before
+func (compositeUpstreamLoader *CompositeUpstreamLoader) Conflicts() []FrontendConflict {
+	conflicts := make([]FrontendConflict, 0)
+	for _, loader := range compositeUpstreamLoader.Loaders {
+		conflicts = append(conflicts, loader.Conflicts()...)
+	}
+	compositeUpstreamLoader.Lock()
+	defer compositeUpstreamLoader.Unlock()
+	return append(conflicts, compositeUpstreamLoader.served.conflictList()...)
+}
+
+// Reload hands the config to every loader, a new merge policy requires a
+// restart
+func (compositeUpstreamLoader *CompositeUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.MergePolicy != compositeUpstreamLoader.Config.MergePolicy {
+		log.Warnf("upstream merge policy change requires a restart")
+	}
+	for _, loader := range compositeUpstreamLoader.Loaders {
+		loader.Reload(Config)
+	}
+}
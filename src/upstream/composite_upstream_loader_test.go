@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUpstreamLoader serves the upstreams it is loaded with
+type fakeUpstreamLoader struct {
+	UpstreamLoader
+
+	served *upstreamSet
+	sync.Mutex
+}
+
+func newFakeUpstreamLoader() *fakeUpstreamLoader {
+	return &fakeUpstreamLoader{served: newUpstreamSet(nil, "")}
+}
+
+func (l *fakeUpstreamLoader) load(upstreams ...*Upstream) {
+	l.Lock()
+	defer l.Unlock()
+	l.served.update(upstreams)
+	l.served.synced()
+}
+
+func (l *fakeUpstreamLoader) List() []*Upstream {
+	l.Lock()
+	defer l.Unlock()
+	return l.served.list()
+}
+
+func (l *fakeUpstreamLoader) Events() <-chan UpstreamEvent {
+	return l.served.events
+}
+
+func (l *fakeUpstreamLoader) Conflicts() []FrontendConflict {
+	l.Lock()
+	defer l.Unlock()
+	return l.served.conflictList()
+}
+
+func TestCompositeUpstreamLoaderPrecedence(t *testing.T) {
+	file, consul := newFakeUpstreamLoader(), newFakeUpstreamLoader()
+	loader, err := InitCompositeUpstreamLoader(config.Upstream{}, []string{"file", "consul"}, []UpstreamLoader{file, consul}, NewOverrides())
+	assert.Nil(t, err)
+
+	file.load(testUpstream("web", "8080", "10.0.0.1"))
+	// nothing is served before every loader synced
+	select {
+	case event := <-loader.Events():
+		t.Fatalf("unexpected %s before consul synced", event.Type)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	consul.load(testUpstream("web-consul", "8080", "10.0.0.2"), testUpstream("api", "9090", "10.0.0.3"))
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+	assert.Equal(t, event.Upstream.Targets[0].Source, "consul")
+	event = waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:80")
+	assert.Equal(t, event.Upstream.Targets[0].Source, "file")
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// consul takes 8080 over once the file lets it go
+	file.load()
+	event = waitEvent(t, loader, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	event = waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web-consul")
+	assert.Equal(t, event.Upstream.Targets[0].Source, "consul")
+}
+
+func TestCompositeUpstreamLoaderConflicts(t *testing.T) {
+	file, consul := newFakeUpstreamLoader(), newFakeUpstreamLoader()
+	loader, err := InitCompositeUpstreamLoader(config.Upstream{}, []string{"file", "consul"}, []UpstreamLoader{file, consul}, NewOverrides())
+	assert.Nil(t, err)
+
+	file.load(testUpstream("web", "8080", "10.0.0.1"))
+	consul.load(testUpstream("api", "8080", "10.0.0.2"), testUpstream("web", "9090", "10.0.0.3"), testUpstream("db", "5432", "10.0.0.4"))
+
+	// api loses 8080 to the file, web of consul loses to web of the file
+	first := waitEvent(t, loader, EVENT_FRONTEND_CONFLICT)
+	second := waitEvent(t, loader, EVENT_FRONTEND_CONFLICT)
+	assert.Equal(t, first.Conflict.Key.Port, "8080")
+	assert.Equal(t, first.Conflict.Policy, COMPOSITE_PRECEDENCE)
+	assert.Equal(t, first.Conflict.Served, "web")
+	assert.Equal(t, first.Conflict.Refused, []string{"api"})
+	assert.Equal(t, second.Conflict.Key.Port, "9090")
+	assert.Equal(t, second.Conflict.Served, "")
+	assert.Equal(t, second.Conflict.Refused, []string{"web"})
+	assert.Equal(t, second.Conflict.Reason, "web of consul is served from file")
+	waitEvent(t, loader, EVENT_SYNCED)
+	assert.Equal(t, len(loader.Conflicts()), 2)
+
+	// the same conflicts are reported once
+	consul.load(testUpstream("api", "8080", "10.0.0.2"), testUpstream("web", "9090", "10.0.0.3"))
+	event := <-loader.Events()
+	assert.Equal(t, event.Type, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "db")
+
+	// and cleared with their cause
+	file.load()
+	event = waitEvent(t, loader, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, event.Upstream.FrontendPort, "9090")
+	assert.Equal(t, len(loader.Conflicts()), 0)
+}
+
+func TestCompositeUpstreamLoaderMerge(t *testing.T) {
+	file, consul := newFakeUpstreamLoader(), newFakeUpstreamLoader()
+	loader, err := InitCompositeUpstreamLoader(config.Upstream{MergePolicy: COMPOSITE_MERGE}, []string{"file", "consul"}, []UpstreamLoader{file, consul}, NewOverrides())
+	assert.Nil(t, err)
+
+	file.load(testUpstream("web", "8080", "10.0.0.1"))
+	consul.load(testUpstream("web-consul", "8080", "10.0.0.1", "10.0.0.2"))
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	assert.Equal(t, len(event.Upstream.Targets), 2)
+	assert.Equal(t, event.Upstream.Targets[0].Source, "file")
+	assert.Equal(t, event.Upstream.Targets[1].Addr(), "10.0.0.2:80")
+	assert.Equal(t, event.Upstream.Targets[1].Source, "consul")
+	assert.Equal(t, event.Upstream.Targets[1].ServiceName, "web")
+	assert.Equal(t, event.Upstream.Targets[1].Upstream, event.Upstream)
+
+	_, err = InitCompositeUpstreamLoader(config.Upstream{MergePolicy: "union"}, []string{"file"}, []UpstreamLoader{file}, nil)
+	assert.NotNil(t, err)
+}
@@ -3,10 +3,13 @@ package upstream
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Dataman-Cloud/janitor/src/config"
 	"github.com/Dataman-Cloud/janitor/src/util"
 
 	log "github.com/Sirupsen/logrus"
@@ -20,18 +23,38 @@ const (
 	BORG_FRONTEND_PROTO = "proto"
 
 	CONSUL_UPSTREAM_LOADER_KEY = "ConsulUpstreamLoader"
+
+	WATCH_MODE_BLOCKING = "blocking"
+	WATCH_MODE_POLL     = "poll"
+
+	CONSUL_WAIT_TIME = time.Minute * 5
 )
 
+// ConsulUpstreamLoader loads upstreams from the services tagged with
+// BORG_TAG. By default it follows consul with blocking queries, one on
+// the catalog and one on the health of each borg service, so changes are
+// applied as soon as consul knows them. With the poll watch mode it asks
+// consul for everything every PollInterval instead.
 type ConsulUpstreamLoader struct {
 	UpstreamLoader
 
 	ConsulClient *consulApi.Client
 	PollTicker   *time.Ticker
+	Config       config.Upstream
+	Overrides    *Overrides
 
-	Upstreams    []*Upstream
-	changeNotify chan bool
+	served *upstreamSet
 	sync.Mutex
 	DefaultUpstreamIp net.IP
+
+	// latest borg services known with their tags and passing entries
+	serviceTags    map[string][]string
+	serviceEntries map[string][]*consulApi.ServiceEntry
+	serviceWatches map[string]chan bool
+	serviceIndexes map[string]uint64 // registration order of the services
+
+	// kv documents under Config.ConsulKVPrefix, by service name
+	serviceDocuments map[string][]byte
 }
 
 func ConsulUpstreamLoaderFromContext(ctx context.Context) *ConsulUpstreamLoader {
@@ -39,138 +62,363 @@ func ConsulUpstreamLoaderFromContext(ctx context.Context) *ConsulUpstreamLoader
 	return upstreamLoader.(*ConsulUpstreamLoader)
 }
 
-func InitConsulUpstreamLoader(consulAddr string, defaultUpstreamIp net.IP, pollInterval time.Duration) (*ConsulUpstreamLoader, error) {
+func InitConsulUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*ConsulUpstreamLoader, error) {
 	consulUpstreamLoader := &ConsulUpstreamLoader{}
+	consulUpstreamLoader.Config = Config
 
-	consulUpstreamLoader.changeNotify = make(chan bool, 64)
 	consulConfig := consulApi.DefaultNonPooledConfig()
-	consulConfig.Address = consulAddr
+	consulConfig.Address = Config.ConsulAddr
 
 	client, err := consulApi.NewClient(consulConfig)
 	if err != nil {
 		return nil, err
 	}
 	consulUpstreamLoader.ConsulClient = client
-	consulUpstreamLoader.PollTicker = time.NewTicker(pollInterval)
-	consulUpstreamLoader.Upstreams = make([]*Upstream, 0)
+	consulUpstreamLoader.served = newUpstreamSet(overrides, Config.ConflictPolicy)
 	consulUpstreamLoader.DefaultUpstreamIp = defaultUpstreamIp
-
-	go consulUpstreamLoader.Poll()
+	consulUpstreamLoader.Overrides = overrides
+	consulUpstreamLoader.serviceTags = make(map[string][]string)
+	consulUpstreamLoader.serviceEntries = make(map[string][]*consulApi.ServiceEntry)
+	consulUpstreamLoader.serviceWatches = make(map[string]chan bool)
+	consulUpstreamLoader.serviceIndexes = make(map[string]uint64)
+	consulUpstreamLoader.serviceDocuments = make(map[string][]byte)
+
+	if Config.WatchMode == WATCH_MODE_POLL {
+		consulUpstreamLoader.PollTicker = time.NewTicker(Config.PollInterval)
+		go consulUpstreamLoader.Poll()
+	} else {
+		go consulUpstreamLoader.Watch()
+	}
 
 	return consulUpstreamLoader, nil
 }
 
+// Poll loads every borg service from consul right away then on each tick
+// of PollTicker, a failed load is retried with a growing delay
 func (consulUpstreamLoader *ConsulUpstreamLoader) Poll() {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Error("ConsulUpstreamLoader poll got error: %s", err)
+			log.Errorf("ConsulUpstreamLoader poll got error: %s", err)
 			consulUpstreamLoader.Poll() // execute poll again
 		}
 	}()
 
+	retry := newRetryDelay()
 	for {
-		<-consulUpstreamLoader.PollTicker.C
 		log.Debug("consul upstream loader loading services form consul")
+		if err := consulUpstreamLoader.load(); err != nil {
+			log.Errorf("poll upstream from consul got err: %s", err)
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
 
-		services, _, err := consulUpstreamLoader.ConsulClient.Catalog().Services(nil)
+		select {
+		case <-consulUpstreamLoader.PollTicker.C:
+		case <-consulUpstreamLoader.Overrides.ChangeNotify():
+		}
+	}
+}
+
+// load asks consul for every borg service and their passing entries
+func (consulUpstreamLoader *ConsulUpstreamLoader) load() error {
+	services, _, err := consulUpstreamLoader.ConsulClient.Catalog().Services(nil)
+	if err != nil {
+		return err
+	}
+
+	consulUpstreamLoader.Lock()
+	knownIndexes := consulUpstreamLoader.serviceIndexes
+	consulUpstreamLoader.Unlock()
+
+	serviceTags := make(map[string][]string)
+	serviceEntries := make(map[string][]*consulApi.ServiceEntry)
+	serviceIndexes := make(map[string]uint64)
+	for serviceName, tags := range services {
+		// skip services not intent for local server
+		if !util.SliceContains(tags, BORG_TAG) {
+			log.Debug("application does't contain tag BORG")
+			continue
+		}
+		// list only passing state and has tag name BORG_TAG
+		entries, _, err := consulUpstreamLoader.ConsulClient.Health().Service(serviceName, BORG_TAG, true, nil)
 		if err != nil {
-			log.Errorf("poll upstream from consul got err: ", err)
-			return
+			log.Errorf("poll upstream from consul got err: %s", err)
+		}
+
+		serviceTags[serviceName] = tags
+		serviceEntries[serviceName] = entries
+		if index := knownIndexes[serviceName]; index != 0 {
+			serviceIndexes[serviceName] = index
+		} else {
+			serviceIndexes[serviceName] = consulUpstreamLoader.registeredIndex(serviceName)
+		}
+	}
+
+	serviceDocuments, _, err := consulUpstreamLoader.listDocuments(0)
+	if err != nil {
+		return err
+	}
+
+	consulUpstreamLoader.Lock()
+	consulUpstreamLoader.serviceTags = serviceTags
+	consulUpstreamLoader.serviceEntries = serviceEntries
+	consulUpstreamLoader.serviceIndexes = serviceIndexes
+	consulUpstreamLoader.serviceDocuments = serviceDocuments
+	consulUpstreamLoader.reconcile()
+	consulUpstreamLoader.served.synced()
+	consulUpstreamLoader.Unlock()
+	return nil
+}
+
+// Watch follows the catalog with a blocking query, and starts or stops a
+// watch on the health of each borg service as they come and go
+func (consulUpstreamLoader *ConsulUpstreamLoader) Watch() {
+	go consulUpstreamLoader.watchOverrides()
+
+	// the documents are in the first complete load when consul has them
+	// at hand, they are watched from then on
+	serviceDocuments, documentsIndex, err := consulUpstreamLoader.listDocuments(0)
+	if err != nil {
+		log.Errorf("load service documents from consul got err: %s", err)
+	}
+	consulUpstreamLoader.Lock()
+	consulUpstreamLoader.serviceDocuments = serviceDocuments
+	consulUpstreamLoader.Unlock()
+	go consulUpstreamLoader.watchDocuments(documentsIndex)
+
+	var index uint64
+	retry := newRetryDelay()
+	for {
+		services, meta, err := consulUpstreamLoader.ConsulClient.Catalog().Services(&consulApi.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  CONSUL_WAIT_TIME,
+		})
+		if err != nil {
+			log.Errorf("watch services from consul got err: %s", err)
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
+
+		if meta.LastIndex == index {
+			continue // timed out without any change
 		}
+		index = nextWaitIndex(index, meta.LastIndex)
 
-		latestUpstreamList := make([]*Upstream, 0)
+		// the first entries of a new service are loaded right away, so that
+		// every service known is in the first complete load
+		consulUpstreamLoader.Lock()
+		newServices := make([]string, 0)
 		for serviceName, tags := range services {
-			// skip services not intent for local server
-			if !util.SliceContains(tags, BORG_TAG) {
-				log.Debugf("application does't contain tag BORG")
-				continue
+			if _, found := consulUpstreamLoader.serviceWatches[serviceName]; !found && util.SliceContains(tags, BORG_TAG) {
+				newServices = append(newServices, serviceName)
 			}
-			// list only passing state and has tag name BORG_TAG
-			serviceEntries, _, err := consulUpstreamLoader.ConsulClient.Health().Service(serviceName, BORG_TAG, true, nil)
+		}
+		consulUpstreamLoader.Unlock()
+
+		newServiceEntries := make(map[string][]*consulApi.ServiceEntry)
+		newServiceIndexes := make(map[string]uint64)
+		newServiceRegistrations := make(map[string]uint64)
+		for _, serviceName := range newServices {
+			entries, meta, err := consulUpstreamLoader.ConsulClient.Health().Service(serviceName, BORG_TAG, true, nil)
 			if err != nil {
-				log.Errorf("poll upstream from consul got err: ", err)
+				log.Errorf("load service %s from consul got err: %s", serviceName, err)
+				continue
+			}
+			newServiceEntries[serviceName] = entries
+			newServiceIndexes[serviceName] = meta.LastIndex
+			newServiceRegistrations[serviceName] = consulUpstreamLoader.registeredIndex(serviceName)
+		}
+
+		consulUpstreamLoader.Lock()
+		for serviceName, tags := range services {
+			if !util.SliceContains(tags, BORG_TAG) {
+				continue
 			}
 
-			upstream := buildUpstream(serviceName, tags, serviceEntries, consulUpstreamLoader.DefaultUpstreamIp.String())
-			upstreamDuplicated := false
-			for _, n := range latestUpstreamList {
-				if n.EntryPointEqual(&upstream) {
-					upstreamDuplicated = true
+			consulUpstreamLoader.serviceTags[serviceName] = tags
+			if _, found := consulUpstreamLoader.serviceWatches[serviceName]; !found {
+				log.Infof("start watching service %s", serviceName)
+				if entries, found := newServiceEntries[serviceName]; found {
+					consulUpstreamLoader.serviceEntries[serviceName] = entries
+					consulUpstreamLoader.serviceIndexes[serviceName] = newServiceRegistrations[serviceName]
 				}
+				stopCh := make(chan bool)
+				consulUpstreamLoader.serviceWatches[serviceName] = stopCh
+				go consulUpstreamLoader.watchService(serviceName, newServiceIndexes[serviceName], stopCh)
 			}
+		}
 
-			if !upstreamDuplicated {
-				latestUpstreamList = append(latestUpstreamList, &upstream)
+		for serviceName, stopCh := range consulUpstreamLoader.serviceWatches {
+			if tags, found := services[serviceName]; found && util.SliceContains(tags, BORG_TAG) {
+				continue
 			}
+
+			log.Infof("stop watching service %s", serviceName)
+			close(stopCh)
+			delete(consulUpstreamLoader.serviceWatches, serviceName)
+			delete(consulUpstreamLoader.serviceTags, serviceName)
+			delete(consulUpstreamLoader.serviceEntries, serviceName)
+			delete(consulUpstreamLoader.serviceIndexes, serviceName)
 		}
 
-		log.Debugf("latest upstream list")
-		for _, s := range latestUpstreamList {
-			log.Debugf(s.ToString())
+		// tags may carry the frontend of a service
+		consulUpstreamLoader.reconcile()
+		consulUpstreamLoader.served.synced()
+		consulUpstreamLoader.Unlock()
+	}
+}
+
+func (consulUpstreamLoader *ConsulUpstreamLoader) watchService(serviceName string, index uint64, stopCh chan bool) {
+	retry := newRetryDelay()
+	for {
+		// list only passing state and has tag name BORG_TAG
+		entries, meta, err := consulUpstreamLoader.ConsulClient.Health().Service(serviceName, BORG_TAG, true, &consulApi.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  CONSUL_WAIT_TIME,
+		})
+
+		select {
+		case <-stopCh:
+			return
+		default:
 		}
 
-		// find and mark oldUpstream that are stale
-		for _, oldUpstream := range consulUpstreamLoader.Upstreams {
-			shouldSweep := true
-			for _, newUpstream := range latestUpstreamList {
-				if oldUpstream.FieldsEqual(newUpstream) && len(newUpstream.Targets) != 0 {
-					shouldSweep = false
-				}
-			}
+		if err != nil {
+			log.Errorf("watch service %s from consul got err: %s", serviceName, err)
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
 
-			if shouldSweep {
-				log.Debugf("mark shouldSweep ", oldUpstream.ToString())
-				oldUpstream.StaleMark = true
-			}
+		if meta.LastIndex == index {
+			continue
 		}
+		index = nextWaitIndex(index, meta.LastIndex)
 
-		// find and mark oldUpstream that are changed with targets
-		for _, oldUpstream := range consulUpstreamLoader.Upstreams {
-			for _, newUpstream := range latestUpstreamList {
-				if oldUpstream.FieldsEqual(newUpstream) && oldUpstream.FieldsEqualButTargetsDiffer(newUpstream) {
-					log.Debugf(oldUpstream.ToString())
-					log.Debugf(newUpstream.ToString())
-					log.Debugf("set changed %s", oldUpstream.ToString())
-					oldUpstream.SetState(STATE_CHANGED)
-					oldUpstream.Targets = newUpstream.Targets
-				}
-			}
+		consulUpstreamLoader.Lock()
+		consulUpstreamLoader.serviceEntries[serviceName] = entries
+		consulUpstreamLoader.reconcile()
+		consulUpstreamLoader.Unlock()
+	}
+}
+
+// watchDocuments follows the service documents with a blocking query
+func (consulUpstreamLoader *ConsulUpstreamLoader) watchDocuments(index uint64) {
+	if consulUpstreamLoader.Config.ConsulKVPrefix == "" {
+		return
+	}
+
+	retry := newRetryDelay()
+	for {
+		serviceDocuments, lastIndex, err := consulUpstreamLoader.listDocuments(index)
+		if err != nil {
+			log.Errorf("watch service documents from consul got err: %s", err)
+			retry.Wait()
+			continue
 		}
+		retry.Reset()
 
-		upstreamsShouldAppend := make([]*Upstream, 0)
-		for _, newUpstream := range latestUpstreamList {
-			notInTheSlice := true
-			for _, oldUpstream := range consulUpstreamLoader.Upstreams {
-				if oldUpstream.FieldsEqual(newUpstream) {
-					notInTheSlice = false
-				}
-			}
+		if lastIndex == index {
+			continue
+		}
+		index = nextWaitIndex(index, lastIndex)
 
-			if notInTheSlice {
-				upstreamsShouldAppend = append(upstreamsShouldAppend, newUpstream)
-			}
+		consulUpstreamLoader.Lock()
+		consulUpstreamLoader.serviceDocuments = serviceDocuments
+		consulUpstreamLoader.reconcile()
+		consulUpstreamLoader.Unlock()
+	}
+}
+
+// listDocuments returns the kv documents of the services by name, waiting
+// for a change past index when it is not 0
+func (consulUpstreamLoader *ConsulUpstreamLoader) listDocuments(index uint64) (map[string][]byte, uint64, error) {
+	serviceDocuments := make(map[string][]byte)
+	prefix := consulUpstreamLoader.Config.ConsulKVPrefix
+	if prefix == "" {
+		return serviceDocuments, 0, nil
+	}
+
+	pairs, meta, err := consulUpstreamLoader.ConsulClient.KV().List(prefix, &consulApi.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  CONSUL_WAIT_TIME,
+	})
+	if err != nil {
+		return serviceDocuments, index, err
+	}
+	for _, pair := range pairs {
+		serviceName := strings.TrimPrefix(pair.Key, prefix)
+		if serviceName == "" || strings.Contains(serviceName, "/") {
+			continue
 		}
+		serviceDocuments[serviceName] = pair.Value
+	}
+	return serviceDocuments, meta.LastIndex, nil
+}
 
-		for _, upstream := range upstreamsShouldAppend {
-			if len(upstream.Targets) > 0 {
-				log.Infof("new upstream found %s", upstream.Key())
-				consulUpstreamLoader.Upstreams = append(consulUpstreamLoader.Upstreams, upstream)
-			}
+func (consulUpstreamLoader *ConsulUpstreamLoader) watchOverrides() {
+	for {
+		<-consulUpstreamLoader.Overrides.ChangeNotify()
+		consulUpstreamLoader.Lock()
+		consulUpstreamLoader.reconcile()
+		consulUpstreamLoader.Unlock()
+	}
+}
+
+// nextWaitIndex follows the consul advice to start over when the index
+// goes backwards, e.g. after the raft state of consul was restored
+func nextWaitIndex(previous, last uint64) uint64 {
+	if last < previous {
+		return 0
+	}
+	return last
+}
+
+// registeredIndex returns the CreateIndex of the oldest instance of a
+// service, which the health entries of the consul api leave out, 0 when
+// it can not be read
+func (consulUpstreamLoader *ConsulUpstreamLoader) registeredIndex(serviceName string) uint64 {
+	var instances []struct{ CreateIndex uint64 }
+	if _, err := consulUpstreamLoader.ConsulClient.Raw().Query("/v1/catalog/service/"+serviceName, &instances, nil); err != nil {
+		log.Errorf("load registration of service %s from consul got err: %s", serviceName, err)
+		return 0
+	}
+
+	var index uint64
+	for _, instance := range instances {
+		if index == 0 || (instance.CreateIndex != 0 && instance.CreateIndex < index) {
+			index = instance.CreateIndex
 		}
+	}
+	return index
+}
 
-		consulUpstreamLoader.changeNotify <- true
+// reconcile builds the upstreams from the latest services known and
+// sends what changed since the last time, callers must hold the lock
+func (consulUpstreamLoader *ConsulUpstreamLoader) reconcile() {
+	loaded := make([]*Upstream, 0, len(consulUpstreamLoader.serviceTags))
+	for serviceName, tags := range consulUpstreamLoader.serviceTags {
+		serviceEntries := consulUpstreamLoader.serviceEntries[serviceName]
+		document := consulUpstreamLoader.serviceDocuments[serviceName]
+		upstream := buildUpstream(serviceName, tags, document, serviceEntries, consulUpstreamLoader.DefaultUpstreamIp.String())
+		upstream.RegisteredIndex = consulUpstreamLoader.serviceIndexes[serviceName]
+		loaded = append(loaded, upstream)
 	}
+	consulUpstreamLoader.served.update(loaded)
 }
 
 func (consulUpstreamLoader *ConsulUpstreamLoader) List() []*Upstream {
 	consulUpstreamLoader.Lock()
 	defer consulUpstreamLoader.Unlock()
-	return consulUpstreamLoader.Upstreams
+
+	return consulUpstreamLoader.served.list()
 }
 
 func (consulUpstreamLoader *ConsulUpstreamLoader) ServiceEntries() []string {
 	entryList := make([]string, 0)
-	for _, u := range consulUpstreamLoader.Upstreams {
+	for _, u := range consulUpstreamLoader.List() {
 		entry := fmt.Sprintf("%s://%s:%s", u.Key().Proto, u.Key().Ip, u.Key().Port)
 		entryList = append(entryList, entry)
 	}
@@ -179,47 +427,78 @@ func (consulUpstreamLoader *ConsulUpstreamLoader) ServiceEntries() []string {
 }
 
 func (consulUpstreamLoader *ConsulUpstreamLoader) Get(serviceName string) *Upstream {
-	return nil
+	consulUpstreamLoader.Lock()
+	defer consulUpstreamLoader.Unlock()
+	return consulUpstreamLoader.served.get(serviceName)
 }
 
-func (consulUpstreamLoader *ConsulUpstreamLoader) Remove(upstream *Upstream) {
-	index := -1
-	for k, v := range consulUpstreamLoader.Upstreams {
-		if v == upstream {
-			index = k
-			break
-		}
-	}
+func (consulUpstreamLoader *ConsulUpstreamLoader) Events() <-chan UpstreamEvent {
+	return consulUpstreamLoader.served.events
+}
 
-	if index >= 0 {
-		consulUpstreamLoader.Upstreams = append(consulUpstreamLoader.Upstreams[:index], consulUpstreamLoader.Upstreams[index+1:]...)
-	}
+func (consulUpstreamLoader *ConsulUpstreamLoader) Conflicts() []FrontendConflict {
+	consulUpstreamLoader.Lock()
+	defer consulUpstreamLoader.Unlock()
+	return consulUpstreamLoader.served.conflictList()
 }
 
-func (consulUpstreamLoader *ConsulUpstreamLoader) ChangeNotify() <-chan bool {
-	return consulUpstreamLoader.changeNotify
+// Reload applies a new poll interval, switching to another consul agent
+// requires a restart as the service pods hold sessions on the current one
+func (consulUpstreamLoader *ConsulUpstreamLoader) Reload(Config config.Upstream) {
+	consulUpstreamLoader.Lock()
+	defer consulUpstreamLoader.Unlock()
+
+	if Config.ConsulAddr != consulUpstreamLoader.Config.ConsulAddr {
+		log.Warnf("consul address change from %s to %s requires a restart", consulUpstreamLoader.Config.ConsulAddr, Config.ConsulAddr)
+	}
+	if Config.WatchMode != consulUpstreamLoader.Config.WatchMode {
+		log.Warnf("consul watch mode change from %s to %s requires a restart", consulUpstreamLoader.Config.WatchMode, Config.WatchMode)
+	}
+	if Config.PollInterval != consulUpstreamLoader.Config.PollInterval && consulUpstreamLoader.PollTicker != nil {
+		log.Infof("consul poll interval changed to %s", Config.PollInterval)
+		consulUpstreamLoader.PollTicker.Reset(Config.PollInterval)
+		consulUpstreamLoader.Config.PollInterval = Config.PollInterval
+	}
 }
 
+// ParseValueFromTags returns the value of the former <what>-<value> tag of
+// what, like port-3412
 func ParseValueFromTags(what string, tags []string) string {
+	prefix := what + "-"
 	for _, tag := range tags {
-		if strings.HasPrefix(tag, what) {
-			if len(strings.Split(tag, "-")) == 2 {
-				return strings.Split(tag, "-")[1]
-			}
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
 		}
 	}
 	return ""
 }
 
-func buildUpstream(serviceName string, tags []string, serviceEntries []*consulApi.ServiceEntry, defaultUpstreamIp string) Upstream {
-	var upstream Upstream
+// buildUpstream builds a borg service from its tags, overlaid with its
+// kv document when it has one
+func buildUpstream(serviceName string, tags []string, document []byte, serviceEntries []*consulApi.ServiceEntry, defaultUpstreamIp string) *Upstream {
+	doc, problems := parseServiceTags(tags)
+	if document != nil {
+		kvDoc, err := parseServiceDocument(document)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("kv document is not valid json: %s", err))
+		} else {
+			doc = doc.overlay(kvDoc)
+		}
+	}
+
+	upstream := &Upstream{}
 	upstream.ServiceName = serviceName
-	upstream.FrontendPort = ParseValueFromTags(BORG_FRONTEND_PORT, tags)
+	upstream.FrontendPort = string(doc.FrontendPort)
 	upstream.FrontendIp = defaultUpstreamIp
-	upstream.FrontendProto = ParseValueFromTags(BORG_FRONTEND_PROTO, tags)
+	upstream.FrontendProto = doc.FrontendProto
 	upstream.Targets = make([]*Target, 0)
-	upstream.StaleMark = false
-	upstream.SetState(STATE_NEW)
+
+	settings, routes, settingsProblems := doc.settings()
+	upstream.Settings = settings
+	if len(routes) > 0 {
+		upstream.Routes = routes
+	}
+	problems = append(problems, settingsProblems...)
 
 	for _, service := range serviceEntries {
 		var target Target
@@ -229,8 +508,42 @@ func buildUpstream(serviceName string, tags []string, serviceEntries []*consulAp
 		target.ServiceName = serviceName
 		target.ServiceAddress = service.Service.Address
 		target.ServicePort = fmt.Sprintf("%d", service.Service.Port)
-		target.Upstream = &upstream
+		target.Upstream = upstream
+
+		weight, found := doc.Weights[service.Service.ID]
+		if !found {
+			weight = DEFAULT_WEIGHT
+			if value := tagValue(SERVICE_TAG_WEIGHT, service.Service.Tags); value != "" {
+				if tagWeight, err := strconv.Atoi(value); err != nil {
+					problems = append(problems, fmt.Sprintf("%s %q of %s is not a number", SERVICE_TAG_WEIGHT, value, service.Service.ID))
+				} else {
+					weight = tagWeight
+				}
+			}
+		}
+		if err := ValidateWeight(weight); err != nil {
+			problems = append(problems, fmt.Sprintf("%s of %s: %s", SERVICE_TAG_WEIGHT, service.Service.ID, err))
+			weight = DEFAULT_WEIGHT
+		}
+		target.Weight = weight
+
 		upstream.Targets = append(upstream.Targets, &target)
 	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		upstream.Problems = problems
+	}
 	return upstream
 }
+
+// tagValue returns the value of the borg-<key>:<value> tag of key
+func tagValue(key string, tags []string) string {
+	prefix := SERVICE_TAG_PREFIX + key + ":"
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,296 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul answers the catalog and health endpoints like consul does,
+// blocking queries wait until the index moves past the one asked for
+type fakeConsul struct {
+	index    uint64
+	services map[string][]string
+	entries  map[string][]*consulApi.ServiceEntry
+	indexes  map[string]uint64 // CreateIndex of the instances of a service
+	kvs      map[string]string
+	changed  chan bool
+	sync.Mutex
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		services: make(map[string][]string),
+		entries:  make(map[string][]*consulApi.ServiceEntry),
+		indexes:  make(map[string]uint64),
+		kvs:      make(map[string]string),
+		changed:  make(chan bool),
+	}
+}
+
+func (c *fakeConsul) update(f func()) {
+	c.Lock()
+	defer c.Unlock()
+	f()
+	c.index++
+	close(c.changed)
+	c.changed = make(chan bool)
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	c.Lock()
+	if waitIndex >= c.index {
+		changed := c.changed
+		c.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+		c.Lock()
+	}
+	defer c.Unlock()
+
+	var body interface{}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		body = c.services
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		entries := c.entries[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+		if entries == nil {
+			entries = make([]*consulApi.ServiceEntry, 0)
+		}
+		body = entries
+	case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+		serviceName := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+		instances := make([]map[string]uint64, 0)
+		for range c.entries[serviceName] {
+			instances = append(instances, map[string]uint64{"CreateIndex": c.indexes[serviceName]})
+		}
+		body = instances
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		pairs := make([]*consulApi.KVPair, 0)
+		for key, value := range c.kvs {
+			if strings.HasPrefix(key, prefix) {
+				pairs = append(pairs, &consulApi.KVPair{Key: key, Value: []byte(value)})
+			}
+		}
+		if len(pairs) == 0 {
+			w.Header().Set("X-Consul-Index", fmt.Sprintf("%d", c.index))
+			http.NotFound(w, r)
+			return
+		}
+		body = pairs
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", fmt.Sprintf("%d", c.index))
+	json.NewEncoder(w).Encode(body)
+}
+
+func serviceEntry(serviceName, address string, port int) *consulApi.ServiceEntry {
+	return &consulApi.ServiceEntry{
+		Node: &consulApi.Node{Node: "node-" + address, Address: address},
+		Service: &consulApi.AgentService{
+			ID:      fmt.Sprintf("%s-%s-%d", serviceName, address, port),
+			Service: serviceName,
+			Address: address,
+			Port:    port,
+		},
+	}
+}
+
+func startConsulUpstreamLoader(t *testing.T, consul *fakeConsul, watchMode string) *ConsulUpstreamLoader {
+	server := httptest.NewServer(consul)
+	t.Cleanup(server.Close)
+
+	loader, err := InitConsulUpstreamLoader(config.Upstream{
+		SourceType:   "consul",
+		ConsulAddr:   strings.TrimPrefix(server.URL, "http://"),
+		WatchMode:    watchMode,
+		PollInterval: time.Millisecond * 50,
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+	return loader
+}
+
+// waitEvent waits for the next event of type eventType
+func waitEvent(t *testing.T, loader UpstreamLoader, eventType UpstreamEventType) UpstreamEvent {
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case event := <-loader.Events():
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event in time", eventType)
+		}
+	}
+}
+
+func TestConsulUpstreamLoaderWatch(t *testing.T) {
+	consul := newFakeConsul()
+	consul.update(func() {
+		consul.services["consul"] = []string{}
+		consul.services["web"] = []string{BORG_TAG, "port-8080", "proto-http"}
+		consul.entries["web"] = []*consulApi.ServiceEntry{serviceEntry("web", "10.0.0.1", 80)}
+	})
+
+	loader := startConsulUpstreamLoader(t, consul, WATCH_MODE_BLOCKING)
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	assert.Equal(t, event.Upstream.FrontendPort, "8080")
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// a new instance is seen without waiting for a poll interval
+	consul.update(func() {
+		consul.entries["web"] = append(consul.entries["web"], serviceEntry("web", "10.0.0.2", 80))
+	})
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.AddedTargets), 1)
+	assert.Equal(t, event.AddedTargets[0].Addr(), "10.0.0.2:80")
+	assert.Equal(t, len(event.RemovedTargets), 0)
+	assert.Equal(t, len(loader.Get("web").Targets), 2)
+
+	consul.update(func() {
+		consul.services["web"] = []string{BORG_TAG, "port-8081", "proto-http"}
+	})
+	event = waitEvent(t, loader, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, event.Previous.FrontendPort, "8080")
+	assert.Equal(t, event.Upstream.FrontendPort, "8081")
+
+	// a service no longer tagged is removed
+	consul.update(func() {
+		consul.services["web"] = []string{"port-8081", "proto-http"}
+	})
+	event = waitEvent(t, loader, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	assert.Equal(t, len(loader.List()), 0)
+}
+
+func TestConsulUpstreamLoaderDocuments(t *testing.T) {
+	consul := newFakeConsul()
+	consul.update(func() {
+		consul.services["web"] = []string{BORG_TAG, "borg-frontend-port:8080", "borg-lb-strategy:rr", "borg-route:web.example.com/api", "borg-dial-timeout:soon"}
+		web1, web2 := serviceEntry("web", "10.0.0.1", 80), serviceEntry("web", "10.0.0.2", 80)
+		web1.Service.Tags = []string{BORG_TAG, "borg-weight:3"}
+		consul.entries["web"] = []*consulApi.ServiceEntry{web1, web2}
+		consul.kvs["janitor/services/web"] = `{"response_header_timeout": "30s", "weights": {"web-10.0.0.2-80": 2}}`
+	})
+
+	server := httptest.NewServer(consul)
+	t.Cleanup(server.Close)
+	loader, err := InitConsulUpstreamLoader(config.Upstream{
+		SourceType:     "consul",
+		ConsulAddr:     strings.TrimPrefix(server.URL, "http://"),
+		ConsulKVPrefix: "janitor/services/",
+		WatchMode:      WATCH_MODE_BLOCKING,
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.FrontendPort, "8080")
+	assert.Equal(t, event.Upstream.FrontendProto, "")
+	assert.Equal(t, event.Upstream.Settings.Strategy, "rr")
+	assert.Equal(t, event.Upstream.Settings.ResponseHeaderTimeout, time.Second*30)
+	assert.Equal(t, event.Upstream.Routes, []Route{{Host: "web.example.com", Path: "/api"}})
+	assert.Equal(t, event.Upstream.Targets[0].Weight, 3)
+	assert.Equal(t, event.Upstream.Targets[1].Weight, 2)
+	assert.Equal(t, len(event.Upstream.Problems), 1)
+	assert.Contains(t, event.Upstream.Problems[0], "dial-timeout")
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// a new document is a new frontend
+	consul.update(func() {
+		consul.kvs["janitor/services/web"] = `{"frontend_proto": "http", "dial_timeout": "2s"}`
+	})
+	event = waitEvent(t, loader, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, event.Upstream.FrontendProto, "http")
+	assert.Equal(t, event.Upstream.Settings.DialTimeout, time.Second*2)
+	assert.Equal(t, len(event.Upstream.Problems), 0)
+}
+
+func TestConsulUpstreamLoaderPoll(t *testing.T) {
+	consul := newFakeConsul()
+	consul.update(func() {
+		consul.services["web"] = []string{BORG_TAG, "port-8080", "proto-http"}
+		consul.entries["web"] = []*consulApi.ServiceEntry{serviceEntry("web", "10.0.0.1", 80)}
+	})
+
+	loader := startConsulUpstreamLoader(t, consul, WATCH_MODE_POLL)
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:80")
+	waitEvent(t, loader, EVENT_SYNCED)
+}
+
+func TestConsulUpstreamLoaderRegisteredOrder(t *testing.T) {
+	for _, watchMode := range []string{WATCH_MODE_POLL, WATCH_MODE_BLOCKING} {
+		// web registered before api keeps 8080 though api sorts first
+		consul := newFakeConsul()
+		consul.update(func() {
+			consul.services["web"] = []string{BORG_TAG, "port-8080", "proto-http"}
+			consul.entries["web"] = []*consulApi.ServiceEntry{serviceEntry("web", "10.0.0.1", 80)}
+			consul.indexes["web"] = 5
+			consul.services["api"] = []string{BORG_TAG, "port-8080", "proto-http"}
+			consul.entries["api"] = []*consulApi.ServiceEntry{serviceEntry("api", "10.0.0.2", 80)}
+			consul.indexes["api"] = 9
+		})
+
+		loader := startConsulUpstreamLoader(t, consul, watchMode)
+		event := waitEvent(t, loader, EVENT_FRONTEND_CONFLICT)
+		assert.Equal(t, event.Conflict.Served, "web", watchMode)
+		assert.Equal(t, event.Conflict.Refused, []string{"api"}, watchMode)
+		assert.Equal(t, loader.Get("web").RegisteredIndex, uint64(5), watchMode)
+	}
+}
+
+func TestConsulUpstreamLoaderOverrides(t *testing.T) {
+	consul := newFakeConsul()
+	consul.update(func() {
+		consul.services["web"] = []string{BORG_TAG, "port-8080", "proto-http"}
+		consul.entries["web"] = []*consulApi.ServiceEntry{
+			serviceEntry("web", "10.0.0.1", 80),
+			serviceEntry("web", "10.0.0.2", 80),
+		}
+	})
+
+	loader := startConsulUpstreamLoader(t, consul, WATCH_MODE_BLOCKING)
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// applied at once, consul is not asked again
+	loader.Overrides.DrainTarget("web", "10.0.0.1:80")
+	event := waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, event.RemovedTargets[0].Addr(), "10.0.0.1:80")
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.2:80")
+
+	// still served with no target left
+	loader.Overrides.DrainTarget("web", "10.0.0.2:80")
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.Upstream.Targets), 0)
+	assert.NotNil(t, loader.Get("web"))
+}
+
+func TestNextWaitIndex(t *testing.T) {
+	assert.Equal(t, nextWaitIndex(0, 12), uint64(12))
+	assert.Equal(t, nextWaitIndex(12, 15), uint64(15))
+	assert.Equal(t, nextWaitIndex(15, 3), uint64(0))
+}
@@ -0,0 +1,481 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// kinds of the dns names, srv://_http._tcp.web.example.com resolves
+	// SRV records, host://web.example.com:80 the A and AAAA records of a
+	// name served on a fixed port
+	DNS_SRV_NAME  = "srv"
+	DNS_HOST_NAME = "host"
+
+	DNS_RESOLV_CONF    = "/etc/resolv.conf"
+	DNS_DEFAULT_SERVER = "127.0.0.1:53"
+	DNS_TIMEOUT        = time.Second * 5
+
+	// bounds of the time between two resolutions of a name, its ttl
+	DNS_MIN_TTL = time.Second
+	DNS_MAX_TTL = time.Minute * 5
+)
+
+// DNSUpstreamLoader loads upstreams from dns, each of the DNSNames is
+// resolved again when its records expire. A failed resolution leaves the
+// targets resolved before in place. Of the SRV records, the ones of the
+// lowest priority are served, the others are backups
+type DNSUpstreamLoader struct {
+	UpstreamLoader
+
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	server  string
+	names   []dnsName
+	served  *upstreamSet
+	changed chan bool
+	sync.Mutex
+
+	resolved  map[string][]*Target // service name -> targets last resolved
+	attempted map[string]bool      // names resolved at least once, or failed to
+}
+
+type dnsName struct {
+	serviceName   string
+	kind          string
+	name          string // fully qualified
+	port          string // of a host name
+	frontendProto string
+	frontendPort  string
+}
+
+// parseDNSName reads the DNSNames entry of a service, like
+// srv://_http._tcp.web.example.com?frontend_port=8080 or
+// host://web.example.com:80?frontend_port=8080&frontend_proto=tcp
+func parseDNSName(serviceName, raw string) (dnsName, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return dnsName{}, err
+	}
+
+	name := dnsName{
+		serviceName:   serviceName,
+		kind:          u.Scheme,
+		name:          u.Hostname(),
+		port:          u.Port(),
+		frontendProto: u.Query().Get("frontend_proto"),
+		frontendPort:  u.Query().Get("frontend_port"),
+	}
+	if name.frontendProto == "" {
+		name.frontendProto = "http"
+	}
+	if !strings.HasSuffix(name.name, ".") {
+		name.name = name.name + "."
+	}
+
+	switch {
+	case name.kind != DNS_SRV_NAME && name.kind != DNS_HOST_NAME:
+		return name, fmt.Errorf("%s of %s should be srv:// or host://", raw, serviceName)
+	case name.name == ".":
+		return name, fmt.Errorf("%s of %s has no name", raw, serviceName)
+	case name.kind == DNS_HOST_NAME && name.port == "":
+		return name, fmt.Errorf("%s of %s has no port", raw, serviceName)
+	case name.frontendPort == "":
+		return name, fmt.Errorf("%s of %s has no frontend_port", raw, serviceName)
+	}
+	return name, nil
+}
+
+func InitDNSUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*DNSUpstreamLoader, error) {
+	names := make([]dnsName, 0, len(Config.DNSNames))
+	for serviceName, raw := range Config.DNSNames {
+		name, err := parseDNSName(serviceName, raw)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	server := Config.DNSServer
+	if server == "" {
+		server = resolvConfServer(DNS_RESOLV_CONF)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	dnsUpstreamLoader := &DNSUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		server:            server,
+		names:             names,
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+		changed:           make(chan bool, 1),
+		resolved:          make(map[string][]*Target),
+		attempted:         make(map[string]bool),
+	}
+
+	go dnsUpstreamLoader.Poll()
+	for _, name := range names {
+		go dnsUpstreamLoader.follow(name)
+	}
+
+	return dnsUpstreamLoader, nil
+}
+
+// resolvConfServer is the first nameserver of the resolv.conf at path
+func resolvConfServer(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return DNS_DEFAULT_SERVER
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return DNS_DEFAULT_SERVER
+}
+
+// Poll rebuilds the upstreams whenever a name is resolved or the overrides
+// change, once every name has been resolved
+func (dnsUpstreamLoader *DNSUpstreamLoader) Poll() {
+	for {
+		select {
+		case <-dnsUpstreamLoader.changed:
+		case <-dnsUpstreamLoader.Overrides.ChangeNotify():
+		}
+
+		dnsUpstreamLoader.Lock()
+		if len(dnsUpstreamLoader.attempted) == len(dnsUpstreamLoader.names) {
+			dnsUpstreamLoader.reconcile()
+			dnsUpstreamLoader.served.synced()
+		}
+		dnsUpstreamLoader.Unlock()
+	}
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) notifyChanged() {
+	select {
+	case dnsUpstreamLoader.changed <- true:
+	default:
+	}
+}
+
+// follow resolves a name again each time its records expire
+func (dnsUpstreamLoader *DNSUpstreamLoader) follow(name dnsName) {
+	retry := newRetryDelay()
+	for {
+		targets, ttl, err := dnsUpstreamLoader.resolve(name)
+		if err != nil {
+			log.Errorf("resolve %s://%s got err: %s", name.kind, name.name, err)
+			dnsUpstreamLoader.Lock()
+			dnsUpstreamLoader.attempted[name.serviceName] = true
+			dnsUpstreamLoader.Unlock()
+			dnsUpstreamLoader.notifyChanged()
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
+
+		dnsUpstreamLoader.Lock()
+		dnsUpstreamLoader.resolved[name.serviceName] = targets
+		dnsUpstreamLoader.attempted[name.serviceName] = true
+		dnsUpstreamLoader.Unlock()
+		dnsUpstreamLoader.notifyChanged()
+
+		time.Sleep(ttl)
+	}
+}
+
+// resolve returns the targets of a name and how long they are valid
+func (dnsUpstreamLoader *DNSUpstreamLoader) resolve(name dnsName) ([]*Target, time.Duration, error) {
+	ttl := DNS_MAX_TTL
+	expire := func(seconds uint32) {
+		if d := time.Duration(seconds) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+
+	targets := make([]*Target, 0)
+	switch name.kind {
+	case DNS_HOST_NAME:
+		ips, err := dnsUpstreamLoader.lookupIPs(name.name, nil, expire)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			targets = append(targets, &Target{
+				Node:           strings.TrimSuffix(name.name, "."),
+				Address:        ip,
+				ServiceName:    name.serviceName,
+				ServiceID:      net.JoinHostPort(ip, name.port),
+				ServiceAddress: ip,
+				ServicePort:    name.port,
+				Weight:         DEFAULT_WEIGHT,
+			})
+		}
+
+	case DNS_SRV_NAME:
+		msg, err := dnsUpstreamLoader.exchange(name.name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, answer := range msg.Answers {
+			srv, ok := answer.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			expire(answer.Header.TTL)
+
+			port := strconv.Itoa(int(srv.Port))
+			ips, err := dnsUpstreamLoader.lookupIPs(srv.Target.String(), msg.Additionals, expire)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, ip := range ips {
+				targets = append(targets, &Target{
+					Node:           strings.TrimSuffix(srv.Target.String(), "."),
+					Address:        ip,
+					ServiceName:    name.serviceName,
+					ServiceID:      net.JoinHostPort(ip, port),
+					ServiceAddress: ip,
+					ServicePort:    port,
+					Priority:       int(srv.Priority),
+					Weight:         srvWeight(srv.Weight),
+				})
+			}
+		}
+	}
+
+	if ttl < DNS_MIN_TTL {
+		ttl = DNS_MIN_TTL
+	}
+	sort.Sort(targetsByPriority(targets))
+	return targets, ttl, nil
+}
+
+// lookupIPs returns the addresses of host, from the additional records of
+// a SRV answer when they have them, from its A and AAAA records otherwise
+func (dnsUpstreamLoader *DNSUpstreamLoader) lookupIPs(host string, additionals []dnsmessage.Resource, expire func(uint32)) ([]string, error) {
+	ips := ipsOf(host, additionals, expire)
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := dnsUpstreamLoader.exchange(host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		// the answers of a CNAME end with the records of its target
+		ips = append(ips, ipsOf("", msg.Answers, expire)...)
+	}
+	return ips, nil
+}
+
+// ipsOf returns the addresses of the A and AAAA records of host, of any
+// name when host is empty
+func ipsOf(host string, resources []dnsmessage.Resource, expire func(uint32)) []string {
+	ips := make([]string, 0)
+	for _, resource := range resources {
+		if host != "" && !strings.EqualFold(resource.Header.Name.String(), host) {
+			continue
+		}
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		default:
+			continue
+		}
+		expire(resource.Header.TTL)
+	}
+	return ips
+}
+
+// exchange asks the dns server about name over udp, then over tcp when
+// the answer is truncated. A name that does not exist has no records
+func (dnsUpstreamLoader *DNSUpstreamLoader) exchange(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := dnsUpstreamLoader.exchangeOver("udp", query.ID, packed)
+	if err == nil && msg.Truncated {
+		msg, err = dnsUpstreamLoader.exchangeOver("tcp", query.ID, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+		return msg, nil
+	case dnsmessage.RCodeNameError:
+		return &dnsmessage.Message{}, nil
+	default:
+		return nil, fmt.Errorf("dns server answered %s for %s", msg.RCode, name)
+	}
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) exchangeOver(network string, id uint16, packed []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, dnsUpstreamLoader.server, DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// messages over tcp are prefixed with their length
+		prefixed := make([]byte, 2+len(packed))
+		binary.BigEndian.PutUint16(prefixed, uint16(len(packed)))
+		copy(prefixed[2:], packed)
+		if _, err := conn.Write(prefixed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if msg.ID != id {
+		return nil, fmt.Errorf("dns answer %d does not match query %d", msg.ID, id)
+	}
+	return &msg, nil
+}
+
+// reconcile builds the upstreams from the targets last resolved and sends
+// what changed since the last time, callers must hold the lock
+func (dnsUpstreamLoader *DNSUpstreamLoader) reconcile() {
+	upstreams := make([]*Upstream, 0, len(dnsUpstreamLoader.names))
+	for _, name := range dnsUpstreamLoader.names {
+		upstream := &Upstream{
+			ServiceName:   name.serviceName,
+			FrontendProto: name.frontendProto,
+			FrontendIp:    dnsUpstreamLoader.DefaultUpstreamIp.String(),
+			FrontendPort:  name.frontendPort,
+			Targets:       make([]*Target, 0, len(dnsUpstreamLoader.resolved[name.serviceName])),
+		}
+		// targets are sorted by priority, the ones of a higher SRV priority
+		// are backups served only once no record of a lower one is left, as
+		// in RFC 2782
+		resolvedTargets := dnsUpstreamLoader.resolved[name.serviceName]
+		for _, resolved := range resolvedTargets {
+			if resolved.Priority != resolvedTargets[0].Priority {
+				break
+			}
+			target := *resolved
+			target.Upstream = upstream
+			upstream.Targets = append(upstream.Targets, &target)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	dnsUpstreamLoader.served.update(upstreams)
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) List() []*Upstream {
+	dnsUpstreamLoader.Lock()
+	defer dnsUpstreamLoader.Unlock()
+	return dnsUpstreamLoader.served.list()
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) Get(serviceName string) *Upstream {
+	dnsUpstreamLoader.Lock()
+	defer dnsUpstreamLoader.Unlock()
+	return dnsUpstreamLoader.served.get(serviceName)
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) Events() <-chan UpstreamEvent {
+	return dnsUpstreamLoader.served.events
+}
+
+func (dnsUpstreamLoader *DNSUpstreamLoader) Conflicts() []FrontendConflict {
+	dnsUpstreamLoader.Lock()
+	defer dnsUpstreamLoader.Unlock()
+	return dnsUpstreamLoader.served.conflictList()
+}
+
+// Reload warns about new dns settings, which require a restart
+func (dnsUpstreamLoader *DNSUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.DNSServer != dnsUpstreamLoader.Config.DNSServer || !reflect.DeepEqual(Config.DNSNames, dnsUpstreamLoader.Config.DNSNames) {
+		log.Warnf("dns server or names change requires a restart")
+	}
+}
+
+// targetsByPriority orders targets by SRV priority, the lowest first
+type targetsByPriority []*Target
+
+func (t targetsByPriority) Len() int      { return len(t) }
+func (t targetsByPriority) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t targetsByPriority) Less(i, j int) bool {
+	if t[i].Priority != t[j].Priority {
+		return t[i].Priority < t[j].Priority
+	}
+	return t[i].Addr() < t[j].Addr()
+}
+
+// srvWeight is the weight of a SRV record, one of 0 having a small share
+// of the requests as in RFC 2782 rather than none, capped at MAX_WEIGHT
+func srvWeight(weight uint16) int {
+	if weight == 0 {
+		return DEFAULT_WEIGHT
+	}
+	if weight > MAX_WEIGHT {
+		return MAX_WEIGHT
+	}
+	return int(weight)
+}
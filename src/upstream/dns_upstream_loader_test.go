@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers over udp with the records set for each name and type
+type fakeDNS struct {
+	conn        net.PacketConn
+	answers     map[string][]dnsmessage.Resource // name/type -> answers
+	additionals map[string][]dnsmessage.Resource
+	sync.Mutex
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	dns := &fakeDNS{conn: conn, answers: make(map[string][]dnsmessage.Resource), additionals: make(map[string][]dnsmessage.Resource)}
+	go dns.serve()
+	return dns
+}
+
+func (d *fakeDNS) set(name string, qtype dnsmessage.Type, answers []dnsmessage.Resource, additionals []dnsmessage.Resource) {
+	d.Lock()
+	d.answers[name+"/"+qtype.String()] = answers
+	d.additionals[name+"/"+qtype.String()] = additionals
+	d.Unlock()
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+		key := question.Name.String() + "/" + question.Type.String()
+
+		d.Lock()
+		answer := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: query.ID, Response: true},
+			Questions:   query.Questions,
+			Answers:     d.answers[key],
+			Additionals: d.additionals[key],
+		}
+		d.Unlock()
+
+		packed, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		d.conn.WriteTo(packed, addr)
+	}
+}
+
+func testSRV(name, target string, port, priority, weight uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: priority, Weight: weight},
+	}
+}
+
+func testA(name, ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func TestDNSUpstreamLoader(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.set("_http._tcp.web.example.com.", dnsmessage.TypeSRV, []dnsmessage.Resource{
+		testSRV("_http._tcp.web.example.com.", "web-1.example.com.", 8001, 10, 60, 60),
+		testSRV("_http._tcp.web.example.com.", "web-2.example.com.", 8002, 10, 40, 60),
+	}, []dnsmessage.Resource{
+		testA("web-1.example.com.", "10.0.0.1", 60),
+	})
+	// web-2 is not in the additionals, it is looked up
+	dns.set("web-2.example.com.", dnsmessage.TypeA, []dnsmessage.Resource{testA("web-2.example.com.", "10.0.0.2", 60)}, nil)
+	dns.set("api.example.com.", dnsmessage.TypeA, []dnsmessage.Resource{testA("api.example.com.", "10.0.0.3", 1)}, nil)
+
+	loader, err := InitDNSUpstreamLoader(config.Upstream{
+		DNSServer: dns.conn.LocalAddr().String(),
+		DNSNames: map[string]string{
+			"web": "srv://_http._tcp.web.example.com?frontend_port=8080",
+			"api": "host://api.example.com:9000?frontend_port=9090&frontend_proto=tcp",
+		},
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	added := make(map[string]*Upstream)
+	for len(added) < 2 {
+		event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+		added[event.Upstream.ServiceName] = event.Upstream
+	}
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	web := added["web"]
+	assert.Equal(t, web.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, len(web.Targets), 2)
+	assert.Equal(t, web.Targets[0].Addr(), "10.0.0.1:8001")
+	assert.Equal(t, web.Targets[0].Node, "web-1.example.com")
+	assert.Equal(t, web.Targets[0].Priority, 10)
+	assert.Equal(t, web.Targets[0].Weight, 60)
+	assert.Equal(t, web.Targets[1].Addr(), "10.0.0.2:8002")
+	assert.Equal(t, web.Targets[1].Weight, 40)
+
+	api := added["api"]
+	assert.Equal(t, api.Key(), UpstreamKey{Proto: "tcp", Ip: "127.0.0.1", Port: "9090"})
+	assert.Equal(t, api.Targets[0].Addr(), "10.0.0.3:9000")
+
+	// api expires after a second and is resolved again
+	dns.set("api.example.com.", dnsmessage.TypeA, []dnsmessage.Resource{testA("api.example.com.", "10.0.0.4", 1)}, nil)
+	event := waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+	assert.Equal(t, event.AddedTargets[0].Addr(), "10.0.0.4:9000")
+	assert.Equal(t, event.RemovedTargets[0].Addr(), "10.0.0.3:9000")
+}
+
+func TestDNSUpstreamLoaderPriority(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.set("_http._tcp.web.example.com.", dnsmessage.TypeSRV, []dnsmessage.Resource{
+		testSRV("_http._tcp.web.example.com.", "web-1.example.com.", 8001, 10, 1, 1),
+		testSRV("_http._tcp.web.example.com.", "web-2.example.com.", 8002, 10, 1, 1),
+		testSRV("_http._tcp.web.example.com.", "backup.example.com.", 8003, 20, 1, 1),
+	}, []dnsmessage.Resource{
+		testA("web-1.example.com.", "10.0.0.1", 1),
+		testA("web-2.example.com.", "10.0.0.2", 1),
+		testA("backup.example.com.", "10.0.0.3", 1),
+	})
+
+	loader, err := InitDNSUpstreamLoader(config.Upstream{
+		DNSServer: dns.conn.LocalAddr().String(),
+		DNSNames:  map[string]string{"web": "srv://_http._tcp.web.example.com?frontend_port=8080"},
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	// the backup of priority 20 gets no traffic while priority 10 has targets
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, len(event.Upstream.Targets), 2)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:8001")
+	assert.Equal(t, event.Upstream.Targets[1].Addr(), "10.0.0.2:8002")
+
+	// and takes over once they are gone
+	dns.set("_http._tcp.web.example.com.", dnsmessage.TypeSRV, []dnsmessage.Resource{
+		testSRV("_http._tcp.web.example.com.", "backup.example.com.", 8003, 20, 1, 1),
+	}, []dnsmessage.Resource{
+		testA("backup.example.com.", "10.0.0.3", 1),
+	})
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.3:8003")
+	assert.Equal(t, event.Upstream.Targets[0].Priority, 20)
+}
+
+func TestParseDNSName(t *testing.T) {
+	name, err := parseDNSName("web", "srv://_http._tcp.web.example.com?frontend_port=8080")
+	assert.Nil(t, err)
+	assert.Equal(t, name.name, "_http._tcp.web.example.com.")
+	assert.Equal(t, name.frontendProto, "http")
+
+	_, err = parseDNSName("web", "host://web.example.com?frontend_port=8080")
+	assert.NotNil(t, err)
+	_, err = parseDNSName("web", "srv://_http._tcp.web.example.com")
+	assert.NotNil(t, err)
+	_, err = parseDNSName("web", "dns://web.example.com:80?frontend_port=8080")
+	assert.NotNil(t, err)
+}
+
+func TestResolvConfServer(t *testing.T) {
+	assert.Equal(t, resolvConfServer("/nonexistent/resolv.conf"), DNS_DEFAULT_SERVER)
+}
@@ -0,0 +1,410 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// labels of the containers to serve, a container is served once it has
+	// a frontend port. The containers of a service share its name, the
+	// container name by default, and the port they serve on, their first
+	// exposed port by default
+	DOCKER_FRONTEND_PORT_LABEL  = "janitor.frontend.port"
+	DOCKER_FRONTEND_PROTO_LABEL = "janitor.frontend.proto"
+	DOCKER_SERVICE_NAME_LABEL   = "janitor.service.name"
+	DOCKER_TARGET_PORT_LABEL    = "janitor.target.port"
+
+	DOCKER_CONTAINERS_PATH = "/containers/json"
+	DOCKER_EVENTS_PATH     = "/events"
+	DOCKER_TIMEOUT         = time.Second * 30
+)
+
+// actions of the docker events telling nothing about the containers served
+var dockerIgnoredActions = map[string]bool{
+	"attach":         true,
+	"commit":         true,
+	"copy":           true,
+	"archive-path":   true,
+	"extract-to-dir": true,
+	"export":         true,
+	"resize":         true,
+	"top":            true,
+	"update":         true,
+}
+
+// DockerUpstreamLoader loads upstreams from the running containers of a
+// docker engine with a DOCKER_FRONTEND_PORT_LABEL. The containers are
+// listed on startup, then again on each event of a container or of a
+// network connection
+type DockerUpstreamLoader struct {
+	UpstreamLoader
+
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	baseURL      string
+	client       *http.Client
+	streamClient *http.Client
+	served       *upstreamSet
+	resync       chan bool
+	sync.Mutex
+
+	containers []dockerContainer // last listed
+}
+
+type dockerContainer struct {
+	ID      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	Created int64             `json:"Created"` // unix time
+	Labels  map[string]string `json:"Labels"`
+	State   string            `json:"State"`
+	Status  string            `json:"Status"`
+	Ports   []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+}
+
+func InitDockerUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*DockerUpstreamLoader, error) {
+	baseURL, transport, err := dockerTransport(Config.DockerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerUpstreamLoader := &DockerUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		baseURL:           baseURL,
+		client:            &http.Client{Transport: transport, Timeout: DOCKER_TIMEOUT},
+		streamClient:      &http.Client{Transport: transport},
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+		resync:            make(chan bool, 1),
+	}
+
+	dockerUpstreamLoader.triggerResync()
+	go dockerUpstreamLoader.Poll()
+	go dockerUpstreamLoader.followEvents()
+
+	return dockerUpstreamLoader, nil
+}
+
+// dockerTransport returns the base url of the docker api at addr, like
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375, and the transport
+// reaching it
+func dockerTransport(addr string) (string, *http.Transport, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}
+		return "http://docker", transport, nil
+	case "tcp", "http":
+		return "http://" + u.Host, &http.Transport{}, nil
+	case "https":
+		return "https://" + u.Host, &http.Transport{}, nil
+	default:
+		return "", nil, fmt.Errorf("docker address %s should be like unix:///var/run/docker.sock or tcp://host:2375", addr)
+	}
+}
+
+// Poll lists the containers whenever a resync is triggered, and applies
+// the overrides as soon as they change
+func (dockerUpstreamLoader *DockerUpstreamLoader) Poll() {
+	retry := newRetryDelay()
+	for {
+		select {
+		case <-dockerUpstreamLoader.resync:
+		case <-dockerUpstreamLoader.Overrides.ChangeNotify():
+			dockerUpstreamLoader.Lock()
+			dockerUpstreamLoader.reconcile()
+			dockerUpstreamLoader.Unlock()
+			continue
+		}
+
+		containers, err := dockerUpstreamLoader.listContainers()
+		if err != nil {
+			log.Errorf("list containers from docker got err: %s", err)
+			retry.Wait()
+			dockerUpstreamLoader.triggerResync()
+			continue
+		}
+		retry.Reset()
+
+		dockerUpstreamLoader.Lock()
+		dockerUpstreamLoader.containers = containers
+		dockerUpstreamLoader.reconcile()
+		dockerUpstreamLoader.served.synced()
+		dockerUpstreamLoader.Unlock()
+	}
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) triggerResync() {
+	select {
+	case dockerUpstreamLoader.resync <- true:
+	default:
+	}
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) listContainers() ([]dockerContainer, error) {
+	query := url.Values{}
+	query.Set("filters", fmt.Sprintf(`{"label":[%q]}`, DOCKER_FRONTEND_PORT_LABEL))
+
+	resp, err := dockerUpstreamLoader.client.Get(dockerUpstreamLoader.baseURL + DOCKER_CONTAINERS_PATH + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker answered %s", resp.Status)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// followEvents reads the events of docker and triggers a resync on every
+// event of a container or a network, and on every reconnection as events
+// might have been missed meanwhile
+func (dockerUpstreamLoader *DockerUpstreamLoader) followEvents() {
+	retry := newRetryDelay()
+	for {
+		err := dockerUpstreamLoader.readEvents(retry)
+		log.Errorf("docker event stream got err: %s", err)
+		retry.Wait()
+	}
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) readEvents(retry *retryDelay) error {
+	query := url.Values{}
+	query.Set("filters", `{"type":["container","network"]}`)
+
+	resp, err := dockerUpstreamLoader.streamClient.Get(dockerUpstreamLoader.baseURL + DOCKER_EVENTS_PATH + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker answered %s", resp.Status)
+	}
+
+	log.Infof("following the events of docker %s", dockerUpstreamLoader.Config.DockerAddr)
+	retry.Reset()
+	dockerUpstreamLoader.triggerResync()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("docker closed the event stream")
+			}
+			return err
+		}
+
+		// exec_start: sh and health_status: healthy carry an argument
+		action := strings.SplitN(event.Action, ":", 2)[0]
+		if dockerIgnoredActions[action] || strings.HasPrefix(action, "exec_") {
+			continue
+		}
+		log.Debugf("docker event %s %s", event.Type, event.Action)
+		dockerUpstreamLoader.triggerResync()
+	}
+}
+
+// reconcile builds the upstreams from the containers last listed and sends
+// what changed since the last time, callers must hold the lock
+func (dockerUpstreamLoader *DockerUpstreamLoader) reconcile() {
+	upstreams := make(map[string]*Upstream)
+	for _, container := range dockerUpstreamLoader.containers {
+		if container.Labels[DOCKER_FRONTEND_PORT_LABEL] == "" {
+			continue
+		}
+
+		serviceName := container.serviceName()
+		upstream, found := upstreams[serviceName]
+		if !found {
+			upstream = &Upstream{
+				ServiceName:   serviceName,
+				FrontendProto: container.Labels[DOCKER_FRONTEND_PROTO_LABEL],
+				FrontendIp:    dockerUpstreamLoader.DefaultUpstreamIp.String(),
+				FrontendPort:  container.Labels[DOCKER_FRONTEND_PORT_LABEL],
+				Targets:       make([]*Target, 0),
+			}
+			if upstream.FrontendProto == "" {
+				upstream.FrontendProto = "http"
+			}
+			upstreams[serviceName] = upstream
+		} else if upstream.FrontendPort != container.Labels[DOCKER_FRONTEND_PORT_LABEL] {
+			log.Warnf("container %s of %s has frontend port %s instead of %s, ignored", container.name(), serviceName, container.Labels[DOCKER_FRONTEND_PORT_LABEL], upstream.FrontendPort)
+			continue
+		}
+
+		// a service is registered since its oldest container
+		if created := uint64(container.Created); created > 0 && (upstream.RegisteredIndex == 0 || created < upstream.RegisteredIndex) {
+			upstream.RegisteredIndex = created
+		}
+		if target := container.target(upstream); target != nil {
+			upstream.Targets = append(upstream.Targets, target)
+		}
+	}
+
+	loaded := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		sort.Sort(targetsByAddr(upstream.Targets))
+		loaded = append(loaded, upstream)
+	}
+	dockerUpstreamLoader.served.update(loaded)
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) List() []*Upstream {
+	dockerUpstreamLoader.Lock()
+	defer dockerUpstreamLoader.Unlock()
+	return dockerUpstreamLoader.served.list()
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) Get(serviceName string) *Upstream {
+	dockerUpstreamLoader.Lock()
+	defer dockerUpstreamLoader.Unlock()
+	return dockerUpstreamLoader.served.get(serviceName)
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) Events() <-chan UpstreamEvent {
+	return dockerUpstreamLoader.served.events
+}
+
+func (dockerUpstreamLoader *DockerUpstreamLoader) Conflicts() []FrontendConflict {
+	dockerUpstreamLoader.Lock()
+	defer dockerUpstreamLoader.Unlock()
+	return dockerUpstreamLoader.served.conflictList()
+}
+
+// Reload warns about a new docker address, which requires a restart
+func (dockerUpstreamLoader *DockerUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.DockerAddr != dockerUpstreamLoader.Config.DockerAddr {
+		log.Warnf("docker address change from %s to %s requires a restart", dockerUpstreamLoader.Config.DockerAddr, Config.DockerAddr)
+	}
+}
+
+func (container dockerContainer) name() string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+func (container dockerContainer) serviceName() string {
+	if serviceName := container.Labels[DOCKER_SERVICE_NAME_LABEL]; serviceName != "" {
+		return serviceName
+	}
+	return container.name()
+}
+
+// target is where the container serves, on the host when its port is
+// published, on its network address otherwise. Containers starting or
+// failing their health check are left out
+func (container dockerContainer) target(upstream *Upstream) *Target {
+	if container.State != "running" || strings.Contains(container.Status, "(unhealthy)") || strings.Contains(container.Status, "(health: starting)") {
+		return nil
+	}
+
+	privatePort := 0
+	if label := container.Labels[DOCKER_TARGET_PORT_LABEL]; label != "" {
+		privatePort, _ = strconv.Atoi(label)
+	} else {
+		for _, port := range container.Ports {
+			if port.Type == "tcp" && (privatePort == 0 || port.PrivatePort < privatePort) {
+				privatePort = port.PrivatePort
+			}
+		}
+	}
+	if privatePort == 0 {
+		log.Warnf("container %s of %s exposes no port, set %s", container.name(), upstream.ServiceName, DOCKER_TARGET_PORT_LABEL)
+		return nil
+	}
+
+	address, port := "", ""
+	for _, p := range container.Ports {
+		if p.PrivatePort == privatePort && p.PublicPort != 0 && p.Type == "tcp" {
+			address, port = p.IP, strconv.Itoa(p.PublicPort)
+			if address == "" || address == "0.0.0.0" || address == "::" {
+				address = "127.0.0.1"
+			}
+			break
+		}
+	}
+	if address == "" {
+		address, port = container.networkAddress(), strconv.Itoa(privatePort)
+	}
+	if address == "" {
+		log.Warnf("container %s of %s has neither a published port nor a network address", container.name(), upstream.ServiceName)
+		return nil
+	}
+
+	return &Target{
+		Address:        address,
+		ServiceName:    upstream.ServiceName,
+		ServiceID:      container.name(),
+		ServiceAddress: address,
+		ServicePort:    port,
+		Weight:         DEFAULT_WEIGHT,
+		Upstream:       upstream,
+	}
+}
+
+// networkAddress is the address of the container on its first network by
+// name
+func (container dockerContainer) networkAddress() string {
+	names := make([]string, 0, len(container.NetworkSettings.Networks))
+	for name := range container.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ip := container.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDocker serves containers on a unix socket, and streams the events
+// pushed to it
+type fakeDocker struct {
+	containers string
+	events     chan string
+	sync.Mutex
+}
+
+func (d *fakeDocker) setContainers(containers string) {
+	d.Lock()
+	d.containers = containers
+	d.Unlock()
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/containers/json":
+		d.Lock()
+		defer d.Unlock()
+		fmt.Fprint(w, d.containers)
+	case "/events":
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-d.events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const testDockerContainers = `[
+  {"Id": "a1", "Names": ["/web-1"], "State": "running", "Status": "Up 2 minutes (healthy)",
+   "Labels": {"janitor.frontend.port": "8080", "janitor.service.name": "web"},
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 32768, "Type": "tcp"}, {"PrivatePort": 443, "Type": "tcp"}]},
+  {"Id": "a2", "Names": ["/web-2"], "State": "running", "Status": "Up 1 second (health: starting)",
+   "Labels": {"janitor.frontend.port": "8080", "janitor.service.name": "web"},
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 32769, "Type": "tcp"}]},
+  {"Id": "b1", "Names": ["/api"], "State": "running", "Status": "Up 5 minutes",
+   "Labels": {"janitor.frontend.port": "9090", "janitor.frontend.proto": "tcp", "janitor.target.port": "9000"},
+   "Ports": [{"PrivatePort": 9000, "Type": "tcp"}, {"PrivatePort": 22, "Type": "tcp"}],
+   "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}}
+]`
+
+func TestDockerUpstreamLoader(t *testing.T) {
+	docker := &fakeDocker{containers: testDockerContainers, events: make(chan string)}
+	server := httptest.NewUnstartedServer(docker)
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(func() {
+		// the event stream stays open, cut it before closing
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	loader, err := InitDockerUpstreamLoader(config.Upstream{DockerAddr: "unix://" + socket}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "tcp", Ip: "127.0.0.1", Port: "9090"})
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "172.17.0.3:9000")
+
+	event = waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web")
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "127.0.0.1:32768")
+	assert.Equal(t, event.Upstream.Targets[0].ServiceID, "web-1")
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// web-2 turns healthy and api is gone
+	docker.setContainers(`[
+  {"Id": "a1", "Names": ["/web-1"], "State": "running", "Status": "Up 2 minutes (healthy)",
+   "Labels": {"janitor.frontend.port": "8080", "janitor.service.name": "web"},
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 32768, "Type": "tcp"}]},
+  {"Id": "a2", "Names": ["/web-2"], "State": "running", "Status": "Up 30 seconds (healthy)",
+   "Labels": {"janitor.frontend.port": "8080", "janitor.service.name": "web"},
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 32769, "Type": "tcp"}]}
+]`)
+	select {
+	case docker.events <- `{"Type": "container", "Action": "health_status: healthy", "Actor": {"ID": "a2"}}`:
+	case <-time.After(time.Second * 5):
+		t.Fatal("events not followed")
+	}
+
+	event = waitEvent(t, loader, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.AddedTargets), 1)
+	assert.Equal(t, event.AddedTargets[0].Addr(), "127.0.0.1:32769")
+}
+
+func TestDockerTransport(t *testing.T) {
+	baseURL, _, err := dockerTransport("tcp://10.0.0.1:2375")
+	assert.Nil(t, err)
+	assert.Equal(t, baseURL, "http://10.0.0.1:2375")
+
+	_, _, err = dockerTransport("10.0.0.1:2375")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,368 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ETCD_RANGE_PATH = "/v3/kv/range"
+	ETCD_WATCH_PATH = "/v3/watch"
+	ETCD_TIMEOUT    = time.Second * 30
+
+	// keys of a service under the prefix, <service>/frontend and
+	// <service>/targets/<id>
+	ETCD_FRONTEND_KEY = "frontend"
+	ETCD_TARGETS_KEY  = "targets"
+)
+
+// errEtcdCompacted tells that a watch fell behind the revisions kept by
+// etcd, the prefix has to be listed again
+var errEtcdCompacted = errors.New("revision has been compacted")
+
+// EtcdUpstreamLoader loads upstreams from the keys of etcd v3 under
+// EtcdPrefix, through the json gateway of etcd. A service is described by
+//
+//	<prefix>web/frontend      {"frontend_proto": "http", "frontend_port": 8080}
+//	<prefix>web/targets/web-1 {"address": "10.0.0.1", "port": 80}
+//
+// with the fields of the upstream files. Targets are usually put with a
+// lease, so that they are deleted when their instance stops renewing it.
+// The prefix is listed, then watched from the revision listed
+type EtcdUpstreamLoader struct {
+	UpstreamLoader
+
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	client       *http.Client
+	streamClient *http.Client
+	served       *upstreamSet
+	changed      chan bool
+	sync.Mutex
+
+	kvs    map[string]etcdKeyValue // key under the prefix -> value
+	listed bool
+}
+
+type etcdKeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end"`
+		StartRevision int64  `json:"start_revision,string"`
+	} `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision int64      `json:"compact_revision,string"`
+		CancelReason    string     `json:"cancel_reason"`
+		Events          []struct {
+			Type string       `json:"type"` // PUT is left out as the default
+			Kv   etcdKeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func InitEtcdUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*EtcdUpstreamLoader, error) {
+	etcdUpstreamLoader := &EtcdUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		client:            &http.Client{Timeout: ETCD_TIMEOUT},
+		streamClient:      &http.Client{},
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+		changed:           make(chan bool, 1),
+		kvs:               make(map[string]etcdKeyValue),
+	}
+
+	go etcdUpstreamLoader.Poll()
+	go etcdUpstreamLoader.follow()
+
+	return etcdUpstreamLoader, nil
+}
+
+// Poll rebuilds the upstreams whenever the keys or the overrides change,
+// once the prefix has been listed
+func (etcdUpstreamLoader *EtcdUpstreamLoader) Poll() {
+	for {
+		select {
+		case <-etcdUpstreamLoader.changed:
+		case <-etcdUpstreamLoader.Overrides.ChangeNotify():
+		}
+
+		etcdUpstreamLoader.Lock()
+		if etcdUpstreamLoader.listed {
+			etcdUpstreamLoader.reconcile()
+			etcdUpstreamLoader.served.synced()
+		}
+		etcdUpstreamLoader.Unlock()
+	}
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) notifyChanged() {
+	select {
+	case etcdUpstreamLoader.changed <- true:
+	default:
+	}
+}
+
+// follow lists the prefix then watches it from the next revision, the
+// prefix is listed again after a compaction or any error
+func (etcdUpstreamLoader *EtcdUpstreamLoader) follow() {
+	retry := newRetryDelay()
+	for {
+		revision, err := etcdUpstreamLoader.list()
+		if err != nil {
+			log.Errorf("list %s from etcd got err: %s", etcdUpstreamLoader.Config.EtcdPrefix, err)
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
+
+		for err == nil {
+			revision, err = etcdUpstreamLoader.watch(revision)
+		}
+		if err == errEtcdCompacted {
+			log.Infof("watch %s from etcd: %s, list it again", etcdUpstreamLoader.Config.EtcdPrefix, err)
+			continue
+		}
+		log.Errorf("watch %s from etcd got err: %s", etcdUpstreamLoader.Config.EtcdPrefix, err)
+		retry.Wait()
+	}
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) list() (int64, error) {
+	prefix := []byte(etcdUpstreamLoader.Config.EtcdPrefix)
+	resp, err := etcdUpstreamLoader.post(etcdUpstreamLoader.client, ETCD_RANGE_PATH, etcdRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var ranged etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ranged); err != nil {
+		return 0, err
+	}
+
+	kvs := make(map[string]etcdKeyValue, len(ranged.Kvs))
+	for _, kv := range ranged.Kvs {
+		kvs[string(kv.Key)] = kv
+	}
+
+	etcdUpstreamLoader.Lock()
+	etcdUpstreamLoader.kvs = kvs
+	etcdUpstreamLoader.listed = true
+	etcdUpstreamLoader.Unlock()
+	etcdUpstreamLoader.notifyChanged()
+
+	return ranged.Header.Revision, nil
+}
+
+// watch applies the changes after revision until etcd ends the watch, and
+// returns the last revision seen
+func (etcdUpstreamLoader *EtcdUpstreamLoader) watch(revision int64) (int64, error) {
+	prefix := []byte(etcdUpstreamLoader.Config.EtcdPrefix)
+	var request etcdWatchRequest
+	request.CreateRequest.Key = prefix
+	request.CreateRequest.RangeEnd = prefixEnd(prefix)
+	request.CreateRequest.StartRevision = revision + 1
+
+	resp, err := etcdUpstreamLoader.post(etcdUpstreamLoader.streamClient, ETCD_WATCH_PATH, request)
+	if err != nil {
+		return revision, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var watched etcdWatchResponse
+		if err := decoder.Decode(&watched); err != nil {
+			if err == io.EOF {
+				return revision, nil
+			}
+			return revision, err
+		}
+
+		switch {
+		case watched.Error != nil:
+			return revision, fmt.Errorf("etcd answered %s", watched.Error.Message)
+		case watched.Result == nil:
+			continue
+		case watched.Result.CompactRevision > 0:
+			return revision, errEtcdCompacted
+		case watched.Result.Canceled:
+			return revision, fmt.Errorf("etcd canceled the watch: %s", watched.Result.CancelReason)
+		}
+
+		if len(watched.Result.Events) == 0 {
+			continue
+		}
+
+		etcdUpstreamLoader.Lock()
+		for _, event := range watched.Result.Events {
+			// a target whose lease expired is deleted by etcd itself
+			if event.Type == "DELETE" {
+				delete(etcdUpstreamLoader.kvs, string(event.Kv.Key))
+			} else {
+				etcdUpstreamLoader.kvs[string(event.Kv.Key)] = event.Kv
+			}
+			if event.Kv.ModRevision > revision {
+				revision = event.Kv.ModRevision
+			}
+		}
+		etcdUpstreamLoader.Unlock()
+		etcdUpstreamLoader.notifyChanged()
+	}
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) post(client *http.Client, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(strings.TrimRight(etcdUpstreamLoader.Config.EtcdAddr, "/")+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// prefixEnd is the end of the range of the keys starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] = end[i] + 1
+			return end[:i+1]
+		}
+	}
+	// every key
+	return []byte{0}
+}
+
+// reconcile builds the upstreams from the keys and sends what changed
+// since the last time, callers must hold the lock
+func (etcdUpstreamLoader *EtcdUpstreamLoader) reconcile() {
+	frontends := make(map[string]*fileUpstream)
+	registered := make(map[string]int64) // service name -> create revision of its frontend
+	targets := make(map[string][]fileTarget)
+
+	keys := make([]string, 0, len(etcdUpstreamLoader.kvs))
+	for key := range etcdUpstreamLoader.kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, etcdUpstreamLoader.Config.EtcdPrefix), "/")
+		kv := etcdUpstreamLoader.kvs[key]
+
+		switch {
+		case len(parts) == 2 && parts[1] == ETCD_FRONTEND_KEY:
+			frontend := &fileUpstream{}
+			if err := json.Unmarshal(kv.Value, frontend); err != nil {
+				log.Warnf("etcd key %s is not a frontend: %s", key, err)
+				continue
+			}
+			frontend.ServiceName = parts[0]
+			frontends[parts[0]] = frontend
+			registered[parts[0]] = kv.CreateRevision
+		case len(parts) == 3 && parts[1] == ETCD_TARGETS_KEY:
+			var target fileTarget
+			if err := json.Unmarshal(kv.Value, &target); err != nil {
+				log.Warnf("etcd key %s is not a target: %s", key, err)
+				continue
+			}
+			targets[parts[0]] = append(targets[parts[0]], target)
+		}
+	}
+
+	upstreams := make([]*Upstream, 0, len(frontends))
+	for serviceName, frontend := range frontends {
+		frontend.Targets = targets[serviceName]
+		if err := frontend.validate(); err != nil {
+			log.Warnf("etcd service %s is ignored: %s", serviceName, err)
+			continue
+		}
+		upstream := frontend.build(etcdUpstreamLoader.DefaultUpstreamIp.String())
+		upstream.RegisteredIndex = uint64(registered[serviceName])
+		upstreams = append(upstreams, upstream)
+	}
+	etcdUpstreamLoader.served.update(upstreams)
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) List() []*Upstream {
+	etcdUpstreamLoader.Lock()
+	defer etcdUpstreamLoader.Unlock()
+	return etcdUpstreamLoader.served.list()
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) Get(serviceName string) *Upstream {
+	etcdUpstreamLoader.Lock()
+	defer etcdUpstreamLoader.Unlock()
+	return etcdUpstreamLoader.served.get(serviceName)
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) Events() <-chan UpstreamEvent {
+	return etcdUpstreamLoader.served.events
+}
+
+func (etcdUpstreamLoader *EtcdUpstreamLoader) Conflicts() []FrontendConflict {
+	etcdUpstreamLoader.Lock()
+	defer etcdUpstreamLoader.Unlock()
+	return etcdUpstreamLoader.served.conflictList()
+}
+
+// Reload warns about a new etcd address or prefix, which require a restart
+func (etcdUpstreamLoader *EtcdUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.EtcdAddr != etcdUpstreamLoader.Config.EtcdAddr || Config.EtcdPrefix != etcdUpstreamLoader.Config.EtcdPrefix {
+		log.Warnf("etcd address or prefix change requires a restart")
+	}
+}
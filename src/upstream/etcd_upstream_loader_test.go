@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcd serves ranges of its keys at its revision, and streams the
+// watch responses pushed to it
+type fakeEtcd struct {
+	kvs      map[string]string
+	revision int64
+	watched  chan int64 // start revision of each watch
+	watches  chan string
+	sync.Mutex
+}
+
+func newFakeEtcd(kvs map[string]string, revision int64) *fakeEtcd {
+	return &fakeEtcd{kvs: kvs, revision: revision, watched: make(chan int64, 8), watches: make(chan string)}
+}
+
+func (e *fakeEtcd) set(kvs map[string]string, revision int64) {
+	e.Lock()
+	e.kvs = kvs
+	e.revision = revision
+	e.Unlock()
+}
+
+func (e *fakeEtcd) push(t *testing.T, response string) {
+	select {
+	case e.watches <- response:
+	case <-time.After(time.Second * 5):
+		t.Fatal("prefix not watched")
+	}
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var request etcdRangeRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		e.Lock()
+		defer e.Unlock()
+		response := etcdRangeResponse{Header: etcdHeader{Revision: e.revision}}
+		for key, value := range e.kvs {
+			if strings.HasPrefix(key, string(request.Key)) {
+				response.Kvs = append(response.Kvs, etcdKeyValue{Key: []byte(key), Value: []byte(value)})
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	case "/v3/watch":
+		var request etcdWatchRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		e.watched <- request.CreateRequest.StartRevision
+
+		fmt.Fprintln(w, `{"result": {"header": {"revision": "1"}, "created": true}}`)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case response := <-e.watches:
+				fmt.Fprintln(w, response)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdUpstreamLoader(t *testing.T) {
+	etcd := newFakeEtcd(map[string]string{
+		"/janitor/upstreams/web/frontend":      `{"frontend_port": 8080}`,
+		"/janitor/upstreams/web/targets/web-1": `{"address": "10.0.0.1", "port": 80}`,
+		"/janitor/upstreams/db/targets/db-1":   `{"address": "10.0.0.9", "port": 5432}`,
+		"/other/web/frontend":                  `{"frontend_port": 9999}`,
+	}, 10)
+	server := httptest.NewServer(etcd)
+	t.Cleanup(func() {
+		// the watch stays open, cut it before closing
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	loader, err := InitEtcdUpstreamLoader(config.Upstream{EtcdAddr: server.URL, EtcdPrefix: "/janitor/upstreams/"}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:80")
+	waitEvent(t, loader, EVENT_SYNCED)
+	assert.Equal(t, len(loader.List()), 1)
+	assert.Equal(t, <-etcd.watched, int64(11))
+
+	etcd.push(t, `{"result": {"header": {"revision": "11"}, "events": [
+  {"kv": {"key": "L2phbml0b3IvdXBzdHJlYW1zL3dlYi90YXJnZXRzL3dlYi0y", "value": "eyJhZGRyZXNzIjogIjEwLjAuMC4yIiwgInBvcnQiOiA4MH0=", "mod_revision": "11", "lease": "7587"}}
+]}}`)
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, event.AddedTargets[0].Addr(), "10.0.0.2:80")
+
+	// the lease of web-1 expired
+	etcd.push(t, `{"result": {"header": {"revision": "12"}, "events": [
+  {"type": "DELETE", "kv": {"key": "L2phbml0b3IvdXBzdHJlYW1zL3dlYi90YXJnZXRzL3dlYi0x", "mod_revision": "12"}}
+]}}`)
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.AddedTargets), 0)
+	assert.Equal(t, event.RemovedTargets[0].Addr(), "10.0.0.1:80")
+
+	// a compaction lists the prefix again
+	etcd.set(map[string]string{
+		"/janitor/upstreams/web/frontend":      `{"frontend_port": 8080}`,
+		"/janitor/upstreams/web/targets/web-2": `{"address": "10.0.0.2", "port": 80}`,
+		"/janitor/upstreams/api/frontend":      `{"frontend_proto": "tcp", "frontend_port": "9090"}`,
+		"/janitor/upstreams/api/targets/api-1": `{"address": "10.0.0.3", "port": 9000}`,
+	}, 30)
+	etcd.push(t, `{"result": {"header": {"revision": "30"}, "canceled": true, "compact_revision": "20"}}`)
+	event = waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "tcp", Ip: "127.0.0.1", Port: "9090"})
+	assert.Equal(t, <-etcd.watched, int64(31))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, prefixEnd([]byte("/janitor/")), []byte("/janitor0"))
+	assert.Equal(t, prefixEnd([]byte{'a', 0xff}), []byte("b"))
+}
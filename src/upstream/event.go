@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"sort"
+)
+
+type UpstreamEventType string
+
+const (
+	EVENT_UPSTREAM_ADDED   UpstreamEventType = "UpstreamAdded"
+	EVENT_UPSTREAM_REMOVED UpstreamEventType = "UpstreamRemoved"
+	EVENT_TARGETS_CHANGED  UpstreamEventType = "TargetsChanged"
+	EVENT_FRONTEND_CHANGED UpstreamEventType = "FrontendChanged"
+
+	// a frontend claimed by several services, sent when found or when the
+	// services claiming it change
+	EVENT_FRONTEND_CONFLICT UpstreamEventType = "FrontendConflict"
+
+	// sent once, after the events of the first complete load
+	EVENT_SYNCED UpstreamEventType = "Synced"
+)
+
+// UpstreamEvent is a change of one upstream found by an upstream loader
+type UpstreamEvent struct {
+	Type     UpstreamEventType
+	Upstream *Upstream
+
+	// the upstream as it was before a FrontendChanged
+	Previous *Upstream
+
+	// targets of a TargetsChanged
+	AddedTargets   []*Target
+	RemovedTargets []*Target
+
+	// the conflict of a FrontendConflict, Upstream is nil
+	Conflict *FrontendConflict
+}
+
+// DiffUpstreams returns the events turning current into latest, both keyed
+// by service name, the routes and settings of an upstream being part of
+// its frontend. Removals come first so that the frontends they free are
+// available to the other events
+func DiffUpstreams(current, latest map[string]*Upstream) []UpstreamEvent {
+	events := make([]UpstreamEvent, 0)
+
+	for _, serviceName := range sortedServiceNames(current) {
+		if _, found := latest[serviceName]; !found {
+			events = append(events, UpstreamEvent{Type: EVENT_UPSTREAM_REMOVED, Upstream: current[serviceName]})
+		}
+	}
+
+	for _, serviceName := range sortedServiceNames(latest) {
+		latestUpstream := latest[serviceName]
+		currentUpstream, found := current[serviceName]
+
+		switch {
+		case !found:
+			events = append(events, UpstreamEvent{Type: EVENT_UPSTREAM_ADDED, Upstream: latestUpstream})
+		case currentUpstream.Key() != latestUpstream.Key() || !currentUpstream.RoutesEqual(latestUpstream) || !currentUpstream.SettingsEqual(latestUpstream):
+			events = append(events, UpstreamEvent{Type: EVENT_FRONTEND_CHANGED, Upstream: latestUpstream, Previous: currentUpstream})
+		default:
+			added, removed := diffTargets(currentUpstream.Targets, latestUpstream.Targets)
+			if len(added) > 0 || len(removed) > 0 {
+				events = append(events, UpstreamEvent{
+					Type:           EVENT_TARGETS_CHANGED,
+					Upstream:       latestUpstream,
+					AddedTargets:   added,
+					RemovedTargets: removed,
+				})
+			}
+		}
+	}
+
+	return events
+}
+
+func diffTargets(current, latest []*Target) (added, removed []*Target) {
+	currentTargets := make(map[string]bool, len(current))
+	for _, t := range current {
+		currentTargets[t.ToString()] = true
+	}
+	latestTargets := make(map[string]bool, len(latest))
+	for _, t := range latest {
+		latestTargets[t.ToString()] = true
+		if !currentTargets[t.ToString()] {
+			added = append(added, t)
+		}
+	}
+	for _, t := range current {
+		if !latestTargets[t.ToString()] {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+func sortedServiceNames(upstreams map[string]*Upstream) []string {
+	serviceNames := make([]string, 0, len(upstreams))
+	for serviceName := range upstreams {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	return serviceNames
+}
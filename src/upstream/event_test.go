@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testUpstream(serviceName, port string, targetAddrs ...string) *Upstream {
+	u := &Upstream{ServiceName: serviceName, FrontendProto: "http", FrontendIp: "127.0.0.1", FrontendPort: port}
+	for _, addr := range targetAddrs {
+		u.Targets = append(u.Targets, &Target{ServiceName: serviceName, ServiceAddress: addr, ServicePort: "80", Upstream: u})
+	}
+	return u
+}
+
+func TestDiffUpstreams(t *testing.T) {
+	current := map[string]*Upstream{
+		"mesos":    testUpstream("mesos", "5050", "10.0.0.1"),
+		"marathon": testUpstream("marathon", "8080", "10.0.0.1", "10.0.0.2"),
+		"chronos":  testUpstream("chronos", "4400", "10.0.0.1"),
+	}
+	latest := map[string]*Upstream{
+		"mesos":    testUpstream("mesos", "5050", "10.0.0.1"),
+		"marathon": testUpstream("marathon", "8080", "10.0.0.2", "10.0.0.3"),
+		"chronos":  testUpstream("chronos", "4401", "10.0.0.1"),
+		"consul":   testUpstream("consul", "8500", "10.0.0.1"),
+	}
+	delete(latest, "mesos")
+
+	events := DiffUpstreams(current, latest)
+	assert.Equal(t, len(events), 4)
+
+	assert.Equal(t, events[0].Type, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, events[0].Upstream, current["mesos"])
+
+	assert.Equal(t, events[1].Type, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, events[1].Previous, current["chronos"])
+	assert.Equal(t, events[1].Upstream, latest["chronos"])
+
+	assert.Equal(t, events[2].Type, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, events[2].Upstream, latest["consul"])
+
+	assert.Equal(t, events[3].Type, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(events[3].AddedTargets), 1)
+	assert.Equal(t, events[3].AddedTargets[0].Addr(), "10.0.0.3:80")
+	assert.Equal(t, len(events[3].RemovedTargets), 1)
+	assert.Equal(t, events[3].RemovedTargets[0].Addr(), "10.0.0.1:80")
+}
+
+func TestDiffUpstreamsUnchanged(t *testing.T) {
+	current := map[string]*Upstream{"mesos": testUpstream("mesos", "5050", "10.0.0.1")}
+	latest := map[string]*Upstream{"mesos": testUpstream("mesos", "5050", "10.0.0.1")}
+	assert.Equal(t, len(DiffUpstreams(current, latest)), 0)
+}
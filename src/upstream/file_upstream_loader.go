@@ -0,0 +1,372 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// FileUpstreamLoader loads upstreams from a toml, yaml or json file, or
+// from every such file of a directory, and loads them again when a file
+// is added, removed or modified. A file lists upstreams like
+//
+//	[[upstreams]]
+//	service_name = "web"
+//	frontend_proto = "http"
+//	frontend_port = 8080
+//
+//	  [[upstreams.targets]]
+//	  address = "10.0.0.1"
+//	  port = 80
+//
+//	    [upstreams.targets.metadata]
+//	    zone = "a"
+//
+// frontend_ip defaults to the listener ip and frontend_proto to http
+type FileUpstreamLoader struct {
+	UpstreamLoader
+
+	PollTicker        *time.Ticker
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	served *upstreamSet
+	sync.Mutex
+
+	// files last loaded, and the upstreams read from them
+	fingerprint string
+	loaded      []fileUpstream
+}
+
+type fileUpstreams struct {
+	Upstreams []fileUpstream `json:"upstreams"`
+}
+
+type fileUpstream struct {
+	ServiceName   string       `json:"service_name"`
+	FrontendProto string       `json:"frontend_proto"`
+	FrontendIp    string       `json:"frontend_ip"`
+	FrontendPort  flexString   `json:"frontend_port"`
+	Targets       []fileTarget `json:"targets"`
+}
+
+type fileTarget struct {
+	Address  string            `json:"address"`
+	Port     flexString        `json:"port"`
+	Metadata map[string]string `json:"metadata"`
+	Weight   *int              `json:"weight"` // DEFAULT_WEIGHT when not set or out of bounds
+}
+
+// flexString accepts a port written as a number as well as a string, and
+// null as an empty one
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+	case string:
+		*s = flexString(v)
+	case float64:
+		*s = flexString(data)
+	default:
+		return fmt.Errorf("%s should be a string or a number", data)
+	}
+	return nil
+}
+
+func InitFileUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*FileUpstreamLoader, error) {
+	fileUpstreamLoader := &FileUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+	}
+
+	// a broken file on startup is a mistake worth to stop for
+	if err := fileUpstreamLoader.load(); err != nil {
+		return nil, err
+	}
+	fileUpstreamLoader.Lock()
+	fileUpstreamLoader.served.synced()
+	fileUpstreamLoader.Unlock()
+
+	fileUpstreamLoader.PollTicker = time.NewTicker(Config.FileInterval)
+	go fileUpstreamLoader.Poll()
+
+	return fileUpstreamLoader, nil
+}
+
+// Poll checks the files on each tick of PollTicker, and applies the
+// overrides as soon as they change
+func (fileUpstreamLoader *FileUpstreamLoader) Poll() {
+	for {
+		select {
+		case <-fileUpstreamLoader.PollTicker.C:
+			if err := fileUpstreamLoader.load(); err != nil {
+				log.Errorf("load upstreams from %s got err, keep the ones loaded before: %s", fileUpstreamLoader.Config.FilePath, err)
+			}
+		case <-fileUpstreamLoader.Overrides.ChangeNotify():
+			fileUpstreamLoader.Lock()
+			fileUpstreamLoader.reconcile()
+			fileUpstreamLoader.Unlock()
+		}
+	}
+}
+
+// load reads the files again if any of them changed since the last time
+func (fileUpstreamLoader *FileUpstreamLoader) load() error {
+	paths, err := upstreamFiles(fileUpstreamLoader.Config.FilePath)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := filesFingerprint(paths)
+	if err != nil {
+		return err
+	}
+
+	fileUpstreamLoader.Lock()
+	defer fileUpstreamLoader.Unlock()
+	if fingerprint == fileUpstreamLoader.fingerprint {
+		return nil
+	}
+
+	loaded := make([]fileUpstream, 0)
+	serviceFiles := make(map[string]string)
+	for _, path := range paths {
+		upstreams, err := readUpstreamFile(path)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range upstreams {
+			if err := u.validate(); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			if file, found := serviceFiles[u.ServiceName]; found {
+				return fmt.Errorf("%s: service %s is already defined in %s", path, u.ServiceName, file)
+			}
+			serviceFiles[u.ServiceName] = path
+			loaded = append(loaded, u)
+		}
+	}
+
+	log.Infof("loaded %d upstreams from %s", len(loaded), fileUpstreamLoader.Config.FilePath)
+	fileUpstreamLoader.fingerprint = fingerprint
+	fileUpstreamLoader.loaded = loaded
+	fileUpstreamLoader.reconcile()
+	return nil
+}
+
+// reconcile builds the upstreams last loaded and sends what changed since
+// the last time, callers must hold the lock
+func (fileUpstreamLoader *FileUpstreamLoader) reconcile() {
+	upstreams := make([]*Upstream, 0, len(fileUpstreamLoader.loaded))
+	for _, u := range fileUpstreamLoader.loaded {
+		upstreams = append(upstreams, u.build(fileUpstreamLoader.DefaultUpstreamIp.String()))
+	}
+	fileUpstreamLoader.served.update(upstreams)
+}
+
+func (fileUpstreamLoader *FileUpstreamLoader) List() []*Upstream {
+	fileUpstreamLoader.Lock()
+	defer fileUpstreamLoader.Unlock()
+	return fileUpstreamLoader.served.list()
+}
+
+func (fileUpstreamLoader *FileUpstreamLoader) Get(serviceName string) *Upstream {
+	fileUpstreamLoader.Lock()
+	defer fileUpstreamLoader.Unlock()
+	return fileUpstreamLoader.served.get(serviceName)
+}
+
+func (fileUpstreamLoader *FileUpstreamLoader) Events() <-chan UpstreamEvent {
+	return fileUpstreamLoader.served.events
+}
+
+func (fileUpstreamLoader *FileUpstreamLoader) Conflicts() []FrontendConflict {
+	fileUpstreamLoader.Lock()
+	defer fileUpstreamLoader.Unlock()
+	return fileUpstreamLoader.served.conflictList()
+}
+
+// Reload applies a new poll interval, switching to another path requires
+// a restart
+func (fileUpstreamLoader *FileUpstreamLoader) Reload(Config config.Upstream) {
+	fileUpstreamLoader.Lock()
+	defer fileUpstreamLoader.Unlock()
+
+	if Config.FilePath != fileUpstreamLoader.Config.FilePath {
+		log.Warnf("upstream file path change from %s to %s requires a restart", fileUpstreamLoader.Config.FilePath, Config.FilePath)
+	}
+	if Config.FileInterval != fileUpstreamLoader.Config.FileInterval {
+		log.Infof("upstream file check interval changed to %s", Config.FileInterval)
+		fileUpstreamLoader.PollTicker.Reset(Config.FileInterval)
+		fileUpstreamLoader.Config.FileInterval = Config.FileInterval
+	}
+}
+
+func (u fileUpstream) validate() error {
+	if u.ServiceName == "" {
+		return fmt.Errorf("service_name is required")
+	}
+	if u.FrontendPort == "" {
+		return fmt.Errorf("frontend_port of %s is required", u.ServiceName)
+	}
+	for _, t := range u.Targets {
+		if t.Address == "" || t.Port == "" {
+			return fmt.Errorf("address and port of the targets of %s are required", u.ServiceName)
+		}
+	}
+	return nil
+}
+
+func (u fileUpstream) build(defaultUpstreamIp string) *Upstream {
+	upstream := &Upstream{
+		ServiceName:   u.ServiceName,
+		FrontendProto: u.FrontendProto,
+		FrontendIp:    u.FrontendIp,
+		FrontendPort:  string(u.FrontendPort),
+		Targets:       make([]*Target, 0, len(u.Targets)),
+	}
+	if upstream.FrontendProto == "" {
+		upstream.FrontendProto = "http"
+	}
+	if upstream.FrontendIp == "" {
+		upstream.FrontendIp = defaultUpstreamIp
+	}
+
+	for _, t := range u.Targets {
+		weight := DEFAULT_WEIGHT
+		if t.Weight != nil && ValidateWeight(*t.Weight) == nil {
+			weight = *t.Weight
+		}
+		upstream.Targets = append(upstream.Targets, &Target{
+			ServiceName:    u.ServiceName,
+			ServiceID:      fmt.Sprintf("%s-%s", u.ServiceName, net.JoinHostPort(t.Address, string(t.Port))),
+			ServiceAddress: t.Address,
+			ServicePort:    string(t.Port),
+			Metadata:       t.Metadata,
+			Weight:         weight,
+			Upstream:       upstream,
+		})
+	}
+	return upstream
+}
+
+// upstreamFiles returns path, or the toml, yaml and json files of the
+// directory path ordered by name
+func upstreamFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, info := range infos {
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".toml", ".yml", ".yaml", ".json":
+			if !info.IsDir() {
+				paths = append(paths, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// filesFingerprint changes whenever a file is added, removed or modified
+func filesFingerprint(paths []string) (string, error) {
+	parts := make([]string, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// readUpstreamFile decodes toml and yaml files into generic values first,
+// so that the json tags of fileUpstream work for every format
+func readUpstreamFile(path string) ([]fileUpstream, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		raw = make(map[string]interface{})
+		_, err = toml.Decode(string(data), &raw)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &raw)
+		raw = stringKeys(raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported upstream file format %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream file %s: %s", path, err)
+	}
+
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream file %s: %s", path, err)
+	}
+	var upstreams fileUpstreams
+	if err := json.Unmarshal(normalized, &upstreams); err != nil {
+		return nil, fmt.Errorf("parse upstream file %s: %s", path, err)
+	}
+	return upstreams.Upstreams, nil
+}
+
+// stringKeys turns the maps decoded from yaml into maps json can encode
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = stringKeys(val)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
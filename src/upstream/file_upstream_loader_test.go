@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tomlUpstreams = `
+[[upstreams]]
+service_name = "web"
+frontend_port = 8080
+
+  [[upstreams.targets]]
+  address = "10.0.0.1"
+  port = 80
+
+    [upstreams.targets.metadata]
+    zone = "a"
+`
+
+const yamlUpstreams = `
+upstreams:
+  - service_name: api
+    frontend_proto: tcp
+    frontend_ip: 0.0.0.0
+    frontend_port: "9090"
+    targets:
+      - address: 10.0.0.2
+        port: 9000
+      - address: 10.0.0.3
+        port: 9000
+`
+
+const jsonUpstreams = `{"upstreams": [{"service_name": "web", "frontend_port": "8081", "targets": [{"address": "10.0.0.1", "port": "80"}]}]}`
+
+func writeUpstreamFile(t *testing.T, path, content string) {
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	// make sure the modification time moves on coarse file systems
+	future := time.Now().Add(time.Second)
+	os.Chtimes(path, future, future)
+}
+
+func startFileUpstreamLoader(t *testing.T, path string) *FileUpstreamLoader {
+	loader, err := InitFileUpstreamLoader(config.Upstream{
+		SourceType:   "file",
+		FilePath:     path,
+		FileInterval: time.Millisecond * 20,
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loader
+}
+
+func TestFileUpstreamLoaderDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeUpstreamFile(t, filepath.Join(dir, "web.toml"), tomlUpstreams)
+	writeUpstreamFile(t, filepath.Join(dir, "api.yml"), yamlUpstreams)
+	writeUpstreamFile(t, filepath.Join(dir, "README"), "not an upstream file")
+
+	loader := startFileUpstreamLoader(t, dir)
+	upstreams := loader.List()
+	assert.Equal(t, len(upstreams), 2)
+
+	api := loader.Get("api")
+	assert.Equal(t, api.Key(), UpstreamKey{Proto: "tcp", Ip: "0.0.0.0", Port: "9090"})
+	assert.Equal(t, len(api.Targets), 2)
+
+	web := loader.Get("web")
+	assert.Equal(t, web.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, web.Targets[0].Addr(), "10.0.0.1:80")
+	assert.Equal(t, web.Targets[0].Metadata["zone"], "a")
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// files are watched
+	assert.Nil(t, os.Remove(filepath.Join(dir, "api.yml")))
+	event := waitEvent(t, loader, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "api")
+}
+
+func TestFileUpstreamLoaderChange(t *testing.T) {
+	dir := t.TempDir()
+	writeUpstreamFile(t, filepath.Join(dir, "web.toml"), tomlUpstreams)
+	loader := startFileUpstreamLoader(t, dir)
+	waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+
+	// a broken file leaves the upstreams loaded before in place
+	writeUpstreamFile(t, filepath.Join(dir, "web.json"), jsonUpstreams[1:])
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, len(loader.List()), 1)
+
+	// and so does a service defined twice
+	writeUpstreamFile(t, filepath.Join(dir, "web.json"), jsonUpstreams)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, loader.Get("web").FrontendPort, "8080")
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "web.toml")))
+	event := waitEvent(t, loader, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, event.Upstream.FrontendPort, "8081")
+}
+
+func TestFileUpstreamLoaderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeUpstreamFile(t, filepath.Join(dir, "a.toml"), tomlUpstreams)
+	writeUpstreamFile(t, filepath.Join(dir, "b.toml"), tomlUpstreams)
+
+	_, err := InitFileUpstreamLoader(config.Upstream{FilePath: dir, FileInterval: time.Second}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.NotNil(t, err)
+
+	_, err = InitFileUpstreamLoader(config.Upstream{FilePath: filepath.Join(dir, "missing.toml"), FileInterval: time.Second}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.NotNil(t, err)
+}
+
+func TestFlexString(t *testing.T) {
+	for data, port := range map[string]flexString{`{"port": 80}`: "80", `{"port": "80"}`: "80", `{"port": null}`: ""} {
+		var target fileTarget
+		assert.Nil(t, json.Unmarshal([]byte(data), &target), data)
+		assert.Equal(t, target.Port, port, data)
+	}
+	for _, data := range []string{`{"port": true}`, `{"port": [80]}`, `{"port": {}}`} {
+		var target fileTarget
+		assert.NotNil(t, json.Unmarshal([]byte(data), &target), data)
+	}
+
+	// a null port is a missing one
+	dir := t.TempDir()
+	writeUpstreamFile(t, filepath.Join(dir, "web.yml"), "upstreams:\n  - service_name: web\n    frontend_port: 8080\n    targets:\n      - address: 10.0.0.1\n        port: null\n")
+	_, err := InitFileUpstreamLoader(config.Upstream{FilePath: dir, FileInterval: time.Second}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,572 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// annotation picking the port of a service with several ones, by name
+	// or by number, the first port is served otherwise
+	SERVICE_PORT_ANNOTATION = "borg-service-port"
+
+	KUBERNETES_TIMEOUT       = time.Second * 30
+	KUBERNETES_WATCH_TIMEOUT = time.Minute * 5
+)
+
+// errKubernetesGone tells that a watch fell behind the history kept by the
+// api server, the resource has to be listed again
+var errKubernetesGone = errors.New("resource version is too old")
+
+// KubernetesUpstreamLoader loads upstreams from the kubernetes services
+// with a FRONTEND_PORT_LABEL annotation, their targets being the ready
+// addresses of the service endpoints. With KubernetesIngress, the rules of
+// the ingresses become host and path routes of their backend services.
+// Each resource is listed, then watched from the version listed
+type KubernetesUpstreamLoader struct {
+	UpstreamLoader
+
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	client       *http.Client
+	streamClient *http.Client
+	served       *upstreamSet
+	changed      chan bool
+	sync.Mutex
+
+	services  *kubernetesResource
+	endpoints *kubernetesResource
+	ingresses *kubernetesResource // nil without KubernetesIngress
+}
+
+// kubernetesResource is the local copy of a kind of kubernetes objects
+type kubernetesResource struct {
+	path      string // like /api/v1/services
+	newObject func() kubernetesObject
+	objects   map[string]kubernetesObject // namespace/name -> object
+	listed    bool
+}
+
+type kubernetesObject interface {
+	meta() kubernetesMeta
+}
+
+type kubernetesMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Annotations       map[string]string `json:"annotations"`
+}
+
+func (m kubernetesMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type kubernetesList struct {
+	Metadata kubernetesMeta    `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type kubernetesService struct {
+	Metadata kubernetesMeta `json:"metadata"`
+	Spec     struct {
+		Ports []kubernetesPort `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubernetesPort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+type kubernetesEndpoints struct {
+	Metadata kubernetesMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses []kubernetesAddress `json:"addresses"`
+		Ports     []kubernetesPort    `json:"ports"`
+	} `json:"subsets"`
+}
+
+type kubernetesAddress struct {
+	IP        string `json:"ip"`
+	NodeName  string `json:"nodeName"`
+	TargetRef *struct {
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
+
+type kubernetesIngress struct {
+	Metadata kubernetesMeta `json:"metadata"`
+	Spec     struct {
+		DefaultBackend *kubernetesIngressBackend `json:"defaultBackend"`
+		Rules          []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string                   `json:"path"`
+					PathType string                   `json:"pathType"`
+					Backend  kubernetesIngressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type kubernetesIngressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+	} `json:"service"`
+}
+
+func (s *kubernetesService) meta() kubernetesMeta   { return s.Metadata }
+func (e *kubernetesEndpoints) meta() kubernetesMeta { return e.Metadata }
+func (i *kubernetesIngress) meta() kubernetesMeta   { return i.Metadata }
+
+func InitKubernetesUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*KubernetesUpstreamLoader, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if Config.KubernetesCAFile != "" {
+		pem, err := ioutil.ReadFile(Config.KubernetesCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", Config.KubernetesCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if Config.KubernetesTokenFile != "" {
+		if _, err := ioutil.ReadFile(Config.KubernetesTokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	kubernetesUpstreamLoader := &KubernetesUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		client:            &http.Client{Transport: transport, Timeout: KUBERNETES_TIMEOUT},
+		streamClient:      &http.Client{Transport: transport},
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+		changed:           make(chan bool, 1),
+	}
+
+	kubernetesUpstreamLoader.services = kubernetesUpstreamLoader.resource("/api/v1", "services", func() kubernetesObject { return &kubernetesService{} })
+	kubernetesUpstreamLoader.endpoints = kubernetesUpstreamLoader.resource("/api/v1", "endpoints", func() kubernetesObject { return &kubernetesEndpoints{} })
+	if Config.KubernetesIngress {
+		kubernetesUpstreamLoader.ingresses = kubernetesUpstreamLoader.resource("/apis/networking.k8s.io/v1", "ingresses", func() kubernetesObject { return &kubernetesIngress{} })
+	}
+
+	go kubernetesUpstreamLoader.Poll()
+	for _, resource := range kubernetesUpstreamLoader.resources() {
+		go kubernetesUpstreamLoader.follow(resource)
+	}
+
+	return kubernetesUpstreamLoader, nil
+}
+
+// resource is the api path of a kind of objects, in the namespace watched
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) resource(group, name string, newObject func() kubernetesObject) *kubernetesResource {
+	path := group + "/" + name
+	if namespace := kubernetesUpstreamLoader.Config.KubernetesNamespace; namespace != "" {
+		path = group + "/namespaces/" + namespace + "/" + name
+	}
+	return &kubernetesResource{
+		path:      path,
+		newObject: newObject,
+		objects:   make(map[string]kubernetesObject),
+	}
+}
+
+// Poll rebuilds the upstreams whenever a resource or the overrides change,
+// a burst of changes is applied at once. Nothing is served before every
+// resource is listed, so that a service does not start without its routes
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) Poll() {
+	for {
+		select {
+		case <-kubernetesUpstreamLoader.changed:
+		case <-kubernetesUpstreamLoader.Overrides.ChangeNotify():
+		}
+
+		kubernetesUpstreamLoader.Lock()
+		if kubernetesUpstreamLoader.allListed() {
+			kubernetesUpstreamLoader.reconcile()
+			kubernetesUpstreamLoader.served.synced()
+		}
+		kubernetesUpstreamLoader.Unlock()
+	}
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) notifyChanged() {
+	select {
+	case kubernetesUpstreamLoader.changed <- true:
+	default:
+	}
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) resources() []*kubernetesResource {
+	resources := []*kubernetesResource{kubernetesUpstreamLoader.services, kubernetesUpstreamLoader.endpoints}
+	if kubernetesUpstreamLoader.ingresses != nil {
+		resources = append(resources, kubernetesUpstreamLoader.ingresses)
+	}
+	return resources
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) allListed() bool {
+	for _, resource := range kubernetesUpstreamLoader.resources() {
+		if !resource.listed {
+			return false
+		}
+	}
+	return true
+}
+
+// follow lists a resource then watches it from the version listed, the
+// watch is resumed when the api server ends it and the resource listed
+// again on any error
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) follow(resource *kubernetesResource) {
+	retry := newRetryDelay()
+	for {
+		resourceVersion, err := kubernetesUpstreamLoader.list(resource)
+		if err != nil {
+			log.Errorf("list %s from kubernetes got err: %s", resource.path, err)
+			retry.Wait()
+			continue
+		}
+		retry.Reset()
+
+		for err == nil {
+			resourceVersion, err = kubernetesUpstreamLoader.watch(resource, resourceVersion)
+		}
+		if err == errKubernetesGone {
+			log.Infof("watch %s from kubernetes: %s, list it again", resource.path, err)
+			continue
+		}
+		log.Errorf("watch %s from kubernetes got err: %s", resource.path, err)
+		retry.Wait()
+	}
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) list(resource *kubernetesResource) (string, error) {
+	resp, err := kubernetesUpstreamLoader.get(kubernetesUpstreamLoader.client, resource.path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list kubernetesList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	objects := make(map[string]kubernetesObject, len(list.Items))
+	for _, item := range list.Items {
+		object := resource.newObject()
+		if err := json.Unmarshal(item, object); err != nil {
+			return "", err
+		}
+		objects[object.meta().key()] = object
+	}
+
+	kubernetesUpstreamLoader.Lock()
+	resource.objects = objects
+	resource.listed = true
+	kubernetesUpstreamLoader.Unlock()
+	kubernetesUpstreamLoader.notifyChanged()
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes of a resource since resourceVersion until the
+// api server ends the watch, and returns the last version seen
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) watch(resource *kubernetesResource, resourceVersion string) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", strconv.Itoa(int(KUBERNETES_WATCH_TIMEOUT.Seconds())))
+
+	resp, err := kubernetesUpstreamLoader.get(kubernetesUpstreamLoader.streamClient, resource.path, query)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubernetesWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		if event.Type == "ERROR" {
+			var status kubernetesStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errKubernetesGone
+			}
+			return resourceVersion, fmt.Errorf("kubernetes answered %d %s", status.Code, status.Message)
+		}
+
+		object := resource.newObject()
+		if err := json.Unmarshal(event.Object, object); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = object.meta().ResourceVersion
+
+		kubernetesUpstreamLoader.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			resource.objects[object.meta().key()] = object
+		case "DELETED":
+			delete(resource.objects, object.meta().key())
+		}
+		kubernetesUpstreamLoader.Unlock()
+
+		if event.Type != "BOOKMARK" {
+			kubernetesUpstreamLoader.notifyChanged()
+		}
+	}
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) get(client *http.Client, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimRight(kubernetesUpstreamLoader.Config.KubernetesAddr, "/") + path
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// service account tokens are rotated, read the file on every request
+	if kubernetesUpstreamLoader.Config.KubernetesTokenFile != "" {
+		token, err := ioutil.ReadFile(kubernetesUpstreamLoader.Config.KubernetesTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errKubernetesGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// reconcile builds the upstreams from the local copy of the resources and
+// sends what changed since the last time, callers must hold the lock
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) reconcile() {
+	routes := make(map[string][]Route)
+	if kubernetesUpstreamLoader.ingresses != nil {
+		for _, object := range kubernetesUpstreamLoader.ingresses.objects {
+			object.(*kubernetesIngress).routes(routes)
+		}
+	}
+
+	upstreams := make([]*Upstream, 0, len(kubernetesUpstreamLoader.services.objects))
+	for key, object := range kubernetesUpstreamLoader.services.objects {
+		service := object.(*kubernetesService)
+		if service.Metadata.Annotations[FRONTEND_PORT_LABEL] == "" {
+			continue
+		}
+
+		var serviceEndpoints *kubernetesEndpoints
+		if object, found := kubernetesUpstreamLoader.endpoints.objects[key]; found {
+			serviceEndpoints = object.(*kubernetesEndpoints)
+		}
+		upstream := service.build(serviceEndpoints, kubernetesUpstreamLoader.DefaultUpstreamIp.String())
+		upstream.Routes = routes[key]
+		sort.Sort(routesByString(upstream.Routes))
+		upstreams = append(upstreams, upstream)
+	}
+	kubernetesUpstreamLoader.served.update(upstreams)
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) List() []*Upstream {
+	kubernetesUpstreamLoader.Lock()
+	defer kubernetesUpstreamLoader.Unlock()
+	return kubernetesUpstreamLoader.served.list()
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) Get(serviceName string) *Upstream {
+	kubernetesUpstreamLoader.Lock()
+	defer kubernetesUpstreamLoader.Unlock()
+	return kubernetesUpstreamLoader.served.get(serviceName)
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) Events() <-chan UpstreamEvent {
+	return kubernetesUpstreamLoader.served.events
+}
+
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) Conflicts() []FrontendConflict {
+	kubernetesUpstreamLoader.Lock()
+	defer kubernetesUpstreamLoader.Unlock()
+	return kubernetesUpstreamLoader.served.conflictList()
+}
+
+// Reload warns about new kubernetes settings, which require a restart
+func (kubernetesUpstreamLoader *KubernetesUpstreamLoader) Reload(Config config.Upstream) {
+	current := kubernetesUpstreamLoader.Config
+	if Config.KubernetesAddr != current.KubernetesAddr ||
+		Config.KubernetesNamespace != current.KubernetesNamespace ||
+		Config.KubernetesTokenFile != current.KubernetesTokenFile ||
+		Config.KubernetesCAFile != current.KubernetesCAFile ||
+		Config.KubernetesIngress != current.KubernetesIngress {
+		log.Warnf("kubernetes settings change requires a restart")
+	}
+}
+
+// kubernetesServiceName turns the service web of the namespace default
+// into web.default, like its dns name
+func kubernetesServiceName(meta kubernetesMeta) string {
+	return meta.Name + "." + meta.Namespace
+}
+
+func (service *kubernetesService) build(endpoints *kubernetesEndpoints, defaultUpstreamIp string) *Upstream {
+	upstream := &Upstream{
+		ServiceName:   kubernetesServiceName(service.Metadata),
+		FrontendProto: service.Metadata.Annotations[FRONTEND_PROTO_LABEL],
+		FrontendIp:    defaultUpstreamIp,
+		FrontendPort:  service.Metadata.Annotations[FRONTEND_PORT_LABEL],
+		Targets:       make([]*Target, 0),
+	}
+	if !service.Metadata.CreationTimestamp.IsZero() {
+		upstream.RegisteredIndex = uint64(service.Metadata.CreationTimestamp.UnixNano())
+	}
+	if upstream.FrontendProto == "" {
+		upstream.FrontendProto = "http"
+	}
+
+	port, found := service.port()
+	if !found || endpoints == nil {
+		return upstream
+	}
+
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != port.Name {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				serviceID := address.IP
+				if address.TargetRef != nil {
+					serviceID = address.TargetRef.Name
+				}
+				upstream.Targets = append(upstream.Targets, &Target{
+					Node:           address.NodeName,
+					Address:        address.IP,
+					ServiceName:    upstream.ServiceName,
+					ServiceID:      serviceID,
+					ServiceAddress: address.IP,
+					ServicePort:    strconv.Itoa(endpointPort.Port),
+					Weight:         DEFAULT_WEIGHT,
+					Upstream:       upstream,
+				})
+			}
+		}
+	}
+	sort.Sort(targetsByAddr(upstream.Targets))
+	return upstream
+}
+
+// port is the port of the service named by SERVICE_PORT_ANNOTATION, or
+// its first one
+func (service *kubernetesService) port() (kubernetesPort, bool) {
+	if len(service.Spec.Ports) == 0 {
+		return kubernetesPort{}, false
+	}
+
+	wanted := service.Metadata.Annotations[SERVICE_PORT_ANNOTATION]
+	if wanted == "" {
+		return service.Spec.Ports[0], true
+	}
+	for _, port := range service.Spec.Ports {
+		if port.Name == wanted || strconv.Itoa(port.Port) == wanted {
+			return port, true
+		}
+	}
+	log.Warnf("service %s has no port %s", service.Metadata.key(), wanted)
+	return kubernetesPort{}, false
+}
+
+// routes adds the rules of the ingress to the routes of their backend
+// services, keyed by namespace/name
+func (ingress *kubernetesIngress) routes(routes map[string][]Route) {
+	namespace := ingress.Metadata.Namespace
+	if backend := ingress.Spec.DefaultBackend; backend != nil && backend.Service != nil {
+		key := namespace + "/" + backend.Service.Name
+		routes[key] = append(routes[key], Route{Path: "/"})
+	}
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				continue
+			}
+			key := namespace + "/" + path.Backend.Service.Name
+			routes[key] = append(routes[key], Route{
+				Host:  rule.Host,
+				Path:  path.Path,
+				Exact: path.PathType == "Exact",
+			})
+		}
+	}
+}
+
+type routesByString []Route
+
+func (r routesByString) Len() int           { return len(r) }
+func (r routesByString) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r routesByString) Less(i, j int) bool { return r[i].ToString() < r[j].ToString() }
+
+type targetsByAddr []*Target
+
+func (t targetsByAddr) Len() int           { return len(t) }
+func (t targetsByAddr) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t targetsByAddr) Less(i, j int) bool { return t[i].Addr() < t[j].Addr() }
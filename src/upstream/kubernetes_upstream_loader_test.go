@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKubernetes serves lists of objects, and streams the watch events
+// pushed to a resource
+type fakeKubernetes struct {
+	lists   map[string]string
+	watches map[string]chan string
+	sync.Mutex
+}
+
+func newFakeKubernetes(lists map[string]string) *fakeKubernetes {
+	watches := make(map[string]chan string)
+	for path := range lists {
+		watches[path] = make(chan string)
+	}
+	return &fakeKubernetes{lists: lists, watches: watches}
+}
+
+func (k *fakeKubernetes) setList(path, list string) {
+	k.Lock()
+	k.lists[path] = list
+	k.Unlock()
+}
+
+func (k *fakeKubernetes) push(t *testing.T, path, event string) {
+	select {
+	case k.watches[path] <- event:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("%s not watched", path)
+	}
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	k.Lock()
+	list, found := k.lists[r.URL.Path]
+	k.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("watch") != "true" {
+		fmt.Fprint(w, list)
+		return
+	}
+
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-k.watches[r.URL.Path]:
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+const (
+	testKubernetesServices = `{"metadata": {"resourceVersion": "10"}, "items": [
+  {"metadata": {"name": "web", "namespace": "default", "annotations": {"borg-frontend-port": "8080", "borg-service-port": "http"}},
+   "spec": {"ports": [{"name": "metrics", "port": 9100}, {"name": "http", "port": 80}]}},
+  {"metadata": {"name": "db", "namespace": "default"}, "spec": {"ports": [{"port": 5432}]}}
+]}`
+
+	testKubernetesEndpoints = `{"metadata": {"resourceVersion": "11"}, "items": [
+  {"metadata": {"name": "web", "namespace": "default"}, "subsets": [
+    {"addresses": [{"ip": "10.0.0.1", "nodeName": "node-1", "targetRef": {"name": "web-1"}}],
+     "ports": [{"name": "http", "port": 8080}, {"name": "metrics", "port": 9100}]}
+  ]}
+]}`
+
+	testKubernetesIngresses = `{"metadata": {"resourceVersion": "12"}, "items": [
+  {"metadata": {"name": "web", "namespace": "default"}, "spec": {"rules": [
+    {"host": "web.example.com", "http": {"paths": [{"path": "/api", "pathType": "Prefix", "backend": {"service": {"name": "web"}}}]}}
+  ]}}
+]}`
+)
+
+func TestKubernetesUpstreamLoader(t *testing.T) {
+	kubernetes := newFakeKubernetes(map[string]string{
+		"/api/v1/services":                     testKubernetesServices,
+		"/api/v1/endpoints":                    testKubernetesEndpoints,
+		"/apis/networking.k8s.io/v1/ingresses": testKubernetesIngresses,
+	})
+	server := httptest.NewServer(kubernetes)
+	t.Cleanup(func() {
+		// the watches stay open, cut them before closing
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	loader, err := InitKubernetesUpstreamLoader(config.Upstream{
+		KubernetesAddr:      server.URL,
+		KubernetesTokenFile: tokenFile,
+		KubernetesIngress:   true,
+	}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "web.default")
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:8080")
+	assert.Equal(t, event.Upstream.Targets[0].ServiceID, "web-1")
+	assert.Equal(t, event.Upstream.Routes, []Route{{Host: "web.example.com", Path: "/api"}})
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// endpoints are watched
+	kubernetes.push(t, "/api/v1/endpoints", `{"type": "MODIFIED", "object":
+  {"metadata": {"name": "web", "namespace": "default", "resourceVersion": "13"}, "subsets": [
+    {"addresses": [{"ip": "10.0.0.1", "nodeName": "node-1", "targetRef": {"name": "web-1"}}, {"ip": "10.0.0.2", "nodeName": "node-2", "targetRef": {"name": "web-2"}}],
+     "ports": [{"name": "http", "port": 8080}]}
+  ]}}`)
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.AddedTargets), 1)
+	assert.Equal(t, event.AddedTargets[0].Addr(), "10.0.0.2:8080")
+
+	// a watch too old lists the ingresses again
+	kubernetes.setList("/apis/networking.k8s.io/v1/ingresses", `{"metadata": {"resourceVersion": "20"}, "items": [
+  {"metadata": {"name": "web", "namespace": "default"}, "spec": {"rules": [
+    {"host": "web.example.com", "http": {"paths": [
+      {"path": "/api", "pathType": "Prefix", "backend": {"service": {"name": "web"}}},
+      {"path": "/health", "pathType": "Exact", "backend": {"service": {"name": "web"}}}
+    ]}}
+  ]}}
+]}`)
+	kubernetes.push(t, "/apis/networking.k8s.io/v1/ingresses", `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`)
+	event = waitEvent(t, loader, EVENT_FRONTEND_CHANGED)
+	assert.Equal(t, event.Upstream.Routes, []Route{
+		{Host: "web.example.com", Path: "/api"},
+		{Host: "web.example.com", Path: "/health", Exact: true},
+	})
+
+	kubernetes.push(t, "/api/v1/services", `{"type": "DELETED", "object": {"metadata": {"name": "web", "namespace": "default", "resourceVersion": "21"}}}`)
+	event = waitEvent(t, loader, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, event.Upstream.ServiceName, "web.default")
+}
+
+func TestRouteMatch(t *testing.T) {
+	assert.True(t, Route{}.Match("any.example.com", "/foo"))
+	assert.True(t, Route{Host: "web.example.com", Path: "/"}.Match("WEB.example.com:80", "/foo"))
+	assert.False(t, Route{Host: "web.example.com"}.Match("api.example.com", "/"))
+	assert.True(t, Route{Path: "/foo/"}.Match("", "/foo"))
+	assert.False(t, Route{Path: "/foo"}.Match("", "/foobar"))
+	assert.False(t, Route{Path: "/", Exact: true}.Match("", "/foo"))
+}
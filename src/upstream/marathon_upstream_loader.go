@@ -0,0 +1,323 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// labels of the marathon apps, and annotations of the kubernetes
+	// services, to serve. An app or a service is served once it has a
+	// frontend port
+	FRONTEND_PORT_LABEL  = "borg-frontend-port"
+	FRONTEND_PROTO_LABEL = "borg-frontend-proto"
+
+	MARATHON_APPS_PATH   = "/v2/apps?embed=apps.tasks"
+	MARATHON_EVENTS_PATH = "/v2/events"
+	MARATHON_TIMEOUT     = time.Second * 30
+)
+
+// events of the marathon stream telling nothing about apps or tasks,
+// any other event makes the apps listed again
+var marathonIgnoredEvents = map[string]bool{
+	"event_stream_attached":        true,
+	"event_stream_detached":        true,
+	"subscribe_event":              true,
+	"unsubscribe_event":            true,
+	"framework_message_event":      true,
+	"scheduler_registered_event":   true,
+	"scheduler_reregistered_event": true,
+	"scheduler_disconnected_event": true,
+	"deployment_info":              true,
+}
+
+// MarathonUpstreamLoader loads upstreams from the apps of marathon with a
+// FRONTEND_PORT_LABEL. The apps are listed on startup, then again each
+// time the event stream of marathon tells a task or an app changed
+type MarathonUpstreamLoader struct {
+	UpstreamLoader
+
+	Config            config.Upstream
+	Overrides         *Overrides
+	DefaultUpstreamIp net.IP
+
+	client       *http.Client
+	streamClient *http.Client
+	served       *upstreamSet
+	resync       chan bool
+	sync.Mutex
+
+	apps []marathonApp // last listed
+}
+
+type marathonApps struct {
+	Apps []marathonApp `json:"apps"`
+}
+
+type marathonApp struct {
+	ID           string            `json:"id"`
+	Labels       map[string]string `json:"labels"`
+	HealthChecks []interface{}     `json:"healthChecks"`
+	Tasks        []marathonTask    `json:"tasks"`
+}
+
+type marathonTask struct {
+	ID                 string                `json:"id"`
+	Host               string                `json:"host"`
+	SlaveID            string                `json:"slaveId"`
+	State              string                `json:"state"`
+	Ports              []int                 `json:"ports"`
+	HealthCheckResults []marathonHealthCheck `json:"healthCheckResults"`
+}
+
+type marathonHealthCheck struct {
+	Alive bool `json:"alive"`
+}
+
+type marathonEvent struct {
+	EventType string `json:"eventType"`
+}
+
+func InitMarathonUpstreamLoader(Config config.Upstream, defaultUpstreamIp net.IP, overrides *Overrides) (*MarathonUpstreamLoader, error) {
+	marathonUpstreamLoader := &MarathonUpstreamLoader{
+		Config:            Config,
+		Overrides:         overrides,
+		DefaultUpstreamIp: defaultUpstreamIp,
+		client:            &http.Client{Timeout: MARATHON_TIMEOUT},
+		streamClient:      &http.Client{},
+		served:            newUpstreamSet(overrides, Config.ConflictPolicy),
+		resync:            make(chan bool, 1),
+	}
+
+	marathonUpstreamLoader.triggerResync()
+	go marathonUpstreamLoader.Poll()
+	go marathonUpstreamLoader.followEvents()
+
+	return marathonUpstreamLoader, nil
+}
+
+// Poll lists the apps of marathon whenever a resync is triggered, and
+// applies the overrides as soon as they change
+func (marathonUpstreamLoader *MarathonUpstreamLoader) Poll() {
+	retry := newRetryDelay()
+	for {
+		select {
+		case <-marathonUpstreamLoader.resync:
+		case <-marathonUpstreamLoader.Overrides.ChangeNotify():
+			marathonUpstreamLoader.Lock()
+			marathonUpstreamLoader.reconcile()
+			marathonUpstreamLoader.Unlock()
+			continue
+		}
+
+		apps, err := marathonUpstreamLoader.listApps()
+		if err != nil {
+			log.Errorf("list apps from marathon got err: %s", err)
+			retry.Wait()
+			marathonUpstreamLoader.triggerResync()
+			continue
+		}
+		retry.Reset()
+
+		marathonUpstreamLoader.Lock()
+		marathonUpstreamLoader.apps = apps
+		marathonUpstreamLoader.reconcile()
+		marathonUpstreamLoader.served.synced()
+		marathonUpstreamLoader.Unlock()
+	}
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) triggerResync() {
+	select {
+	case marathonUpstreamLoader.resync <- true:
+	default:
+	}
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) listApps() ([]marathonApp, error) {
+	resp, err := marathonUpstreamLoader.client.Get(marathonUpstreamLoader.url(MARATHON_APPS_PATH))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marathon answered %s", resp.Status)
+	}
+
+	var apps marathonApps
+	if err := json.NewDecoder(resp.Body).Decode(&apps); err != nil {
+		return nil, err
+	}
+	return apps.Apps, nil
+}
+
+// followEvents reads the event stream of marathon and triggers a resync
+// on every event changing apps or tasks, and on every reconnection as
+// events might have been missed meanwhile
+func (marathonUpstreamLoader *MarathonUpstreamLoader) followEvents() {
+	retry := newRetryDelay()
+	for {
+		err := marathonUpstreamLoader.readEvents(retry)
+		log.Errorf("marathon event stream got err: %s", err)
+		retry.Wait()
+	}
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) readEvents(retry *retryDelay) error {
+	req, err := http.NewRequest("GET", marathonUpstreamLoader.url(MARATHON_EVENTS_PATH), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := marathonUpstreamLoader.streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("marathon answered %s", resp.Status)
+	}
+
+	log.Infof("following the event stream of marathon %s", marathonUpstreamLoader.Config.MarathonAddr)
+	retry.Reset()
+	marathonUpstreamLoader.triggerResync()
+
+	eventType := ""
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:") && eventType == "":
+			var event marathonEvent
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event) == nil {
+				eventType = event.EventType
+			}
+		case line == "":
+			if eventType != "" && !marathonIgnoredEvents[eventType] {
+				log.Debugf("marathon event %s", eventType)
+				marathonUpstreamLoader.triggerResync()
+			}
+			eventType = ""
+		}
+	}
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) url(path string) string {
+	return strings.TrimRight(marathonUpstreamLoader.Config.MarathonAddr, "/") + path
+}
+
+// reconcile builds the upstreams from the apps last listed and sends
+// what changed since the last time, callers must hold the lock
+func (marathonUpstreamLoader *MarathonUpstreamLoader) reconcile() {
+	upstreams := make([]*Upstream, 0, len(marathonUpstreamLoader.apps))
+	for _, app := range marathonUpstreamLoader.apps {
+		if app.Labels[FRONTEND_PORT_LABEL] == "" {
+			continue
+		}
+		upstreams = append(upstreams, app.build(marathonUpstreamLoader.DefaultUpstreamIp.String()))
+	}
+	marathonUpstreamLoader.served.update(upstreams)
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) List() []*Upstream {
+	marathonUpstreamLoader.Lock()
+	defer marathonUpstreamLoader.Unlock()
+	return marathonUpstreamLoader.served.list()
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) Get(serviceName string) *Upstream {
+	marathonUpstreamLoader.Lock()
+	defer marathonUpstreamLoader.Unlock()
+	return marathonUpstreamLoader.served.get(serviceName)
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) Events() <-chan UpstreamEvent {
+	return marathonUpstreamLoader.served.events
+}
+
+func (marathonUpstreamLoader *MarathonUpstreamLoader) Conflicts() []FrontendConflict {
+	marathonUpstreamLoader.Lock()
+	defer marathonUpstreamLoader.Unlock()
+	return marathonUpstreamLoader.served.conflictList()
+}
+
+// Reload warns about a new marathon address, which requires a restart
+func (marathonUpstreamLoader *MarathonUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.MarathonAddr != marathonUpstreamLoader.Config.MarathonAddr {
+		log.Warnf("marathon address change from %s to %s requires a restart", marathonUpstreamLoader.Config.MarathonAddr, Config.MarathonAddr)
+	}
+}
+
+// marathonServiceName turns an app id like /group/web into group-web
+func marathonServiceName(appID string) string {
+	return strings.Replace(strings.Trim(appID, "/"), "/", "-", -1)
+}
+
+func (app marathonApp) build(defaultUpstreamIp string) *Upstream {
+	upstream := &Upstream{
+		ServiceName:   marathonServiceName(app.ID),
+		FrontendProto: app.Labels[FRONTEND_PROTO_LABEL],
+		FrontendIp:    defaultUpstreamIp,
+		FrontendPort:  app.Labels[FRONTEND_PORT_LABEL],
+		Targets:       make([]*Target, 0, len(app.Tasks)),
+	}
+	if upstream.FrontendProto == "" {
+		upstream.FrontendProto = "http"
+	}
+
+	for _, task := range app.Tasks {
+		if !app.healthy(task) || len(task.Ports) == 0 {
+			continue
+		}
+
+		upstream.Targets = append(upstream.Targets, &Target{
+			Node:           task.SlaveID,
+			Address:        task.Host,
+			ServiceName:    upstream.ServiceName,
+			ServiceID:      task.ID,
+			ServiceAddress: task.Host,
+			ServicePort:    fmt.Sprintf("%d", task.Ports[0]),
+			Weight:         DEFAULT_WEIGHT,
+			Upstream:       upstream,
+		})
+	}
+	return upstream
+}
+
+// healthy tells whether a task passes every health check of its app, a
+// task of an app without health checks only has to be running
+func (app marathonApp) healthy(task marathonTask) bool {
+	if task.State != "" && task.State != "TASK_RUNNING" {
+		return false
+	}
+
+	if len(task.HealthCheckResults) < len(app.HealthChecks) {
+		return false
+	}
+	for _, result := range task.HealthCheckResults {
+		if !result.Alive {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMarathon serves apps and streams an event each time they change
+type fakeMarathon struct {
+	apps   string
+	events chan string
+	sync.Mutex
+}
+
+func (m *fakeMarathon) setApps(apps string) {
+	m.Lock()
+	m.apps = apps
+	m.Unlock()
+}
+
+func (m *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v2/apps":
+		if r.URL.Query().Get("embed") != "apps.tasks" {
+			http.Error(w, "tasks not embedded", http.StatusBadRequest)
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		fmt.Fprint(w, m.apps)
+	case "/v2/events":
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: event_stream_attached\ndata: {\"remoteAddress\":\"127.0.0.1\"}\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-m.events:
+				fmt.Fprintf(w, "event: %s\ndata: {\"eventType\":%q}\n\n", event, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const testMarathonApps = `{"apps": [
+  {"id": "/tools/web", "labels": {"borg-frontend-port": "8080"}, "healthChecks": [{"protocol": "HTTP"}], "tasks": [
+    {"id": "web.1", "host": "10.0.0.1", "slaveId": "s1", "state": "TASK_RUNNING", "ports": [31001], "healthCheckResults": [{"alive": true}]},
+    {"id": "web.2", "host": "10.0.0.2", "slaveId": "s2", "state": "TASK_RUNNING", "ports": [31002], "healthCheckResults": [{"alive": false}]},
+    {"id": "web.3", "host": "10.0.0.3", "slaveId": "s3", "state": "TASK_STAGING", "ports": [31003], "healthCheckResults": []}
+  ]},
+  {"id": "/db", "labels": {}, "tasks": [
+    {"id": "db.1", "host": "10.0.0.4", "state": "TASK_RUNNING", "ports": [31004]}
+  ]}
+]}`
+
+func TestMarathonUpstreamLoader(t *testing.T) {
+	marathon := &fakeMarathon{apps: testMarathonApps, events: make(chan string)}
+	server := httptest.NewServer(marathon)
+	t.Cleanup(func() {
+		// the event stream stays open, cut it before closing
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	loader, err := InitMarathonUpstreamLoader(config.Upstream{MarathonAddr: server.URL + "/"}, net.ParseIP("127.0.0.1"), NewOverrides())
+	assert.Nil(t, err)
+
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.ServiceName, "tools-web")
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, len(event.Upstream.Targets), 1)
+	assert.Equal(t, event.Upstream.Targets[0].Addr(), "10.0.0.1:31001")
+	assert.Equal(t, event.Upstream.Targets[0].ServiceID, "web.1")
+	waitEvent(t, loader, EVENT_SYNCED)
+
+	// the second task passes its health check
+	marathon.setApps(`{"apps": [
+  {"id": "/tools/web", "labels": {"borg-frontend-port": "8080"}, "healthChecks": [{"protocol": "HTTP"}], "tasks": [
+    {"id": "web.1", "host": "10.0.0.1", "slaveId": "s1", "state": "TASK_RUNNING", "ports": [31001], "healthCheckResults": [{"alive": true}]},
+    {"id": "web.2", "host": "10.0.0.2", "slaveId": "s2", "state": "TASK_RUNNING", "ports": [31002], "healthCheckResults": [{"alive": true}]}
+  ]}
+]}`)
+	select {
+	case marathon.events <- "health_status_changed_event":
+	case <-time.After(time.Second * 5):
+		t.Fatal("event stream not followed")
+	}
+
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, len(event.AddedTargets), 1)
+	assert.Equal(t, event.AddedTargets[0].Addr(), "10.0.0.2:31002")
+}
+
+func TestMarathonTaskHealthy(t *testing.T) {
+	app := marathonApp{}
+	assert.True(t, app.healthy(marathonTask{State: "TASK_RUNNING"}))
+	assert.False(t, app.healthy(marathonTask{State: "TASK_KILLING"}))
+
+	app.HealthChecks = []interface{}{"http", "tcp"}
+	assert.False(t, app.healthy(marathonTask{HealthCheckResults: []marathonHealthCheck{{Alive: true}}}))
+	assert.True(t, app.healthy(marathonTask{HealthCheckResults: []marathonHealthCheck{{Alive: true}, {Alive: true}}}))
+}
@@ -0,0 +1,247 @@
+package upstream
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	OVERRIDES_KEY = "UpstreamOverrides"
+
+	OVERRIDE_MAINTENANCE = "maintenance"
+	OVERRIDE_DRAIN       = "drain"
+	OVERRIDE_STATIC      = "static"
+	OVERRIDE_WEIGHT      = "weight"
+)
+
+// Overrides are decisions taken by operators at runtime, layered on top
+// of what an upstream loader discovers. They are applied again on every
+// load, so they survive until reverted.
+type Overrides struct {
+	maintenance map[string]bool
+	drained     map[string]map[string]bool    // service name -> target addr
+	static      map[string]map[string]*Target // service name -> target addr
+	weights     map[string]map[string]int     // service name -> target addr
+
+	changeNotify chan bool
+	sync.RWMutex
+}
+
+type Override struct {
+	ServiceName string
+	Kind        string
+	TargetAddr  string `json:",omitempty"`
+	Weight      *int   `json:",omitempty"`
+}
+
+func NewOverrides() *Overrides {
+	return &Overrides{
+		maintenance:  make(map[string]bool),
+		drained:      make(map[string]map[string]bool),
+		static:       make(map[string]map[string]*Target),
+		weights:      make(map[string]map[string]int),
+		changeNotify: make(chan bool, 1),
+	}
+}
+
+func OverridesFromContext(ctx context.Context) *Overrides {
+	overrides, _ := ctx.Value(OVERRIDES_KEY).(*Overrides)
+	return overrides
+}
+
+// ChangeNotify fires when overrides changed and upstreams should be
+// loaded again
+func (o *Overrides) ChangeNotify() <-chan bool {
+	if o == nil {
+		return nil
+	}
+	return o.changeNotify
+}
+
+func (o *Overrides) notify() {
+	select {
+	case o.changeNotify <- true:
+	default:
+	}
+}
+
+func (o *Overrides) SetMaintenance(serviceName string, on bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if on {
+		o.maintenance[serviceName] = true
+	} else {
+		delete(o.maintenance, serviceName)
+	}
+}
+
+func (o *Overrides) InMaintenance(serviceName string) bool {
+	if o == nil {
+		return false
+	}
+
+	o.RLock()
+	defer o.RUnlock()
+	return o.maintenance[serviceName]
+}
+
+// DrainTarget takes a target out of rotation without deregistering it
+func (o *Overrides) DrainTarget(serviceName, targetAddr string) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.drained[serviceName] == nil {
+		o.drained[serviceName] = make(map[string]bool)
+	}
+	o.drained[serviceName][targetAddr] = true
+	o.notify()
+}
+
+func (o *Overrides) UndrainTarget(serviceName, targetAddr string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.drained[serviceName][targetAddr] {
+		return false
+	}
+	delete(o.drained[serviceName], targetAddr)
+	o.notify()
+	return true
+}
+
+func (o *Overrides) AddStaticTarget(serviceName string, target *Target) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.static[serviceName] == nil {
+		o.static[serviceName] = make(map[string]*Target)
+	}
+	o.static[serviceName][target.Addr()] = target
+	o.notify()
+}
+
+func (o *Overrides) RemoveStaticTarget(serviceName, targetAddr string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, found := o.static[serviceName][targetAddr]; !found {
+		return false
+	}
+	delete(o.static[serviceName], targetAddr)
+	o.notify()
+	return true
+}
+
+// SetTargetWeight replaces the weight a target is loaded with, 0 to send
+// it no new traffic under a weighted strategy
+func (o *Overrides) SetTargetWeight(serviceName, targetAddr string, weight int) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.weights[serviceName] == nil {
+		o.weights[serviceName] = make(map[string]int)
+	}
+	o.weights[serviceName][targetAddr] = weight
+	o.notify()
+}
+
+func (o *Overrides) ClearTargetWeight(serviceName, targetAddr string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, found := o.weights[serviceName][targetAddr]; !found {
+		return false
+	}
+	delete(o.weights[serviceName], targetAddr)
+	o.notify()
+	return true
+}
+
+// List returns every override ordered by service name
+func (o *Overrides) List() []Override {
+	o.RLock()
+	defer o.RUnlock()
+
+	overrides := make([]Override, 0)
+	for serviceName := range o.maintenance {
+		overrides = append(overrides, Override{ServiceName: serviceName, Kind: OVERRIDE_MAINTENANCE})
+	}
+	for serviceName, targets := range o.drained {
+		for addr := range targets {
+			overrides = append(overrides, Override{ServiceName: serviceName, Kind: OVERRIDE_DRAIN, TargetAddr: addr})
+		}
+	}
+	for serviceName, targets := range o.static {
+		for addr := range targets {
+			overrides = append(overrides, Override{ServiceName: serviceName, Kind: OVERRIDE_STATIC, TargetAddr: addr})
+		}
+	}
+
+	for serviceName, targets := range o.weights {
+		for addr, weight := range targets {
+			weight := weight
+			overrides = append(overrides, Override{ServiceName: serviceName, Kind: OVERRIDE_WEIGHT, TargetAddr: addr, Weight: &weight})
+		}
+	}
+
+	sort.Sort(overridesByService(overrides))
+	return overrides
+}
+
+type overridesByService []Override
+
+func (s overridesByService) Len() int      { return len(s) }
+func (s overridesByService) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s overridesByService) Less(i, j int) bool {
+	if s[i].ServiceName != s[j].ServiceName {
+		return s[i].ServiceName < s[j].ServiceName
+	}
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	return s[i].TargetAddr < s[j].TargetAddr
+}
+
+// Apply removes the drained targets from a freshly loaded upstream, adds
+// its static ones and sets the weights overridden
+func (o *Overrides) Apply(u *Upstream) {
+	if o == nil {
+		return
+	}
+
+	o.RLock()
+	defer o.RUnlock()
+
+	drained := o.drained[u.ServiceName]
+	targets := make([]*Target, 0, len(u.Targets))
+	for _, t := range u.Targets {
+		if !drained[t.Addr()] {
+			targets = append(targets, t)
+		}
+	}
+
+	addrs := make([]string, 0, len(o.static[u.ServiceName]))
+	for addr := range o.static[u.ServiceName] {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		static := *o.static[u.ServiceName][addr]
+		static.ServiceName = u.ServiceName
+		static.Upstream = u
+		targets = append(targets, &static)
+	}
+
+	for i, t := range targets {
+		if weight, found := o.weights[u.ServiceName][t.Addr()]; found && weight != t.Weight {
+			weighted := *t
+			weighted.Weight = weight
+			targets[i] = &weighted
+		}
+	}
+
+	u.Targets = targets
+}
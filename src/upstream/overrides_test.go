@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverridesApply(t *testing.T) {
+	overrides := NewOverrides()
+	overrides.DrainTarget("mesos", "192.168.1.103:5100")
+	overrides.AddStaticTarget("mesos", &Target{ServiceAddress: "10.0.0.1", ServicePort: "80"})
+
+	u := &Upstream{ServiceName: "mesos"}
+	u.Targets = []*Target{
+		{ServiceAddress: "192.168.1.103", ServicePort: "5100"},
+		{ServiceAddress: "192.168.1.104", ServicePort: "5100"},
+	}
+	overrides.Apply(u)
+
+	assert.Equal(t, len(u.Targets), 2)
+	assert.Equal(t, u.Targets[0].Addr(), "192.168.1.104:5100")
+	assert.Equal(t, u.Targets[1].Addr(), "10.0.0.1:80")
+	assert.Equal(t, u.Targets[1].Upstream, u)
+	assert.Equal(t, u.Targets[1].ServiceName, "mesos")
+}
+
+func TestOverridesTargetWeight(t *testing.T) {
+	overrides := NewOverrides()
+	overrides.SetTargetWeight("mesos", "192.168.1.103:5100", 0)
+	loaded := &Target{ServiceAddress: "192.168.1.103", ServicePort: "5100", Weight: DEFAULT_WEIGHT}
+
+	u := &Upstream{ServiceName: "mesos", Targets: []*Target{loaded}}
+	overrides.Apply(u)
+	assert.Equal(t, u.Targets[0].Weight, 0)
+	// the target loaded is left as it is
+	assert.Equal(t, loaded.Weight, DEFAULT_WEIGHT)
+	assert.Equal(t, *overrides.List()[0].Weight, 0)
+
+	assert.True(t, overrides.ClearTargetWeight("mesos", "192.168.1.103:5100"))
+	assert.False(t, overrides.ClearTargetWeight("mesos", "192.168.1.103:5100"))
+	u = &Upstream{ServiceName: "mesos", Targets: []*Target{loaded}}
+	overrides.Apply(u)
+	assert.Equal(t, u.Targets[0].Weight, DEFAULT_WEIGHT)
+}
+
+func TestOverridesRevert(t *testing.T) {
+	overrides := NewOverrides()
+	overrides.SetMaintenance("mesos", true)
+	overrides.DrainTarget("mesos", "192.168.1.103:5100")
+	assert.True(t, overrides.InMaintenance("mesos"))
+	assert.Equal(t, len(overrides.List()), 2)
+
+	select {
+	case <-overrides.ChangeNotify():
+	default:
+		t.Error("drain should notify a change")
+	}
+
+	overrides.SetMaintenance("mesos", false)
+	assert.True(t, overrides.UndrainTarget("mesos", "192.168.1.103:5100"))
+	assert.False(t, overrides.UndrainTarget("mesos", "192.168.1.103:5100"))
+	assert.Equal(t, len(overrides.List()), 0)
+}
+
+func TestNilOverrides(t *testing.T) {
+	var overrides *Overrides
+	assert.False(t, overrides.InMaintenance("mesos"))
+	overrides.Apply(&Upstream{})
+}
@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"time"
+)
+
+const (
+	RETRY_MIN_DELAY = time.Second
+	RETRY_MAX_DELAY = time.Second * 30
+)
+
+// retryDelay doubles the delay between two failed attempts, from
+// RETRY_MIN_DELAY up to RETRY_MAX_DELAY
+type retryDelay struct {
+	delay time.Duration
+}
+
+func newRetryDelay() *retryDelay {
+	return &retryDelay{delay: RETRY_MIN_DELAY}
+}
+
+func (r *retryDelay) Wait() {
+	time.Sleep(r.delay)
+	r.delay = r.delay * 2
+	if r.delay > RETRY_MAX_DELAY {
+		r.delay = RETRY_MAX_DELAY
+	}
+}
+
+func (r *retryDelay) Reset() {
+	r.delay = RETRY_MIN_DELAY
+}
@@ -0,0 +1,333 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+)
+
+const (
+	// tags of a borg service are borg-<key>:<value>, like
+	// borg-frontend-port:3412, route and the header keys may be repeated
+	SERVICE_TAG_PREFIX = "borg-"
+
+	SERVICE_TAG_FRONTEND_PORT           = "frontend-port"
+	SERVICE_TAG_FRONTEND_PROTO          = "frontend-proto"
+	SERVICE_TAG_FRONTEND_PRIORITY       = "frontend-priority" // under upstream.conflict_policy priority
+	SERVICE_TAG_LB_STRATEGY             = "lb-strategy"
+	SERVICE_TAG_HASH_KEY                = "hash-key" // under lb-strategy chash
+	SERVICE_TAG_WEIGHT                  = "weight"   // on the tags of an instance
+	SERVICE_TAG_DIAL_TIMEOUT            = "dial-timeout"
+	SERVICE_TAG_RESPONSE_HEADER_TIMEOUT = "response-header-timeout"
+	SERVICE_TAG_HEALTH_CHECK_PATH       = "health-check-path" // informational, not probed
+	SERVICE_TAG_ROUTE                   = "route"             // host/path, /path or host
+	SERVICE_TAG_REQUEST_HEADER          = "request-header"    // Name=value
+	SERVICE_TAG_RESPONSE_HEADER         = "response-header"   // Name=value
+	SERVICE_TAG_TLS_SKIP_VERIFY         = "tls-skip-verify"
+	SERVICE_TAG_TLS_SERVER_NAME         = "tls-server-name"
+)
+
+// ServiceSettings tune how janitor serves a service, beyond its frontend
+// and targets. Zero values keep the settings of the janitor config
+type ServiceSettings struct {
+	Priority              int               `json:",omitempty"` // of the claim on the frontend
+	Strategy              string            `json:",omitempty"` // load balancing strategy
+	HashKey               string            `json:",omitempty"` // ip, header:<name>, cookie:<name> or query:<name>
+	DialTimeout           time.Duration     `json:",omitempty"`
+	ResponseHeaderTimeout time.Duration     `json:",omitempty"`
+	HealthCheckPath       string            `json:",omitempty"` // shown by the admin api, janitor does not probe it
+	RequestHeaders        map[string]string `json:",omitempty"` // set on the requests to the targets
+	ResponseHeaders       map[string]string `json:",omitempty"` // set on the responses to the clients
+	TLSSkipVerify         bool              `json:",omitempty"` // of https targets
+	TLSServerName         string            `json:",omitempty"`
+}
+
+// serviceDocument describes a service with the same keys as its tags, it
+// is either read from the tags or stored in the consul kv as json
+//
+//	{
+//	  "frontend_port": 3412,
+//	  "lb_strategy": "rr",
+//	  "weights": {"web-1": 3},
+//	  "dial_timeout": "2s",
+//	  "routes": ["web.example.com/api"],
+//	  "request_headers": {"X-Env": "prod"}
+//	}
+//
+// weights are keyed by service id, between 0 and MAX_WEIGHT
+type serviceDocument struct {
+	FrontendPort          flexString        `json:"frontend_port"`
+	FrontendProto         string            `json:"frontend_proto"`
+	FrontendPriority      flexString        `json:"frontend_priority"`
+	Strategy              string            `json:"lb_strategy"`
+	HashKey               string            `json:"hash_key"`
+	Weights               map[string]int    `json:"weights"`
+	DialTimeout           string            `json:"dial_timeout"`
+	ResponseHeaderTimeout string            `json:"response_header_timeout"`
+	HealthCheckPath       string            `json:"health_check_path"`
+	Routes                []string          `json:"routes"`
+	RequestHeaders        map[string]string `json:"request_headers"`
+	ResponseHeaders       map[string]string `json:"response_headers"`
+	TLSSkipVerify         *bool             `json:"tls_skip_verify"`
+	TLSServerName         string            `json:"tls_server_name"`
+}
+
+// parseServiceTags reads the borg-<key>:<value> tags of a service, the
+// former <key>-<value> form being kept for the frontend port and proto
+func parseServiceTags(tags []string) (serviceDocument, []string) {
+	doc := serviceDocument{}
+	problems := make([]string, 0)
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, SERVICE_TAG_PREFIX) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(tag, SERVICE_TAG_PREFIX), ":", 2)
+		if len(kv) != 2 {
+			problems = append(problems, fmt.Sprintf("tag %s should be %s<key>:<value>", tag, SERVICE_TAG_PREFIX))
+			continue
+		}
+		key, value := kv[0], kv[1]
+
+		switch key {
+		case SERVICE_TAG_FRONTEND_PORT:
+			doc.FrontendPort = flexString(value)
+		case SERVICE_TAG_FRONTEND_PROTO:
+			doc.FrontendProto = value
+		case SERVICE_TAG_FRONTEND_PRIORITY:
+			doc.FrontendPriority = flexString(value)
+		case SERVICE_TAG_LB_STRATEGY:
+			doc.Strategy = value
+		case SERVICE_TAG_HASH_KEY:
+			doc.HashKey = value
+		case SERVICE_TAG_DIAL_TIMEOUT:
+			doc.DialTimeout = value
+		case SERVICE_TAG_RESPONSE_HEADER_TIMEOUT:
+			doc.ResponseHeaderTimeout = value
+		case SERVICE_TAG_HEALTH_CHECK_PATH:
+			doc.HealthCheckPath = value
+		case SERVICE_TAG_ROUTE:
+			doc.Routes = append(doc.Routes, value)
+		case SERVICE_TAG_REQUEST_HEADER, SERVICE_TAG_RESPONSE_HEADER:
+			header := strings.SplitN(value, "=", 2)
+			if len(header) != 2 || header[0] == "" {
+				problems = append(problems, fmt.Sprintf("tag %s should be %s%s:Name=value", tag, SERVICE_TAG_PREFIX, key))
+				continue
+			}
+			if key == SERVICE_TAG_REQUEST_HEADER {
+				doc.RequestHeaders = setHeader(doc.RequestHeaders, header[0], header[1])
+			} else {
+				doc.ResponseHeaders = setHeader(doc.ResponseHeaders, header[0], header[1])
+			}
+		case SERVICE_TAG_TLS_SKIP_VERIFY:
+			skip, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("tag %s should be true or false", tag))
+				continue
+			}
+			doc.TLSSkipVerify = &skip
+		case SERVICE_TAG_TLS_SERVER_NAME:
+			doc.TLSServerName = value
+		case SERVICE_TAG_WEIGHT:
+			// read from the instances
+		default:
+			problems = append(problems, fmt.Sprintf("tag %s has an unknown key %s", tag, key))
+		}
+	}
+
+	if doc.FrontendPort == "" {
+		doc.FrontendPort = flexString(ParseValueFromTags(BORG_FRONTEND_PORT, tags))
+	}
+	if doc.FrontendProto == "" {
+		doc.FrontendProto = ParseValueFromTags(BORG_FRONTEND_PROTO, tags)
+	}
+	return doc, problems
+}
+
+func setHeader(headers map[string]string, name, value string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[name] = value
+	return headers
+}
+
+// parseServiceDocument reads a json service document
+func parseServiceDocument(data []byte) (serviceDocument, error) {
+	doc := serviceDocument{}
+	err := json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// overlay returns doc with the keys set in over replacing its own
+func (doc serviceDocument) overlay(over serviceDocument) serviceDocument {
+	if over.FrontendPort != "" {
+		doc.FrontendPort = over.FrontendPort
+	}
+	if over.FrontendProto != "" {
+		doc.FrontendProto = over.FrontendProto
+	}
+	if over.FrontendPriority != "" {
+		doc.FrontendPriority = over.FrontendPriority
+	}
+	if over.Strategy != "" {
+		doc.Strategy = over.Strategy
+	}
+	if over.HashKey != "" {
+		doc.HashKey = over.HashKey
+	}
+	if over.Weights != nil {
+		doc.Weights = over.Weights
+	}
+	if over.DialTimeout != "" {
+		doc.DialTimeout = over.DialTimeout
+	}
+	if over.ResponseHeaderTimeout != "" {
+		doc.ResponseHeaderTimeout = over.ResponseHeaderTimeout
+	}
+	if over.HealthCheckPath != "" {
+		doc.HealthCheckPath = over.HealthCheckPath
+	}
+	if over.Routes != nil {
+		doc.Routes = over.Routes
+	}
+	if over.RequestHeaders != nil {
+		doc.RequestHeaders = over.RequestHeaders
+	}
+	if over.ResponseHeaders != nil {
+		doc.ResponseHeaders = over.ResponseHeaders
+	}
+	if over.TLSSkipVerify != nil {
+		doc.TLSSkipVerify = over.TLSSkipVerify
+	}
+	if over.TLSServerName != "" {
+		doc.TLSServerName = over.TLSServerName
+	}
+	return doc
+}
+
+// settings validates the document, a value found invalid is left out and
+// reported as a problem
+func (doc serviceDocument) settings() (ServiceSettings, []Route, []string) {
+	settings := ServiceSettings{
+		RequestHeaders:  doc.RequestHeaders,
+		ResponseHeaders: doc.ResponseHeaders,
+		TLSServerName:   doc.TLSServerName,
+	}
+	problems := make([]string, 0)
+
+	durations := []struct {
+		key   string
+		value string
+		field *time.Duration
+	}{
+		{SERVICE_TAG_DIAL_TIMEOUT, doc.DialTimeout, &settings.DialTimeout},
+		{SERVICE_TAG_RESPONSE_HEADER_TIMEOUT, doc.ResponseHeaderTimeout, &settings.ResponseHeaderTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration <= 0 {
+			problems = append(problems, fmt.Sprintf("%s %q should be a positive duration like 5s", d.key, d.value))
+			continue
+		}
+		*d.field = duration
+	}
+
+	if doc.FrontendPriority != "" {
+		priority, err := strconv.Atoi(string(doc.FrontendPriority))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q should be an integer", SERVICE_TAG_FRONTEND_PRIORITY, doc.FrontendPriority))
+		} else {
+			settings.Priority = priority
+		}
+	}
+
+	if doc.Strategy != "" {
+		if err := config.ValidateStrategy(doc.Strategy); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s", SERVICE_TAG_LB_STRATEGY, err))
+		} else {
+			settings.Strategy = doc.Strategy
+		}
+	}
+	if doc.HashKey != "" {
+		if err := config.ValidateHashKey(doc.HashKey); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s", SERVICE_TAG_HASH_KEY, err))
+		} else {
+			settings.HashKey = doc.HashKey
+		}
+	}
+
+	if doc.HealthCheckPath != "" {
+		if strings.HasPrefix(doc.HealthCheckPath, "/") {
+			settings.HealthCheckPath = doc.HealthCheckPath
+		} else {
+			problems = append(problems, fmt.Sprintf("%s %q should start with /", SERVICE_TAG_HEALTH_CHECK_PATH, doc.HealthCheckPath))
+		}
+	}
+
+	if doc.TLSSkipVerify != nil {
+		settings.TLSSkipVerify = *doc.TLSSkipVerify
+	}
+
+	for name := range settings.RequestHeaders {
+		if name == "" || strings.ContainsAny(name, " :") {
+			problems = append(problems, fmt.Sprintf("%s %q is not a header name", SERVICE_TAG_REQUEST_HEADER, name))
+			delete(settings.RequestHeaders, name)
+		}
+	}
+	for name := range settings.ResponseHeaders {
+		if name == "" || strings.ContainsAny(name, " :") {
+			problems = append(problems, fmt.Sprintf("%s %q is not a header name", SERVICE_TAG_RESPONSE_HEADER, name))
+			delete(settings.ResponseHeaders, name)
+		}
+	}
+
+	routes := make([]Route, 0, len(doc.Routes))
+	for _, raw := range doc.Routes {
+		route, err := parseRoute(raw)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	return settings, routes, problems
+}
+
+// parseRoute reads host/path, /path or host, a path ending with $ is
+// matched exactly
+func parseRoute(raw string) (Route, error) {
+	route := Route{}
+	if i := strings.Index(raw, "/"); i >= 0 {
+		route.Host, route.Path = raw[:i], raw[i:]
+	} else {
+		route.Host = raw
+	}
+	if strings.HasSuffix(route.Path, "$") {
+		route.Path = strings.TrimSuffix(route.Path, "$")
+		route.Exact = true
+	}
+
+	if route.Host == "" && route.Path == "" || strings.ContainsAny(route.Host, " :") {
+		return route, fmt.Errorf("%s %q should be like web.example.com/api", SERVICE_TAG_ROUTE, raw)
+	}
+	return route, nil
+}
+
+// SettingsEqual tells whether two upstreams have the same settings
+func (u *Upstream) SettingsEqual(u1 *Upstream) bool {
+	return settingsKey(u.Settings) == settingsKey(u1.Settings)
+}
+
+func settingsKey(settings ServiceSettings) string {
+	data, _ := json.Marshal(settings)
+	return string(data)
+}
@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServiceTags(t *testing.T) {
+	doc, problems := parseServiceTags([]string{
+		BORG_TAG,
+		"borg-frontend-port:3412",
+		"borg-frontend-proto:https",
+		"borg-request-header:X-Env=prod",
+		"borg-response-header:X-Served-By",
+		"borg-tls-skip-verify:yes",
+		"borg-color:blue",
+		"borg-route:web.example.com/api",
+		"borg-route:/health$",
+	})
+	assert.Equal(t, string(doc.FrontendPort), "3412")
+	assert.Equal(t, doc.FrontendProto, "https")
+	assert.Equal(t, doc.RequestHeaders, map[string]string{"X-Env": "prod"})
+	assert.Nil(t, doc.TLSSkipVerify)
+	assert.Equal(t, len(problems), 3)
+
+	settings, routes, problems := doc.settings()
+	assert.Equal(t, settings.RequestHeaders["X-Env"], "prod")
+	assert.Equal(t, routes, []Route{{Host: "web.example.com", Path: "/api"}, {Path: "/health", Exact: true}})
+	assert.Equal(t, len(problems), 0)
+
+	// the former form
+	doc, problems = parseServiceTags([]string{BORG_TAG, "port-8080", "proto-tcp"})
+	assert.Equal(t, string(doc.FrontendPort), "8080")
+	assert.Equal(t, doc.FrontendProto, "tcp")
+	assert.Equal(t, len(problems), 0)
+}
+
+func TestServiceDocumentOverlay(t *testing.T) {
+	tags, _ := parseServiceTags([]string{"borg-frontend-port:3412", "borg-lb-strategy:rr", "borg-hash-key:header:X-User", "borg-dial-timeout:1s"})
+	kv, err := parseServiceDocument([]byte(`{"frontend_port": 3413, "dial_timeout": "2s", "health_check_path": "health", "tls_skip_verify": true}`))
+	assert.Nil(t, err)
+
+	doc := tags.overlay(kv)
+	assert.Equal(t, string(doc.FrontendPort), "3413")
+	assert.Equal(t, doc.Strategy, "rr")
+
+	settings, _, problems := doc.settings()
+	assert.Equal(t, settings.DialTimeout, time.Second*2)
+	assert.Equal(t, settings.HashKey, "header:X-User")
+	assert.True(t, settings.TLSSkipVerify)
+	assert.Equal(t, settings.HealthCheckPath, "")
+	assert.Equal(t, len(problems), 1)
+}
+
+func TestParseValueFromTags(t *testing.T) {
+	assert.Equal(t, ParseValueFromTags(BORG_FRONTEND_PORT, []string{"borg", "port-3412"}), "3412")
+	assert.Equal(t, ParseValueFromTags(BORG_FRONTEND_PROTO, []string{"proto-http-2"}), "http-2")
+	assert.Equal(t, ParseValueFromTags(BORG_FRONTEND_PORT, []string{"borg-frontend-port:3412"}), "")
+}
+
+func TestServiceDocumentStrategy(t *testing.T) {
+	doc, _ := parseServiceTags([]string{"borg-lb-strategy:fastest", "borg-hash-key:cookie"})
+	settings, _, problems := doc.settings()
+	assert.Equal(t, settings.Strategy, "")
+	assert.Equal(t, settings.HashKey, "")
+	assert.Equal(t, len(problems), 2)
+
+	doc, _ = parseServiceTags([]string{"borg-lb-strategy:rr", "borg-hash-key:query:user"})
+	settings, _, problems = doc.settings()
+	assert.Equal(t, settings.Strategy, "rr")
+	assert.Equal(t, settings.HashKey, "query:user")
+	assert.Equal(t, len(problems), 0)
+}
@@ -0,0 +1,203 @@
+package upstream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SnapshotUpstreamLoader keeps the last upstreams of a loader in a file, so
+// that janitor serves them on startup while the source is unreachable.
+// They are stale until the loader synced, its upstreams then replace them
+// and are saved again on every change
+type SnapshotUpstreamLoader struct {
+	UpstreamLoader
+
+	Config config.Upstream
+	Loader UpstreamLoader
+
+	served  *upstreamSet
+	changed chan bool
+	sync.Mutex
+
+	stale        bool
+	staleAt      time.Time // when the snapshot served was saved
+	loaderSynced bool      // the loader sent EVENT_SYNCED
+}
+
+type upstreamSnapshot struct {
+	SavedAt   time.Time
+	Upstreams []*Upstream
+}
+
+// InitSnapshotUpstreamLoader serves the snapshot at Config.SnapshotPath
+// until loader synced, the overrides being applied by loader
+func InitSnapshotUpstreamLoader(Config config.Upstream, loader UpstreamLoader) (*SnapshotUpstreamLoader, error) {
+	snapshotUpstreamLoader := &SnapshotUpstreamLoader{
+		Config:  Config,
+		Loader:  loader,
+		served:  newUpstreamSet(nil, Config.ConflictPolicy),
+		changed: make(chan bool, 1),
+	}
+
+	snapshot, err := readUpstreamSnapshot(Config.SnapshotPath)
+	switch {
+	case os.IsNotExist(err):
+		log.Infof("no upstream snapshot at %s yet", Config.SnapshotPath)
+	case err != nil:
+		log.Errorf("read upstream snapshot %s got err: %s", Config.SnapshotPath, err)
+	default:
+		log.Infof("serve %d upstreams of the snapshot saved at %s until %s synced", len(snapshot.Upstreams), snapshot.SavedAt, Config.SourceType)
+		snapshotUpstreamLoader.stale = true
+		snapshotUpstreamLoader.staleAt = snapshot.SavedAt
+		snapshotUpstreamLoader.served.update(snapshot.Upstreams)
+		snapshotUpstreamLoader.served.synced()
+	}
+
+	go snapshotUpstreamLoader.Poll()
+	go snapshotUpstreamLoader.follow()
+
+	return snapshotUpstreamLoader, nil
+}
+
+// Poll serves the upstreams of the loader whenever they change, once it
+// synced, and saves them
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Poll() {
+	for range snapshotUpstreamLoader.changed {
+		snapshotUpstreamLoader.Lock()
+		if snapshotUpstreamLoader.loaderSynced {
+			snapshotUpstreamLoader.reconcile()
+			snapshotUpstreamLoader.served.synced()
+		}
+		snapshotUpstreamLoader.Unlock()
+	}
+}
+
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) notifyChanged() {
+	select {
+	case snapshotUpstreamLoader.changed <- true:
+	default:
+	}
+}
+
+// follow drains the events of the loader, its upstreams are read again
+// rather than replaying them
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) follow() {
+	for event := range snapshotUpstreamLoader.Loader.Events() {
+		if event.Type == EVENT_FRONTEND_CONFLICT {
+			snapshotUpstreamLoader.served.events <- event
+			continue
+		}
+		if event.Type == EVENT_SYNCED {
+			snapshotUpstreamLoader.Lock()
+			snapshotUpstreamLoader.loaderSynced = true
+			snapshotUpstreamLoader.Unlock()
+		}
+		snapshotUpstreamLoader.notifyChanged()
+	}
+}
+
+// reconcile serves the upstreams of the loader in place of the snapshot
+// and saves them, callers must hold the lock
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) reconcile() {
+	if snapshotUpstreamLoader.stale {
+		log.Infof("%s synced, the upstream snapshot is replaced", snapshotUpstreamLoader.Config.SourceType)
+		snapshotUpstreamLoader.stale = false
+		snapshotUpstreamLoader.staleAt = time.Time{}
+	}
+
+	snapshotUpstreamLoader.served.update(snapshotUpstreamLoader.Loader.List())
+
+	snapshot := upstreamSnapshot{SavedAt: time.Now(), Upstreams: snapshotUpstreamLoader.served.list()}
+	if err := writeUpstreamSnapshot(snapshotUpstreamLoader.Config.SnapshotPath, snapshot); err != nil {
+		log.Errorf("save upstream snapshot %s got err: %s", snapshotUpstreamLoader.Config.SnapshotPath, err)
+	}
+}
+
+// Stale tells whether the upstreams served come from the snapshot, and
+// when it was saved
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Stale() (bool, time.Time) {
+	snapshotUpstreamLoader.Lock()
+	defer snapshotUpstreamLoader.Unlock()
+	return snapshotUpstreamLoader.stale, snapshotUpstreamLoader.staleAt
+}
+
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) List() []*Upstream {
+	snapshotUpstreamLoader.Lock()
+	defer snapshotUpstreamLoader.Unlock()
+	return snapshotUpstreamLoader.served.list()
+}
+
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Get(serviceName string) *Upstream {
+	snapshotUpstreamLoader.Lock()
+	defer snapshotUpstreamLoader.Unlock()
+	return snapshotUpstreamLoader.served.get(serviceName)
+}
+
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Events() <-chan UpstreamEvent {
+	return snapshotUpstreamLoader.served.events
+}
+
+// Conflicts are the ones of the loader, the snapshot holds the upstreams
+// it served
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Conflicts() []FrontendConflict {
+	return snapshotUpstreamLoader.Loader.Conflicts()
+}
+
+// Reload hands the config to the loader, a new snapshot path requires a
+// restart
+func (snapshotUpstreamLoader *SnapshotUpstreamLoader) Reload(Config config.Upstream) {
+	if Config.SnapshotPath != snapshotUpstreamLoader.Config.SnapshotPath {
+		log.Warnf("upstream snapshot path change requires a restart")
+	}
+	snapshotUpstreamLoader.Loader.Reload(Config)
+}
+
+func readUpstreamSnapshot(path string) (*upstreamSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &upstreamSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	for _, u := range snapshot.Upstreams {
+		for _, t := range u.Targets {
+			t.Upstream = u
+		}
+	}
+	return snapshot, nil
+}
+
+// writeUpstreamSnapshot replaces the snapshot at path at once, a crash
+// leaves the previous one in place
+func writeUpstreamSnapshot(path string, snapshot upstreamSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
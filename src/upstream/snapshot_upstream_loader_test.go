@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Dataman-Cloud/janitor/src/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotUpstreamLoader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+
+	// a first run saves the upstreams of consul
+	consul := newFakeUpstreamLoader()
+	loader, err := InitSnapshotUpstreamLoader(config.Upstream{SourceType: "consul", SnapshotPath: path}, consul)
+	assert.Nil(t, err)
+	consul.load(testUpstream("web", "8080", "10.0.0.1", "10.0.0.2"))
+	waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	waitEvent(t, loader, EVENT_SYNCED)
+	stale, _ := loader.Stale()
+	assert.False(t, stale)
+
+	// the next one starts while consul is down
+	consul = newFakeUpstreamLoader()
+	loader, err = InitSnapshotUpstreamLoader(config.Upstream{SourceType: "consul", SnapshotPath: path}, consul)
+	assert.Nil(t, err)
+	event := waitEvent(t, loader, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, event.Upstream.Key(), UpstreamKey{Proto: "http", Ip: "127.0.0.1", Port: "8080"})
+	assert.Equal(t, len(event.Upstream.Targets), 2)
+	assert.Equal(t, event.Upstream.Targets[1].Addr(), "10.0.0.2:80")
+	assert.Equal(t, event.Upstream.Targets[1].Upstream, event.Upstream)
+	waitEvent(t, loader, EVENT_SYNCED)
+	stale, savedAt := loader.Stale()
+	assert.True(t, stale)
+	assert.False(t, savedAt.IsZero())
+
+	// consul is back with web-2 gone
+	consul.load(testUpstream("web", "8080", "10.0.0.1"))
+	event = waitEvent(t, loader, EVENT_TARGETS_CHANGED)
+	assert.Equal(t, event.RemovedTargets[0].Addr(), "10.0.0.2:80")
+	stale, _ = loader.Stale()
+	assert.False(t, stale)
+
+	snapshot, err := readUpstreamSnapshot(path)
+	assert.Nil(t, err)
+	assert.Equal(t, len(snapshot.Upstreams[0].Targets), 1)
+}
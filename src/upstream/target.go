@@ -8,6 +8,13 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+const (
+	DEFAULT_WEIGHT = 1
+	// bound of the weights, a consistent hash ring holding points for
+	// each unit of weight of its targets
+	MAX_WEIGHT = 256
+)
+
 type Target struct {
 	Node           string
 	Address        string
@@ -15,7 +22,21 @@ type Target struct {
 	ServiceID      string
 	ServiceAddress string
 	ServicePort    string
-	Upstream       *Upstream
+	Metadata       map[string]string `json:",omitempty"`
+	Upstream       *Upstream         `json:"-"`
+
+	// as announced by the source, like the priority of a dns SRV record,
+	// 0 when it has none
+	Priority int `json:",omitempty"`
+
+	// share of the requests under a weighted strategy, DEFAULT_WEIGHT when
+	// the source announces none, 0 to receive no new traffic, MAX_WEIGHT
+	// at most
+	Weight int
+
+	// source type of the loader which found the target, set when several
+	// sources are combined
+	Source string `json:",omitempty"`
 }
 
 func (t *Target) Equal(t1 *Target) bool {
@@ -24,17 +45,33 @@ func (t *Target) Equal(t1 *Target) bool {
 		t.ServiceName == t1.ServiceName &&
 		t.ServiceID == t1.ServiceID &&
 		t.ServiceAddress == t1.ServiceAddress &&
-		t.ServicePort == t1.ServicePort
+		t.ServicePort == t1.ServicePort &&
+		t.Priority == t1.Priority &&
+		t.Weight == t1.Weight &&
+		t.Source == t1.Source
 }
 
 func (t *Target) ToString() string {
-	return fmt.Sprintf("%s-%s-%s-%s-%s-%s", t.Node, t.Address, t.ServiceName, t.ServiceID, t.ServiceAddress, t.ServicePort)
+	return fmt.Sprintf("%s-%s-%s-%s-%s-%s-%d-%d-%s", t.Node, t.Address, t.ServiceName, t.ServiceID, t.ServiceAddress, t.ServicePort, t.Priority, t.Weight, t.Source)
+}
+
+// ValidateWeight tells whether weight is within 0 and MAX_WEIGHT
+func ValidateWeight(weight int) error {
+	if weight < 0 || weight > MAX_WEIGHT {
+		return fmt.Errorf("weight %d should be between 0 and %d", weight, MAX_WEIGHT)
+	}
+	return nil
+}
+
+// Addr is the host:port the target serves on
+func (t *Target) Addr() string {
+	return net.JoinHostPort(t.ServiceAddress, t.ServicePort)
 }
 
 func (t Target) Entry() *url.URL {
 	url, err := url.Parse(fmt.Sprintf("%s://%s", t.Upstream.FrontendProto, net.JoinHostPort(t.ServiceAddress, t.ServicePort)))
 	if err != nil {
-		log.Error("parse target.Address %s to url got err %s", t.Address, err)
+		log.Errorf("parse target.Address %s to url got err %s", t.Address, err)
 	}
 
 	return url
@@ -0,0 +1,31 @@
+package upstream
+
+import (
+	"sync/atomic"
+)
+
+// TargetSet is the live set of targets of a service pod. It is read on
+// every request and replaced as a whole when targets change, so a request
+// sees either the old or the new set, and requests in flight to a removed
+// target are left to finish
+type TargetSet struct {
+	targets atomic.Value // []*Target
+}
+
+func NewTargetSet(targets []*Target) *TargetSet {
+	set := &TargetSet{}
+	set.Swap(targets)
+	return set
+}
+
+// Targets returns the current targets, the slice must not be modified
+func (set *TargetSet) Targets() []*Target {
+	targets, _ := set.targets.Load().([]*Target)
+	return targets
+}
+
+func (set *TargetSet) Swap(targets []*Target) {
+	snapshot := make([]*Target, len(targets))
+	copy(snapshot, targets)
+	set.targets.Store(snapshot)
+}
@@ -4,64 +4,80 @@ import (
 	"fmt"
 	"sort"
 	"strings"
-
-	log "github.com/Sirupsen/logrus"
 )
 
 type Upstream struct {
-	State     *UpstreamState // new|listening|outdated|changed
-	StaleMark bool           // mark if the current upstream not inuse anymore
-
 	ServiceName   string `json:"ServiceName"`
 	FrontendPort  string // port listen
 	FrontendIp    string // ip listen
 	FrontendProto string // http|https|tcp
 
 	Targets []*Target `json:"Target"`
-}
 
-type UpstreamKey struct {
-	Proto string
-	Ip    string
-	Port  string
-}
+	// host and path routes, when set only the http requests matching one
+	// of them are proxied
+	Routes []Route `json:",omitempty"`
 
-func (uk UpstreamKey) ToString() string {
-	return fmt.Sprintf("%s://%s:%s", uk.Proto, uk.Ip, uk.Port)
-}
+	Settings ServiceSettings
 
-type UpstreamStateEnum string
-
-const (
-	STATE_NEW       UpstreamStateEnum = "new"
-	STATE_LISTENING UpstreamStateEnum = "listening"
-	STATE_OUTDATED  UpstreamStateEnum = "outdated"
-	STATE_CHANGED   UpstreamStateEnum = "changed"
-)
+	// problems found in the description of the service, the values
+	// concerned are left out
+	Problems []string `json:",omitempty"`
 
-type UpstreamState struct {
-	state    UpstreamStateEnum
-	upstream *Upstream
+	// order the source registered the service in, like the consul
+	// CreateIndex of its oldest instance, 0 when the source tells none
+	RegisteredIndex uint64 `json:",omitempty"`
 }
 
-func (us UpstreamState) State() UpstreamStateEnum {
-	return us.state
+// Route matches the http requests to a host, any host when empty, whose
+// path starts with Path, or is Path when Exact
+type Route struct {
+	Host  string
+	Path  string
+	Exact bool
 }
 
-func NewUpstreamState(u *Upstream, newState UpstreamStateEnum) *UpstreamState {
-	return &UpstreamState{
-		upstream: u,
-		state:    newState,
+func (r Route) ToString() string {
+	if r.Exact {
+		return fmt.Sprintf("%s%s (exact)", r.Host, r.Path)
 	}
+	return r.Host + r.Path
 }
 
-func (us *UpstreamState) Update(newState UpstreamStateEnum) {
-	if us.state != newState {
-		log.Debugf("change state of upstream <%s> to [%s]", us.upstream.Key(), newState)
-		us.state = newState
+// Match tells whether a request to host and path follows the route, host
+// may carry a port
+func (r Route) Match(host, path string) bool {
+	if r.Host != "" {
+		if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+			host = host[:i]
+		}
+		if !strings.EqualFold(r.Host, host) {
+			return false
+		}
+	}
+
+	switch {
+	case r.Path == "" || r.Path == "/":
+		return !r.Exact || path == "/"
+	case r.Exact:
+		return path == r.Path
+	default:
+		// /foo matches /foo and /foo/bar, not /foobar
+		prefix := strings.TrimSuffix(r.Path, "/")
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
 	}
 }
 
+type UpstreamKey struct {
+	Proto string
+	Ip    string
+	Port  string
+}
+
+func (uk UpstreamKey) ToString() string {
+	return fmt.Sprintf("%s://%s:%s", uk.Proto, uk.Ip, uk.Port)
+}
+
 func (u *Upstream) ToString() string {
 	targets := []string{}
 	for _, t := range u.Targets {
@@ -71,98 +87,35 @@ func (u *Upstream) ToString() string {
 	return fmt.Sprintf("%s-%s-%s-%s Targets: \n %s", u.ServiceName, u.FrontendProto, u.FrontendIp, u.FrontendPort, strings.Join(targets, "\n  "))
 }
 
-func (u *Upstream) Equal(u1 *Upstream) bool {
-	fieldsEqual := u.ServiceName == u1.ServiceName &&
-		u.FrontendPort == u1.FrontendPort &&
+func (u *Upstream) EntryPointEqual(u1 *Upstream) bool {
+	fieldsEqual := u.FrontendPort == u1.FrontendPort &&
 		u.FrontendIp == u1.FrontendIp &&
 		u.FrontendProto == u1.FrontendProto
 
-	targetsSizeEqual := len(u.Targets) == len(u1.Targets)
-
-	targetsEqual := true
-	uTargets := make([]string, 0)
-	for _, t := range u.Targets {
-		uTargets = append(uTargets, t.ToString())
-	}
-	u1Targets := make([]string, 0)
-	for _, t := range u1.Targets {
-		u1Targets = append(u1Targets, t.ToString())
-	}
-	for index, targetStr := range uTargets {
-		if targetStr != uTargets[index] {
-			targetsEqual = false
-		}
-	}
-
-	return fieldsEqual && targetsSizeEqual && targetsEqual
+	return fieldsEqual
 }
 
-func (u *Upstream) FieldsEqualButTargetsDiffer(u1 *Upstream) bool {
-	fieldsEqual := u.ServiceName == u1.ServiceName &&
-		u.FrontendPort == u1.FrontendPort &&
-		u.FrontendIp == u1.FrontendIp &&
-		u.FrontendProto == u1.FrontendProto
-
-	if !fieldsEqual {
+// RoutesEqual tells whether two upstreams have the same routes in any order
+func (u *Upstream) RoutesEqual(u1 *Upstream) bool {
+	if len(u.Routes) != len(u1.Routes) {
 		return false
 	}
-
-	targetsSizeEqual := len(u.Targets) == len(u1.Targets)
-
-	if fieldsEqual && !targetsSizeEqual {
-		return true
+	routes := make([]string, 0, len(u.Routes))
+	for _, r := range u.Routes {
+		routes = append(routes, r.ToString())
 	}
-
-	targetsEqual := true
-	uTargets := make([]string, 0)
-	u1Targets := make([]string, 0)
-
-	for _, t := range u.Targets {
-		uTargets = append(uTargets, t.ToString())
+	routes1 := make([]string, 0, len(u1.Routes))
+	for _, r := range u1.Routes {
+		routes1 = append(routes1, r.ToString())
 	}
-	for _, t := range u1.Targets {
-		u1Targets = append(u1Targets, t.ToString())
-	}
-
-	sort.Strings(uTargets)
-	sort.Strings(u1Targets)
-
-	for index, targetStr := range uTargets {
-		if targetStr != u1Targets[index] {
-			targetsEqual = false
+	sort.Strings(routes)
+	sort.Strings(routes1)
+	for i := range routes {
+		if routes[i] != routes1[i] {
+			return false
 		}
 	}
-
-	return (fieldsEqual && !targetsSizeEqual) || (fieldsEqual && !targetsEqual)
-}
-
-func (u *Upstream) FieldsEqual(u1 *Upstream) bool {
-	fieldsEqual := u.ServiceName == u1.ServiceName &&
-		u.FrontendPort == u1.FrontendPort &&
-		u.FrontendIp == u1.FrontendIp &&
-		u.FrontendProto == u1.FrontendProto
-
-	return fieldsEqual
-}
-
-func (u *Upstream) EntryPointEqual(u1 *Upstream) bool {
-	fieldsEqual := u.FrontendPort == u1.FrontendPort &&
-		u.FrontendIp == u1.FrontendIp &&
-		u.FrontendProto == u1.FrontendProto
-
-	return fieldsEqual
-}
-
-func (u *Upstream) SetState(newState UpstreamStateEnum) {
-	if u.State == nil {
-		u.State = NewUpstreamState(u, newState)
-	} else {
-		u.State.Update(newState)
-	}
-}
-
-func (u *Upstream) StateIs(expectState UpstreamStateEnum) bool {
-	return u.State.state == expectState
+	return true
 }
 
 func (u *Upstream) Key() UpstreamKey {
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/Dataman-Cloud/janitor/src/config"
@@ -12,20 +13,104 @@ type UpstreamLoader interface {
 	Poll()
 	List() []*Upstream
 	Get(serviceName string) *Upstream
-	Remove(upstream *Upstream)
-	ChangeNotify() <-chan bool
+	Events() <-chan UpstreamEvent
+	Conflicts() []FrontendConflict
+	Reload(Config config.Upstream)
 }
 
+// InitAndStartUpstreamLoader starts the loader of upstream.source_type,
+// several sources separated by commas are combined by a composite loader.
+// With upstream.snapshot_path the last upstreams loaded are served on
+// startup until the sources synced
 func InitAndStartUpstreamLoader(ctx context.Context, Config config.Config) (UpstreamLoader, error) {
+	upstreamLoader, err := initSourcesUpstreamLoader(ctx, Config)
+	if err != nil || Config.Upstream.SnapshotPath == "" {
+		return upstreamLoader, err
+	}
+	return InitSnapshotUpstreamLoader(Config.Upstream, upstreamLoader)
+}
+
+func initSourcesUpstreamLoader(ctx context.Context, Config config.Config) (UpstreamLoader, error) {
+	sources := strings.Split(strings.ToLower(Config.Upstream.SourceType), ",")
+	for i := range sources {
+		sources[i] = strings.TrimSpace(sources[i])
+	}
+	if len(sources) == 1 {
+		return initUpstreamLoader(sources[0], Config, OverridesFromContext(ctx))
+	}
+
+	loaders := make([]UpstreamLoader, 0, len(sources))
+	for _, source := range sources {
+		// the overrides are applied once, to the merged upstreams
+		loader, err := initUpstreamLoader(source, Config, nil)
+		if err != nil {
+			return nil, err
+		}
+		loaders = append(loaders, loader)
+	}
+	return InitCompositeUpstreamLoader(Config.Upstream, sources, loaders, OverridesFromContext(ctx))
+}
+
+func initUpstreamLoader(source string, Config config.Config, overrides *Overrides) (UpstreamLoader, error) {
 	var upstreamLoader UpstreamLoader
 	var err error
-	switch strings.ToLower(Config.Upstream.SourceType) {
+	switch source {
 	case "consul":
-		upstreamLoader, err = InitConsulUpstreamLoader(Config.Upstream.ConsulAddr, Config.Listener.IP, Config.Upstream.PollInterval)
+		upstreamLoader, err = InitConsulUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	case "etcd":
+		upstreamLoader, err = InitEtcdUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	case "marathon":
+		upstreamLoader, err = InitMarathonUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
 		if err != nil {
 			return nil, err
 		}
+	case "kubernetes":
+		upstreamLoader, err = InitKubernetesUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	case "docker":
+		upstreamLoader, err = InitDockerUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	case "dns":
+		upstreamLoader, err = InitDNSUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	case "file":
+		upstreamLoader, err = InitFileUpstreamLoader(Config.Upstream, Config.Listener.IP, overrides)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("upstream source type %s is not supported", source)
 	}
 
 	return upstreamLoader, nil
 }
+
+// FindConsulUpstreamLoader returns the consul loader behind loader, nil
+// when upstreams are not loaded from consul
+func FindConsulUpstreamLoader(loader UpstreamLoader) *ConsulUpstreamLoader {
+	switch l := loader.(type) {
+	case *ConsulUpstreamLoader:
+		return l
+	case *SnapshotUpstreamLoader:
+		return FindConsulUpstreamLoader(l.Loader)
+	case *CompositeUpstreamLoader:
+		for _, child := range l.Loaders {
+			if consulUpstreamLoader := FindConsulUpstreamLoader(child); consulUpstreamLoader != nil {
+				return consulUpstreamLoader
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package upstream
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// who gets a frontend claimed by several services, the one served or
+	// seen first, the one of the highest borg-frontend-priority, or none
+	CONFLICT_FIRST_REGISTERED = "first_registered"
+	CONFLICT_PRIORITY         = "priority"
+	CONFLICT_REFUSE           = "refuse"
+)
+
+// frontendConflicts counts the conflicts found since startup
+var frontendConflicts = expvar.NewInt("frontend_conflicts")
+
+// FrontendConflict is a frontend claimed by several services, Refused
+// are the ones left unserved. Reason tells why when the frontend is not
+// served for another service, like a service of several sources
+type FrontendConflict struct {
+	Key     UpstreamKey
+	Policy  string
+	Served  string `json:",omitempty"`
+	Refused []string
+	Reason  string `json:",omitempty"`
+}
+
+func (c FrontendConflict) ToString() string {
+	if c.Reason != "" {
+		return fmt.Sprintf("%s is claimed by %s, %s (%s)", c.Key.ToString(), strings.Join(c.Refused, ", "), c.Reason, c.Policy)
+	}
+	if c.Served == "" {
+		return fmt.Sprintf("%s is claimed by %s, none of them is served (%s)", c.Key.ToString(), strings.Join(c.Refused, ", "), c.Policy)
+	}
+	return fmt.Sprintf("%s is claimed by %s, served for %s (%s)", c.Key.ToString(), strings.Join(c.Refused, ", "), c.Served, c.Policy)
+}
+
+// upstreamSet holds the upstreams served for a loader and turns every
+// load into the events changing them, loaders guard it with their lock
+type upstreamSet struct {
+	overrides      *Overrides
+	conflictPolicy string
+	upstreams      map[string]*Upstream // service name -> upstream served
+	events         chan UpstreamEvent
+	syncOnce       sync.Once
+
+	conflicts map[UpstreamKey]FrontendConflict
+	seen      map[string]uint64 // service name -> order it was first loaded in
+	seenCount uint64
+}
+
+func newUpstreamSet(overrides *Overrides, conflictPolicy string) *upstreamSet {
+	if conflictPolicy == "" {
+		conflictPolicy = CONFLICT_FIRST_REGISTERED
+	}
+	return &upstreamSet{
+		overrides:      overrides,
+		conflictPolicy: conflictPolicy,
+		upstreams:      make(map[string]*Upstream),
+		events:         make(chan UpstreamEvent, 1024),
+		conflicts:      make(map[UpstreamKey]FrontendConflict),
+		seen:           make(map[string]uint64),
+	}
+}
+
+// update applies the overrides to a fresh load of upstreams and sends
+// what changed since the previous one, a frontend claimed by several
+// services is given following the conflict policy
+func (set *upstreamSet) update(loaded []*Upstream) {
+	set.updateWithConflicts(loaded, nil)
+}
+
+// updateWithConflicts is update for a load whose claims were already
+// resolved in part, the conflicts found then, one per frontend, are
+// reported along with the ones of the load
+func (set *upstreamSet) updateWithConflicts(loaded []*Upstream, resolved []FrontendConflict) {
+	// services new to the set are seen in the order of their source
+	loadedNames := make(map[string]bool, len(loaded))
+	for _, upstream := range loaded {
+		loadedNames[upstream.ServiceName] = true
+		if _, found := set.seen[upstream.ServiceName]; !found {
+			set.seenCount++
+			set.seen[upstream.ServiceName] = set.seenCount
+		}
+	}
+	for serviceName := range set.seen {
+		if !loadedNames[serviceName] {
+			delete(set.seen, serviceName)
+		}
+	}
+	sort.Sort(upstreamsByService(loaded))
+
+	keys := make([]UpstreamKey, 0)
+	claims := make(map[UpstreamKey][]*Upstream)
+	for _, upstream := range loaded {
+		set.overrides.Apply(upstream)
+
+		// a service is served once it has a target, then kept while it is
+		// registered so that its frontend answers with no route
+		if _, served := set.upstreams[upstream.ServiceName]; !served && len(upstream.Targets) == 0 {
+			continue
+		}
+
+		if _, found := claims[upstream.Key()]; !found {
+			keys = append(keys, upstream.Key())
+		}
+		claims[upstream.Key()] = append(claims[upstream.Key()], upstream)
+	}
+
+	latestUpstreams := make(map[string]*Upstream)
+	conflicts := make(map[UpstreamKey]FrontendConflict)
+	for _, key := range keys {
+		claimants := claims[key]
+		if len(claimants) == 1 {
+			latestUpstreams[claimants[0].ServiceName] = claimants[0]
+			continue
+		}
+
+		winner := set.resolve(key, claimants)
+		conflict := FrontendConflict{Key: key, Policy: set.conflictPolicy, Refused: make([]string, 0, len(claimants))}
+		for _, upstream := range claimants {
+			if upstream == winner {
+				conflict.Served = upstream.ServiceName
+				latestUpstreams[upstream.ServiceName] = upstream
+			} else {
+				conflict.Refused = append(conflict.Refused, upstream.ServiceName)
+			}
+		}
+		conflicts[key] = conflict
+	}
+	for _, conflict := range resolved {
+		if _, found := claims[conflict.Key]; !found {
+			keys = append(keys, conflict.Key)
+		}
+		conflicts[conflict.Key] = conflict
+	}
+
+	for _, event := range DiffUpstreams(set.upstreams, latestUpstreams) {
+		if event.Type == EVENT_UPSTREAM_REMOVED {
+			delete(set.upstreams, event.Upstream.ServiceName)
+		} else {
+			set.upstreams[event.Upstream.ServiceName] = event.Upstream
+		}
+
+		// the janitor server never calls back into a loader while
+		// handling an event, so sending with the lock held is safe
+		log.Debugf("%s %s", event.Type, event.Upstream.ToString())
+		set.events <- event
+	}
+
+	for _, key := range keys {
+		conflict, found := conflicts[key]
+		if !found {
+			continue
+		}
+		if previous, found := set.conflicts[key]; found && previous.ToString() == conflict.ToString() {
+			continue
+		}
+		log.Warnf("frontend conflict: %s", conflict.ToString())
+		frontendConflicts.Add(1)
+		c := conflict
+		set.events <- UpstreamEvent{Type: EVENT_FRONTEND_CONFLICT, Conflict: &c}
+	}
+	set.conflicts = conflicts
+}
+
+// resolve returns the claimant of key to serve, nil when the policy
+// refuses all of them
+func (set *upstreamSet) resolve(key UpstreamKey, claimants []*Upstream) *Upstream {
+	if set.conflictPolicy == CONFLICT_REFUSE {
+		return nil
+	}
+
+	ordered := make([]*Upstream, len(claimants))
+	copy(ordered, claimants)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if set.conflictPolicy == CONFLICT_PRIORITY && ordered[i].Settings.Priority != ordered[j].Settings.Priority {
+			return ordered[i].Settings.Priority > ordered[j].Settings.Priority
+		}
+		// the service already serving the frontend keeps it, then the
+		// one registered first in the source, then the one loaded first
+		servedI, servedJ := set.serves(ordered[i], key), set.serves(ordered[j], key)
+		if servedI != servedJ {
+			return servedI
+		}
+		registeredI, registeredJ := ordered[i].RegisteredIndex, ordered[j].RegisteredIndex
+		if (registeredI == 0) != (registeredJ == 0) {
+			return registeredI != 0
+		}
+		if registeredI != registeredJ {
+			return registeredI < registeredJ
+		}
+		return set.seen[ordered[i].ServiceName] < set.seen[ordered[j].ServiceName]
+	})
+	return ordered[0]
+}
+
+func (set *upstreamSet) serves(upstream *Upstream, key UpstreamKey) bool {
+	served, found := set.upstreams[upstream.ServiceName]
+	return found && served.Key() == key
+}
+
+// conflictList returns the current conflicts ordered by frontend
+func (set *upstreamSet) conflictList() []FrontendConflict {
+	conflicts := make([]FrontendConflict, 0, len(set.conflicts))
+	for _, conflict := range set.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Key.ToString() < conflicts[j].Key.ToString() })
+	return conflicts
+}
+
+// synced sends EVENT_SYNCED after the first complete load
+func (set *upstreamSet) synced() {
+	set.syncOnce.Do(func() {
+		set.events <- UpstreamEvent{Type: EVENT_SYNCED}
+	})
+}
+
+func (set *upstreamSet) list() []*Upstream {
+	upstreams := make([]*Upstream, 0, len(set.upstreams))
+	for _, serviceName := range sortedServiceNames(set.upstreams) {
+		upstreams = append(upstreams, set.upstreams[serviceName])
+	}
+	return upstreams
+}
+
+func (set *upstreamSet) get(serviceName string) *Upstream {
+	return set.upstreams[serviceName]
+}
+
+type upstreamsByService []*Upstream
+
+func (s upstreamsByService) Len() int           { return len(s) }
+func (s upstreamsByService) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s upstreamsByService) Less(i, j int) bool { return s[i].ServiceName < s[j].ServiceName }
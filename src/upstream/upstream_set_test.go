@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drainSetEvents(set *upstreamSet) []UpstreamEvent {
+	events := make([]UpstreamEvent, 0)
+	for {
+		select {
+		case event := <-set.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestUpstreamSetConflictFirstRegistered(t *testing.T) {
+	set := newUpstreamSet(nil, CONFLICT_FIRST_REGISTERED)
+	set.update([]*Upstream{testUpstream("web", "8080", "10.0.0.1")})
+	drainSetEvents(set)
+
+	// web registered first keeps 8080 though api sorts before it
+	set.update([]*Upstream{testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2")})
+	events := drainSetEvents(set)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Type, EVENT_FRONTEND_CONFLICT)
+	assert.Equal(t, events[0].Conflict.Served, "web")
+	assert.Equal(t, events[0].Conflict.Refused, []string{"api"})
+	assert.Equal(t, len(set.conflictList()), 1)
+
+	// the same conflict is reported once
+	set.update([]*Upstream{testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2")})
+	assert.Equal(t, len(drainSetEvents(set)), 0)
+
+	// api takes 8080 over once web is gone
+	set.update([]*Upstream{testUpstream("api", "8080", "10.0.0.2")})
+	events = drainSetEvents(set)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Type, EVENT_UPSTREAM_REMOVED)
+	assert.Equal(t, events[1].Type, EVENT_UPSTREAM_ADDED)
+	assert.Equal(t, events[1].Upstream.ServiceName, "api")
+	assert.Equal(t, len(set.conflictList()), 0)
+}
+
+func TestUpstreamSetConflictRegisteredOrder(t *testing.T) {
+	// on a first load, like after a restart, web registered first in the
+	// source keeps 8080 though api sorts before it
+	set := newUpstreamSet(nil, CONFLICT_FIRST_REGISTERED)
+	web, api := testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2")
+	web.RegisteredIndex, api.RegisteredIndex = 5, 9
+	set.update([]*Upstream{api, web})
+	events := drainSetEvents(set)
+	assert.Equal(t, events[len(events)-1].Conflict.Served, "web")
+
+	// without registration order, the order of the source is kept
+	set = newUpstreamSet(nil, CONFLICT_FIRST_REGISTERED)
+	set.update([]*Upstream{testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2")})
+	events = drainSetEvents(set)
+	assert.Equal(t, events[len(events)-1].Conflict.Served, "web")
+}
+
+func TestUpstreamSetConflictPriority(t *testing.T) {
+	set := newUpstreamSet(nil, CONFLICT_PRIORITY)
+	web, api := testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2")
+	web.Settings.Priority = 10
+	set.update([]*Upstream{api})
+	set.update([]*Upstream{api, web})
+
+	events := drainSetEvents(set)
+	assert.Equal(t, events[len(events)-1].Type, EVENT_FRONTEND_CONFLICT)
+	assert.Equal(t, events[len(events)-1].Conflict.Served, "web")
+	assert.Equal(t, set.get("web").ServiceName, "web")
+	assert.Nil(t, set.get("api"))
+}
+
+func TestUpstreamSetConflictRefuse(t *testing.T) {
+	set := newUpstreamSet(nil, CONFLICT_REFUSE)
+	set.update([]*Upstream{testUpstream("web", "8080", "10.0.0.1"), testUpstream("api", "8080", "10.0.0.2"), testUpstream("db", "5432", "10.0.0.3")})
+
+	events := drainSetEvents(set)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Upstream.ServiceName, "db")
+	assert.Equal(t, events[1].Conflict.Served, "")
+	assert.Equal(t, events[1].Conflict.Refused, []string{"api", "web"})
+	assert.Equal(t, len(set.list()), 1)
+}